@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// parseHeaders() parses extra headers for the backend, each as "Name: value"
+func parseHeaders(specs []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.ContainsAny(parts[0], " \t") {
+			return nil, fmt.Errorf("Invalid --header %q, should be \"Name: value\"", spec)
+		}
+		h.Add(parts[0], strings.TrimSpace(parts[1]))
+	}
+	return h, nil
+}
+
+// tlsConfig() returns the TLS settings for the backend. Certificates are only verified if asked
+// to, or against the CAs in caFile. A client certificate is presented if certFile is given.
+func tlsConfig(verify bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: !verify && caFile == ""}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read --ca-file: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in --ca-file %q", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if keyFile == "" {
+			keyFile = certFile // both in one file
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load --client-cert: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
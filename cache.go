@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ResponseCache keeps responses that came with an ETag or Last-Modified, to ask the backend with
+// conditional requests if they changed, and reuse them if not
+type ResponseCache struct {
+	Dir string
+}
+
+// cachedResponse is a response as kept in the cache, one file per URL
+type cachedResponse struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// file() returns the cache file for url
+func (rc *ResponseCache) file(url string) string {
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	return filepath.Join(rc.Dir, fmt.Sprintf("check_graphite_%016x.cache", h.Sum64()))
+}
+
+// Get() returns the cached response for url, or nil if there's none
+func (rc *ResponseCache) Get(url string) (*cachedResponse, error) {
+	data, err := ioutil.ReadFile(rc.file(url))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cr := &cachedResponse{}
+	if err := json.Unmarshal(data, cr); err != nil {
+		return nil, fmt.Errorf("%s: %v", rc.file(url), err)
+	}
+	if cr.URL != url {
+		return nil, nil // another URL with the same hash
+	}
+	return cr, nil
+}
+
+// Put() saves a response for url, if it has what a conditional request needs
+func (rc *ResponseCache) Put(url string, h http.Header, body []byte) error {
+	cr := &cachedResponse{URL: url, ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified"), Body: body}
+	if cr.ETag == "" && cr.LastModified == "" {
+		return nil
+	}
+	data, err := json.Marshal(cr)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rc.Dir, 0755); err != nil {
+		return err
+	}
+	// write and rename, so concurrent checks never read half a file
+	tmp, err := ioutil.TempFile(rc.Dir, ".check_graphite_cache")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), rc.file(url))
+}
+
+// conditions() returns the headers asking for the response only if it changed since this one
+func (cr *cachedResponse) conditions() http.Header {
+	h := make(http.Header)
+	if cr.ETag != "" {
+		h.Set("If-None-Match", cr.ETag)
+	}
+	if cr.LastModified != "" {
+		h.Set("If-Modified-Since", cr.LastModified)
+	}
+	return h
+}
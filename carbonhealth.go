@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_CARBON_PREFIX string = "carbon.agents.*"
+)
+
+// HealthCheck is one of the built in checks for the health of Carbon itself
+type HealthCheck struct {
+	Name      string // used for flag names and in output
+	Metric    string // appended to the carbon prefix
+	Condition string
+	Warn      float64
+	Crit      float64
+	HasWarn   bool
+	HasCrit   bool
+}
+
+// The defaults are meant to be sensible for an average setup. Each can be overridden with
+// --<name>-warning and --<name>-critical.
+var carbonHealthChecks = []HealthCheck{
+	{Name: "cache-size", Metric: "cache.size", Condition: CMP_GT, Warn: 1000000, Crit: 5000000, HasWarn: true, HasCrit: true},
+	{Name: "metrics-received", Metric: "metricsReceived", Condition: CMP_LT, Crit: 1, HasCrit: true},
+	{Name: "errors", Metric: "errors", Condition: CMP_GT, Warn: 0, Crit: 10, HasWarn: true, HasCrit: true},
+	{Name: "cpu-usage", Metric: "cpuUsage", Condition: CMP_GT, Warn: 80, Crit: 95, HasWarn: true, HasCrit: true},
+}
+
+// carbonHealthFlags() generates the threshold flags for all built in checks
+func carbonHealthFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "prefix",
+			Value: DEF_CARBON_PREFIX,
+			Usage: "Metric prefix for the Carbon agents to check",
+		},
+		cli.StringFlag{
+			Name:  "timeperiod, T",
+			Value: DEF_PERIOD,
+			Usage: "Timeperiod for selection",
+		},
+	}
+	for _, hc := range carbonHealthChecks {
+		flags = append(flags,
+			cli.Float64Flag{
+				Name:  hc.Name + "-warning",
+				Value: hc.Warn,
+				Usage: fmt.Sprintf("WARNING threshold for %s (%s)", hc.Metric, hc.Condition),
+			},
+			cli.Float64Flag{
+				Name:  hc.Name + "-critical",
+				Value: hc.Crit,
+				Usage: fmt.Sprintf("CRITICAL threshold for %s (%s)", hc.Metric, hc.Condition),
+			},
+		)
+	}
+	return flags
+}
+
+// worstStatus() returns the most severe of two exit codes, with UNKNOWN ranked between OK and WARNING
+func worstStatus(a, b int) int {
+	rank := func(ecode int) int {
+		switch ecode {
+		case E_OK:
+			return 0
+		case E_UNKNOWN:
+			return 1
+		case E_WARNING:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+// statusText() returns the status string for an exit code
+func statusText(ecode int) string {
+	switch ecode {
+	case E_OK:
+		return S_OK
+	case E_WARNING:
+		return S_WARNING
+	case E_CRITICAL:
+		return S_CRITICAL
+	default:
+		return S_UNKNOWN
+	}
+}
+
+// parseStatus() returns the exit code for a status string, like WARNING, in any case
+func parseStatus(s string) (int, error) {
+	for _, ecode := range []int{E_OK, E_WARNING, E_CRITICAL, E_UNKNOWN} {
+		if strings.EqualFold(s, statusText(ecode)) {
+			return ecode, nil
+		}
+	}
+	return E_UNKNOWN, fmt.Errorf("unknown status %q (options: %s, %s, %s, %s)", s, S_OK, S_WARNING, S_CRITICAL, S_UNKNOWN)
+}
+
+// run_carbon_health() runs all built in Carbon checks in parallel and reports the worst status
+func run_carbon_health(c *cli.Context) {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	prefix := strings.TrimSuffix(c.String("prefix"), ".")
+	period := c.String("timeperiod")
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ds, err := NewDatasource(BE_GRAPHITE, base)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+
+	checks := make([]HealthCheck, len(carbonHealthChecks))
+	chans := make([]chan GraphiteResponse, len(carbonHealthChecks))
+	for i, hc := range carbonHealthChecks {
+		if c.IsSet(hc.Name + "-warning") {
+			hc.HasWarn = true
+		}
+		if c.IsSet(hc.Name + "-critical") {
+			hc.HasCrit = true
+		}
+		hc.Warn = c.Float64(hc.Name + "-warning")
+		hc.Crit = c.Float64(hc.Name + "-critical")
+		checks[i] = hc
+
+		log.Debugf("Checking %s", hc.Name)
+		chans[i] = make(chan GraphiteResponse, 1) // buffered, so late responses don't block after a timeout
+		go parse(ctx, ds, []string{prefix + "." + hc.Metric}, Window{Period: period}, chans[i])
+	}
+
+	ecode := E_OK
+	var summary []string
+	var perf, lo bytes.Buffer
+	for i, hc := range checks {
+		var res GraphiteResponse
+		select {
+		case res = <-chans[i]:
+		case <-ctx.Done():
+			fmt.Printf("%s: Timed out after %d seconds", S_CRITICAL, int(tmout))
+			exit(E_CRITICAL)
+		}
+		if res.Err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				fmt.Printf("%s: Timed out after %d seconds", S_CRITICAL, int(tmout))
+				exit(E_CRITICAL)
+			}
+			fmt.Printf("%s: Error parsing result for %s: %q", S_CRITICAL, hc.Metric, res.Err)
+			exit(E_CRITICAL)
+		}
+
+		wpred, cpred := Never, Never
+		if hc.HasWarn {
+			wpred = Threshold(hc.Condition, hc.Warn)
+		}
+		if hc.HasCrit {
+			cpred = Threshold(hc.Condition, hc.Crit)
+		}
+		o, w, cr := res.MS.FilterOffenders(wpred, cpred)
+		cr.SortFor(hc.Condition)
+		w.SortFor(hc.Condition)
+		o.SortFor(hc.Condition)
+
+		hcode := E_OK
+		var detail string
+		switch {
+		case len(res.MS) == 0:
+			hcode = E_UNKNOWN
+			detail = "no values"
+		case len(cr) > 0:
+			hcode = E_CRITICAL
+			detail = fmt.Sprintf("%d agents", len(cr))
+		case len(w) > 0:
+			hcode = E_WARNING
+			detail = fmt.Sprintf("%d agents", len(w))
+		default:
+			detail = fmt.Sprintf("%d agents", len(o))
+		}
+		ecode = worstStatus(ecode, hcode)
+		summary = append(summary, fmt.Sprintf("%s %s (%s)", hc.Metric, statusText(hcode), detail))
+
+		// the worst value is the most interesting one for graphing
+		worst := res.MS.Max()
+		if hc.Condition == CMP_LT || hc.Condition == CMP_LE {
+			worst = res.MS.Min()
+		}
+		var s_warn, s_crit string
+		if hc.HasWarn {
+			s_warn = fmt.Sprintf("%f", hc.Warn)
+		}
+		if hc.HasCrit {
+			s_crit = fmt.Sprintf("%f", hc.Crit)
+		}
+		label := strings.Replace(hc.Name, "-", "_", -1)
+		fmt.Fprintf(&perf, " %s=%f;%s;%s;; %s_response_time=%fs;;;",
+			label, worst, s_warn, s_crit, label, res.RT)
+
+		fmt.Fprintf(&lo, "=====> %s:\n%s", hc.Metric, long_output(o, w, cr, res.MS.LongestKey(), 0, false))
+	}
+
+	fmt.Printf("%s: Carbon health: %s |%s\n\n%s", statusText(ecode), strings.Join(summary, ", "),
+		strings.TrimPrefix(perf.String(), " "), lo.String())
+	exit(ecode)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Coalescer makes requests for the same URL share one response, for checks run as a batch,
+// where many may query the same wildcard
+type Coalescer struct {
+	mu     sync.Mutex
+	calls  map[string]*coalescedCall
+	saved  int64 // requests not made thanks to it, accessed atomically
+	flight bool  // share only requests in flight, for checks run at intervals that need fresh data
+}
+
+// coalescedCall is a request, made or in flight, that others wait for
+type coalescedCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewCoalescer() returns a Coalescer for one batch run
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// NewFlightCoalescer() returns a Coalescer that forgets a response once it's been handed out,
+// for the daemon, where the same URL asked for later must get what the backend has then
+func NewFlightCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall), flight: true}
+}
+
+type coalescerKey struct{}
+
+// withCoalescer() returns a context that has the requests made with it share responses through co
+func withCoalescer(ctx context.Context, co *Coalescer) context.Context {
+	return context.WithValue(ctx, coalescerKey{}, co)
+}
+
+// coalescerFrom() returns the Coalescer for a request made with ctx, or nil
+func coalescerFrom(ctx context.Context) *Coalescer {
+	co, _ := ctx.Value(coalescerKey{}).(*Coalescer)
+	return co
+}
+
+// Do() returns the body of url as fetch gets it, calling fetch only for the first caller. The others
+// wait for it, and are told that the body was shared. Failed requests aren't kept, so later calls retry,
+// nor are any once done when sharing only those in flight.
+func (co *Coalescer) Do(ctx context.Context, url string, fetch func() ([]byte, error)) ([]byte, bool, error) {
+	co.mu.Lock()
+	if cl, ok := co.calls[url]; ok {
+		co.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if cl.err == nil {
+			atomic.AddInt64(&co.saved, 1)
+		}
+		return cl.data, true, cl.err
+	}
+	cl := &coalescedCall{done: make(chan struct{})}
+	co.calls[url] = cl
+	co.mu.Unlock()
+
+	cl.data, cl.err = fetch()
+	if cl.err != nil || co.flight {
+		co.mu.Lock()
+		delete(co.calls, url)
+		co.mu.Unlock()
+	}
+	close(cl.done)
+	return cl.data, false, cl.err
+}
+
+// Saved() returns how many requests were answered with the response of another
+func (co *Coalescer) Saved() int64 {
+	return atomic.LoadInt64(&co.saved)
+}
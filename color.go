@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ANSI colors for the states, for output on a terminal
+const (
+	COL_RED    string = "\x1b[31m"
+	COL_YELLOW string = "\x1b[33m"
+	COL_GREEN  string = "\x1b[32m"
+	COL_RESET  string = "\x1b[0m"
+)
+
+// stateColor() returns the color of a status word, "" for UNKNOWN or none
+func stateColor(status string) string {
+	switch status {
+	case S_OK:
+		return COL_GREEN
+	case S_WARNING:
+		return COL_YELLOW
+	case S_CRITICAL:
+		return COL_RED
+	}
+	return ""
+}
+
+// useColor() tells if output should be colored: when stdout is a terminal, and not run by
+// Nagios or alike, which sets NAGIOS_ or ICINGA_ environment variables. NO_COLOR is honoured.
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "NAGIOS_") || strings.HasPrefix(kv, "ICINGA_") {
+			return false
+		}
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize() colors the status word of Nagios output, and each section of metrics in a state in
+// the long output, by state
+func colorize(out string) string {
+	lines := strings.Split(out, "\n")
+	if i := strings.Index(lines[0], ":"); i > 0 {
+		if col := stateColor(lines[0][:i]); col != "" {
+			lines[0] = col + lines[0][:i] + COL_RESET + lines[0][i:]
+		}
+	}
+	var col string
+	for i := 1; i < len(lines); i++ {
+		switch {
+		case strings.HasPrefix(lines[i], "===> Metrics in state "):
+			col = stateColor(strings.TrimSuffix(strings.TrimPrefix(lines[i], "===> Metrics in state "), ":"))
+		case lines[i] == "":
+			col = ""
+		}
+		if col != "" {
+			lines[i] = col + lines[i] + COL_RESET
+		}
+	}
+	return strings.Join(lines, "\n")
+}
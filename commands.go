@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	URL_FINDTMPL string = "/metrics/find?query=%s" // find path template
+)
+
+// inheritFlags() sets the flags not given to a subcommand that has all the flags of the app, like check,
+// to what was given before the subcommand, so flags work on both sides of it
+func inheritFlags(c *cli.Context, flags []cli.Flag) error {
+	for _, f := range flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if c.IsSet(name) || !c.GlobalIsSet(name) {
+			continue
+		}
+		vals := []string{c.GlobalString(name)}
+		if _, ok := f.(cli.StringSliceFlag); ok {
+			vals = c.GlobalStringSlice(name)
+		}
+		for _, v := range vals {
+			if err := c.Set(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run_version() prints the version
+func run_version(c *cli.Context) {
+	fmt.Printf("%s version %s\n", c.App.Name, c.App.Version)
+}
+
+// FindResult is one node in a response from the Graphite find API
+type FindResult struct {
+	Text string `json:"text"`
+	ID   string `json:"id"`
+	Leaf int    `json:"leaf"`
+}
+
+// run_find() lists the nodes at the level of the tree a query ends at, like browsing the Graphite
+// tree, where expand lists whole series
+func run_find(c *cli.Context) error {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	query := c.Args().First()
+	if query == "" {
+		return cli.NewExitError("No query given", E_UNKNOWN)
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	u := base + fmt.Sprintf(URL_FINDTMPL, url.QueryEscape(query))
+	log.Debugf("URL: %s\n", u)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	resp, err := geturl(ctx, u)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to find %q: %v", query, err), E_UNKNOWN)
+	}
+	defer resp.Body.Close()
+	if err := respError(resp); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to find %q: %v", query, err), E_UNKNOWN)
+	}
+	var nodes []FindResult
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to find %q: %v", query, err), E_UNKNOWN)
+	}
+	for _, n := range nodes {
+		if n.Leaf == 1 {
+			fmt.Println(n.ID)
+		} else {
+			fmt.Println(n.ID + ".") // a branch, with more below
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%q matches %d nodes\n", query, len(nodes))
+	return nil
+}
+
+// run_dump() prints all datapoints of the series a target matches, as CSV, to see what a check gets
+func run_dump(c *cli.Context) error {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	target := c.Args().First()
+	if target == "" {
+		return cli.NewExitError("No target given", E_UNKNOWN)
+	}
+	window, err := NewWindow(c.String("timeperiod"), c.String("offset"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	ds, err := NewDatasource(c.GlobalString("backend"), base)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	ms, err := ds.Fetch(ctx, target, window)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to fetch %q: %v", target, err), E_UNKNOWN)
+	}
+	ms.SortByPath()
+	for _, m := range ms {
+		for _, p := range m.Points {
+			fmt.Printf("%s,%s,%g\n", m.Path, p.TS.Format(G_DATEFORMAT), p.Value)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%q matches %d series\n", target, len(ms))
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// composeFlags are the flags of the compose subcommand
+var composeFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "cond",
+		Usage: "Sub condition as NAME=COND:WARN:CRIT:TARGET, e.g. errors=gt:5:10:sumSeries(app.*.errors), where WARN or CRIT may be left empty. Repeat for each.",
+	},
+	cli.StringFlag{
+		Name:  "when",
+		Usage: "How to combine the sub conditions, with AND, OR and parentheses, e.g. \"errors AND traffic\" (default: all of them AND-ed)",
+	},
+	cli.StringFlag{
+		Name:  "timeperiod, T",
+		Value: DEF_PERIOD,
+		Usage: "Timeperiod for selection",
+	},
+}
+
+// SubCondition is one target with its own thresholds, for the compose subcommand. It's in the state of
+// the worst of its metrics.
+type SubCondition struct {
+	Name             string
+	Condition        string
+	Warn, Crit       float64
+	HasWarn, HasCrit bool
+	Target           string
+}
+
+// ParseSubCondition() parses NAME=COND:WARN:CRIT:TARGET
+func ParseSubCondition(spec string) (*SubCondition, error) {
+	i := strings.Index(spec, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("Invalid --cond %q, should be NAME=COND:WARN:CRIT:TARGET", spec)
+	}
+	parts := strings.SplitN(spec[i+1:], ":", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		return nil, fmt.Errorf("Invalid --cond %q, should be NAME=COND:WARN:CRIT:TARGET", spec)
+	}
+	sc := &SubCondition{Name: spec[:i], Condition: parts[0], Target: parts[3]}
+	if !isName(sc.Name) {
+		return nil, fmt.Errorf("Invalid --cond %q: name %q should be letters, digits and _ only", spec, sc.Name)
+	}
+	switch sc.Condition {
+	case CMP_LT, CMP_LE, CMP_GE, CMP_GT:
+	default:
+		return nil, fmt.Errorf("Invalid --cond %q: unknown condition %q", spec, sc.Condition)
+	}
+	var err error
+	if parts[1] != "" {
+		if sc.Warn, err = strconv.ParseFloat(parts[1], 64); err != nil {
+			return nil, fmt.Errorf("Invalid --cond %q: warning threshold %q is not a number", spec, parts[1])
+		}
+		sc.HasWarn = true
+	}
+	if parts[2] != "" {
+		if sc.Crit, err = strconv.ParseFloat(parts[2], 64); err != nil {
+			return nil, fmt.Errorf("Invalid --cond %q: critical threshold %q is not a number", spec, parts[2])
+		}
+		sc.HasCrit = true
+	}
+	if !sc.HasWarn && !sc.HasCrit {
+		return nil, fmt.Errorf("Invalid --cond %q: no warning or critical threshold", spec)
+	}
+	return sc, nil
+}
+
+// isName() tells if s can be the name of a sub condition
+func isName(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Judge() returns the state of the sub condition from its metrics, and the worst value. No values
+// leave it OK, as a sub condition can't be breached without them.
+func (sc *SubCondition) Judge(ms Metrics) (int, float64) {
+	if len(ms) == 0 {
+		return E_OK, 0
+	}
+	worst := ms.Max()
+	if sc.Condition == CMP_LT || sc.Condition == CMP_LE {
+		worst = ms.Min()
+	}
+	switch {
+	case sc.HasCrit && checkIf(sc.Condition, worst, sc.Crit):
+		return E_CRITICAL, worst
+	case sc.HasWarn && checkIf(sc.Condition, worst, sc.Warn):
+		return E_WARNING, worst
+	}
+	return E_OK, worst
+}
+
+// Composition combines the states of sub conditions. AND gives the least severe state of its
+// operands, and OR the most severe, so "a AND b" is only CRITICAL if both are.
+type Composition func(states map[string]int) int
+
+// ParseComposition() parses an expression of names of sub conditions, AND, OR and parentheses
+func ParseComposition(expr string, names map[string]bool) (Composition, error) {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr))
+	pos := 0
+	peek := func() string {
+		if pos < len(tokens) {
+			return tokens[pos]
+		}
+		return ""
+	}
+
+	var parseOr func() (Composition, error)
+	parseFactor := func() (Composition, error) {
+		tok := peek()
+		pos++
+		switch {
+		case tok == "(":
+			c, err := parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if peek() != ")" {
+				return nil, fmt.Errorf("missing ) in %q", expr)
+			}
+			pos++
+			return c, nil
+		case names[tok]:
+			return func(states map[string]int) int { return states[tok] }, nil
+		case tok == "":
+			return nil, fmt.Errorf("unexpected end of %q", expr)
+		}
+		return nil, fmt.Errorf("unknown sub condition %q in %q", tok, expr)
+	}
+	// helper func, parses operands joined by op, combining their states with pick
+	parseOp := func(op string, operand func() (Composition, error), pick func(a, b int) bool) (Composition, error) {
+		c, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		for strings.EqualFold(peek(), op) {
+			pos++
+			left := c
+			right, err := operand()
+			if err != nil {
+				return nil, err
+			}
+			c = func(states map[string]int) int {
+				a, b := left(states), right(states)
+				if pick(b, a) {
+					return b
+				}
+				return a
+			}
+		}
+		return c, nil
+	}
+	parseAnd := func() (Composition, error) {
+		return parseOp("AND", parseFactor, func(a, b int) bool { return a < b })
+	}
+	parseOr = func() (Composition, error) {
+		return parseOp("OR", parseAnd, func(a, b int) bool { return a > b })
+	}
+
+	c, err := parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", tokens[pos], expr)
+	}
+	return c, nil
+}
+
+// run_compose() checks several targets, each with its own thresholds, and combines their states
+func run_compose(c *cli.Context) {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	period := c.String("timeperiod")
+	when := c.String("when")
+
+	var conds []*SubCondition
+	names := make(map[string]bool)
+	for _, spec := range c.StringSlice("cond") {
+		sc, err := ParseSubCondition(spec)
+		if err != nil {
+			fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+			exit(E_UNKNOWN)
+		}
+		if names[sc.Name] {
+			fmt.Printf("%s: Sub condition %q given more than once\n", S_UNKNOWN, sc.Name)
+			exit(E_UNKNOWN)
+		}
+		names[sc.Name] = true
+		conds = append(conds, sc)
+	}
+	if len(conds) == 0 {
+		fmt.Printf("%s: No sub conditions given, use --cond\n", S_UNKNOWN)
+		exit(E_UNKNOWN)
+	}
+	if when == "" {
+		all := make([]string, len(conds))
+		for i := range conds {
+			all[i] = conds[i].Name
+		}
+		when = strings.Join(all, " AND ")
+	}
+	comp, err := ParseComposition(when, names)
+	if err != nil {
+		fmt.Printf("%s: Invalid --when: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ds, err := NewDatasource(c.GlobalString("backend"), base)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+
+	chans := make([]chan GraphiteResponse, len(conds))
+	for i, sc := range conds {
+		log.Debugf("Checking %s: %s", sc.Name, sc.Target)
+		chans[i] = make(chan GraphiteResponse, 1) // buffered, so late responses don't block after a timeout
+		go parse(ctx, ds, []string{sc.Target}, Window{Period: period}, chans[i])
+	}
+
+	states := make(map[string]int)
+	var summary, pds []string
+	var lo bytes.Buffer
+	var rt float64
+	for i, sc := range conds {
+		var res GraphiteResponse
+		select {
+		case res = <-chans[i]:
+		case <-ctx.Done():
+			fmt.Printf("%s: Timed out after %d seconds\n", S_CRITICAL, int(tmout))
+			exit(E_CRITICAL)
+		}
+		if res.Err != nil {
+			fmt.Printf("%s: Error parsing result for %s: %q\n", S_CRITICAL, sc.Name, res.Err)
+			exit(E_CRITICAL)
+		}
+		if res.RT > rt {
+			rt = res.RT
+		}
+		state, worst := sc.Judge(res.MS)
+		states[sc.Name] = state
+		if len(res.MS) == 0 {
+			summary = append(summary, fmt.Sprintf("%s %s (no values)", sc.Name, statusText(state)))
+		} else {
+			summary = append(summary, fmt.Sprintf("%s %s (%.02f)", sc.Name, statusText(state), worst))
+		}
+
+		pd := PerfData{Label: sc.Name, Value: worst, Unknown: len(res.MS) == 0}
+		if sc.HasWarn {
+			pd.Warn = fmt.Sprintf("%f", sc.Warn)
+		}
+		if sc.HasCrit {
+			pd.Crit = fmt.Sprintf("%f", sc.Crit)
+		}
+		pds = append(pds, pd.String())
+
+		fmt.Fprintf(&lo, "=====> %s: %s\n", sc.Name, sc.Target)
+		res.MS.SortFor(sc.Condition)
+		res.MS.Dump(&lo, res.MS.LongestKey(), false)
+		fmt.Fprintf(&lo, "\n")
+	}
+	pds = append(pds, PerfData{Label: "response_time", Value: rt, UOM: "s"}.String())
+
+	ecode := comp(states)
+	fmt.Printf("%s: %s: %s |%s\n\n%s", statusText(ecode), when, strings.Join(summary, ", "), strings.Join(pds, " "), lo.String())
+	exit(ecode)
+}
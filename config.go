@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_INTERVAL string = "60s"
+	DEF_SINK     string = "-"
+)
+
+// CheckConfig is one check in a config file, given by the same flags as on the command line
+type CheckConfig struct {
+	Name     string   `yaml:"name"`
+	Interval string   `yaml:"interval,omitempty"` // e.g. 30s, the global interval if not given
+	Args     []string `yaml:"args"`
+	Bands    []Band   `yaml:"bands,omitempty"` // expected values by time of day and week, for the seasonal evaluator
+}
+
+// Route sends the checks of metrics under a prefix to a Graphite of their own, for sharded clusters
+type Route struct {
+	Prefix string `yaml:"prefix"`
+	URL    string `yaml:"url"` // as for --urlprefix
+}
+
+// Config is what a config file for running many checks in one process holds, e.g.:
+//
+//	interval: 60s
+//	output: json
+//	sinks: [/var/log/check_graphite.log]
+//	webhooks:
+//	  - url: https://hooks.slack.com/services/T000/B000/XXXX
+//	    template: slack
+//	routes:
+//	  - prefix: dc2.
+//	    url: http://graphite-dc2:8080
+//	checks:
+//	  - name: web_cpu
+//	    args: [-m, "servers.web*.cpu", -w, "80", -c, "90"]
+type Config struct {
+	Interval string        `yaml:"interval,omitempty"`
+	Output   string        `yaml:"output,omitempty"`   // format of results written to sinks
+	Sinks    []string      `yaml:"sinks,omitempty"`    // files to append results to, - for stdout
+	Routes   []Route       `yaml:"routes,omitempty"`   // where checks not given a host or URL prefix go, by metric path
+	Webhooks []Webhook     `yaml:"webhooks,omitempty"` // told when a check changes state
+	Checks   []CheckConfig `yaml:"checks"`
+}
+
+// processFlags are the flags applied once for the whole process in app.Before, like how to connect to
+// the backend, so the checks of a config can't each be given their own
+var processFlags = []string{
+	"header", "http-user", "http-password", "grafana-token", "grafana-datasource", "dialect",
+	"tls-verify", "ca-file", "client-cert", "client-key", "resolve", "source-ip",
+	"max-inflight", "max-rps", "http-timeout", "idle-timeout", "cache-dir",
+	"srv", "consul-addr", "consul-service", "consul-token", "k8s-service", "k8s-proxy", "k8s-token",
+	"record", "replay", "log-level", "debug", "profile", "defaults",
+}
+
+// processFlagsIn() returns the long names of the processFlags given in args. Not from the parsed
+// flags, as those count the environment as given as well.
+func processFlagsIn(app *cli.App, args []string) []string {
+	names := make(map[string]string) // long name by each name of the flag
+	for _, f := range app.Flags {
+		all := strings.Split(f.GetName(), ",")
+		long := strings.TrimSpace(all[0])
+		for _, pf := range processFlags {
+			if pf != long {
+				continue
+			}
+			for _, n := range all {
+				names[strings.TrimSpace(n)] = long
+			}
+		}
+	}
+	var given []string
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if long, ok := names[name]; ok {
+			given = append(given, long)
+		}
+	}
+	return given
+}
+
+// ConfiguredCheck is a check from the config, ready to run
+type ConfiguredCheck struct {
+	Name     string
+	Interval time.Duration
+	Ctx      *cli.Context
+	lastRun  int64 // unix nanoseconds of when the last run finished, accessed atomically
+	lastOK   int64 // unix nanoseconds of when the last run without a Failure finished, accessed atomically
+	failing  int32 // 1 if the last run had a Failure, accessed atomically
+}
+
+// linker() returns a GraphLinker for the Graphite and time window of the check
+func (cc *ConfiguredCheck) linker() *GraphLinker {
+	c := cc.Ctx
+	window, err := NewWindow(c.String("timeperiod"), c.String("offset"))
+	if err != nil {
+		return nil
+	}
+	base, err := base_url(c.String("urlprefix"), c.String("protocol"), c.String("hostname"), c.Uint64("port"))
+	if err != nil {
+		return nil
+	}
+	return &GraphLinker{Base: base, Window: window}
+}
+
+// LoadConfig() reads and validates a config file
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if cfg.Interval == "" {
+		cfg.Interval = DEF_INTERVAL
+	}
+	if cfg.Output == "" {
+		cfg.Output = OUT_NAGIOS
+	}
+	if len(cfg.Sinks) == 0 {
+		cfg.Sinks = []string{DEF_SINK}
+	}
+	if _, err := GetFormatter(cfg.Output); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(cfg.Checks) == 0 {
+		return nil, fmt.Errorf("%s: no checks configured", file)
+	}
+	for _, r := range cfg.Routes {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	for _, wh := range cfg.Webhooks {
+		if err := wh.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return cfg, nil
+}
+
+// validate() tells what's wrong with a route, if anything
+func (r Route) validate() error {
+	if r.Prefix == "" {
+		return fmt.Errorf("route to %q has no prefix", r.URL)
+	}
+	if u, err := url.Parse(r.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("route for %q has an invalid url %q", r.Prefix, r.URL)
+	}
+	return nil
+}
+
+// routePath() returns the part of a target to route by: the path in the innermost function call,
+// or the target itself if it's a plain path
+func routePath(target string) string {
+	if i := strings.LastIndex(target, "("); i >= 0 {
+		target = target[i+1:]
+	}
+	return strings.TrimSpace(target)
+}
+
+// route() returns the URL of the route with the longest prefix of the target, "" if none matches
+func (cfg *Config) route(target string) string {
+	path := routePath(target)
+	var best Route
+	for _, r := range cfg.Routes {
+		if strings.HasPrefix(path, r.Prefix) && len(r.Prefix) > len(best.Prefix) {
+			best = r
+		}
+	}
+	return best.URL
+}
+
+// routeCheck() returns the URL the targets of a check are routed to, from --metricpath and
+// --targets-file, "" if none. All targets of a check are fetched from the same Graphite, so it's
+// an error if they route to different ones.
+func (cfg *Config) routeCheck(c *cli.Context) (string, error) {
+	if len(cfg.Routes) == 0 {
+		return "", nil
+	}
+	var targets []string
+	if mpath := c.String("metricpath"); mpath != "" {
+		targets = append(targets, mpath)
+	}
+	if tfile := c.String("targets-file"); tfile != "" {
+		ftargets, err := ReadTargets(tfile)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read targets to route by: %v", err)
+		}
+		targets = append(targets, ftargets...)
+	}
+	for i, t := range targets {
+		if cfg.route(t) != cfg.route(targets[0]) {
+			return "", fmt.Errorf("targets %q and %q route to different Graphites, split them into checks of their own",
+				targets[0], targets[i])
+		}
+	}
+	if len(targets) == 0 {
+		return "", nil
+	}
+	return cfg.route(targets[0]), nil
+}
+
+// Prepare() parses the flags of each check, for running them in process
+func (cfg *Config) Prepare(app *cli.App) ([]*ConfiguredCheck, error) {
+	defint, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval: %v", err)
+	}
+	seen := make(map[string]bool)
+	ccs := make([]*ConfiguredCheck, 0, len(cfg.Checks))
+	for i, chk := range cfg.Checks {
+		if chk.Name == "" {
+			return nil, fmt.Errorf("check #%d has no name", i+1)
+		}
+		if seen[chk.Name] {
+			return nil, fmt.Errorf("check %q is configured more than once", chk.Name)
+		}
+		seen[chk.Name] = true
+		cc := &ConfiguredCheck{Name: chk.Name, Interval: defint}
+		if chk.Interval != "" {
+			if cc.Interval, err = time.ParseDuration(chk.Interval); err != nil {
+				return nil, fmt.Errorf("check %q: invalid interval: %v", chk.Name, err)
+			}
+		}
+		if cc.Interval <= 0 {
+			return nil, fmt.Errorf("check %q: interval must be positive", chk.Name)
+		}
+		args := chk.Args
+		for _, b := range chk.Bands {
+			args = append(args, "--band", b.String())
+		}
+		if cc.Ctx, err = parseCheck(app, chk.Name, args); err != nil {
+			return nil, fmt.Errorf("check %q: %v", chk.Name, err)
+		}
+		// all checks share the connection set up for the process, so these would be silently ignored
+		if given := processFlagsIn(app, args); len(given) > 0 {
+			return nil, fmt.Errorf("check %q: --%s can't be given per check, only on the command line of the daemon",
+				chk.Name, strings.Join(given, ", --"))
+		}
+		// where a check is sent when given, the routes don't apply. Decided before the defaults are
+		// applied, as they'd count as given after that.
+		if !cc.Ctx.IsSet("urlprefix") && !cc.Ctx.IsSet("hostname") && !cc.Ctx.IsSet("port") {
+			u, err := cfg.routeCheck(cc.Ctx)
+			if err != nil {
+				return nil, fmt.Errorf("check %q: %v", chk.Name, err)
+			}
+			if u != "" {
+				cc.Ctx.Set("urlprefix", u)
+			}
+		}
+		if err := applyDefaults(cc.Ctx, defaults); err != nil {
+			return nil, fmt.Errorf("check %q: %v", chk.Name, err)
+		}
+		ccs = append(ccs, cc)
+	}
+	return ccs, nil
+}
+
+// checkContext() parses the args of a check with the flags of the app, the same way as for a one-shot run.
+// Flags applied in app.Before, like --dialect, come from the command line of the process instead,
+// see processFlags.
+func checkContext(app *cli.App, name string, args []string) (*cli.Context, error) {
+	ctx, err := parseCheck(app, name, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyDefaults(ctx, defaults); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// parseCheck() is checkContext() without the defaults, so IsSet() tells what the args give
+func parseCheck(app *cli.App, name string, args []string) (*cli.Context, error) {
+	var ctx *cli.Context
+	parser := cli.NewApp()
+	parser.Name = name
+	parser.Flags = append([]cli.Flag{}, app.Flags...)
+	parser.HideHelp = true
+	parser.Writer = ioutil.Discard
+	parser.ErrWriter = ioutil.Discard
+	parser.Action = func(c *cli.Context) error {
+		if c.NArg() > 0 {
+			return fmt.Errorf("unexpected argument %q", c.Args().First())
+		}
+		ctx = c
+		return nil
+	}
+	if err := parser.Run(append([]string{name}, args...)); err != nil {
+		return nil, err
+	}
+	if !ctx.IsSet("check-name") {
+		ctx.Set("check-name", name)
+	}
+	return ctx, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testApp() returns an app with the flags routing and the defaults look at
+func testApp() *cli.App {
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "urlprefix, U"},
+		cli.StringFlag{Name: "hostname, H", Value: "localhost"},
+		cli.Uint64Flag{Name: "port, p", Value: 80},
+		cli.StringFlag{Name: "metricpath, m"},
+		cli.StringFlag{Name: "targets-file, f"},
+		cli.StringFlag{Name: "check-name"},
+		cli.Float64Flag{Name: "warning, w"},
+		cli.StringSliceFlag{Name: "header"},
+	}
+	return app
+}
+
+func testRoutes() *Config {
+	return &Config{
+		Interval: "60s",
+		Routes: []Route{
+			{Prefix: "dc2.", URL: "http://graphite-dc2"},
+			{Prefix: "dc2.web.", URL: "http://graphite-dc2-web"},
+			{Prefix: "dc3.", URL: "http://graphite-dc3"},
+		},
+	}
+}
+
+func TestRoute(t *testing.T) {
+	cfg := testRoutes()
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"dc1.web01.cpu", ""},
+		{"dc2.db01.cpu", "http://graphite-dc2"},
+		{"dc2.web01.cpu", "http://graphite-dc2"},
+		{"dc2.web.lb.cpu", "http://graphite-dc2-web"},
+		{"sumSeries(dc3.*.cpu)", "http://graphite-dc3"},
+		{"scale(dc2.web.a, 2)", "http://graphite-dc2-web"},
+		{"dc2", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.route(tt.target); got != tt.want {
+			t.Errorf("route(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRouteCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	same := write("same", "dc2.a\ndc2.b\n")
+	mixed := write("mixed", "dc2.a\ndc3.b\n")
+
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"-m", "dc1.a"}, "", false},
+		{[]string{"-m", "dc2.a"}, "http://graphite-dc2", false},
+		{[]string{"-f", same}, "http://graphite-dc2", false},
+		{[]string{"-m", "dc2.c", "-f", same}, "http://graphite-dc2", false},
+		{[]string{"-m", "dc3.c", "-f", same}, "", true},
+		{[]string{"-f", mixed}, "", true},
+		{[]string{"-f", filepath.Join(dir, "missing")}, "", true},
+		{[]string{}, "", false},
+	}
+	cfg := testRoutes()
+	for _, tt := range tests {
+		c, err := parseCheck(testApp(), "test", tt.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		got, err := cfg.routeCheck(c)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%v: got %q, %v, want %q, error: %v", tt.args, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPrepareRoutes(t *testing.T) {
+	saved := defaults
+	defer func() { defaults = saved }()
+	// a host in the defaults doesn't keep checks from being routed
+	defaults = map[string][]string{"hostname": {"graphite-default"}}
+
+	tests := []struct {
+		args      []string
+		urlprefix string
+	}{
+		{[]string{"-m", "dc2.a"}, "http://graphite-dc2"},
+		{[]string{"-m", "dc1.a"}, ""},
+		{[]string{"-m", "dc2.a", "-H", "graphite-given"}, ""},
+		{[]string{"-m", "dc2.a", "-U", "http://given"}, "http://given"},
+	}
+	for _, tt := range tests {
+		cfg := testRoutes()
+		cfg.Checks = []CheckConfig{{Name: "test", Args: tt.args}}
+		ccs, err := cfg.Prepare(testApp())
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if got := ccs[0].Ctx.String("urlprefix"); got != tt.urlprefix {
+			t.Errorf("%v: got urlprefix %q, want %q", tt.args, got, tt.urlprefix)
+		}
+	}
+}
+
+func TestPrepareProcessFlags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-m", "a"}, false},
+		{[]string{"-m", "a", "--header", "X-A: 1"}, true},
+		{[]string{"-m", "a", "--header=X-A: 1"}, true},
+		{[]string{"-m", "a", "--", "--header"}, true}, // an argument, refused by the parser
+	}
+	for _, tt := range tests {
+		cfg := &Config{Interval: "60s", Checks: []CheckConfig{{Name: "test", Args: tt.args}}}
+		if _, err := cfg.Prepare(testApp()); (err != nil) != tt.wantErr {
+			t.Errorf("%v: got %v, want error: %v", tt.args, err, tt.wantErr)
+		}
+	}
+
+	// from the environment, it's the process that has them
+	os.Setenv("CHECK_GRAPHITE_TEST_HEADER", "X-A: 1")
+	defer os.Unsetenv("CHECK_GRAPHITE_TEST_HEADER")
+	app := testApp()
+	app.Flags = append(app.Flags, cli.StringFlag{Name: "http-user", EnvVar: "CHECK_GRAPHITE_TEST_HEADER"})
+	cfg := &Config{Interval: "60s", Checks: []CheckConfig{{Name: "test", Args: []string{"-m", "a"}}}}
+	if _, err := cfg.Prepare(app); err != nil {
+		t.Errorf("got %v for a flag from the environment", err)
+	}
+}
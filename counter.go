@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"sort"
+)
+
+const (
+	EV_COUNTER string = "counter"
+)
+
+func init() {
+	RegisterEvaluator(EV_COUNTER, NewCounterEvaluator)
+}
+
+// CounterEvaluator checks that counters never go down within the window, as that means the process
+// counting was restarted, or data was lost. Any metric reset more than MaxResets times is CRITICAL.
+type CounterEvaluator struct {
+	MaxResets int
+	Top       int // how many metrics to keep in each state, 0 for all
+}
+
+// NewCounterEvaluator() creates a CounterEvaluator from --max-resets
+func NewCounterEvaluator(c *cli.Context) (Evaluator, error) {
+	ce := &CounterEvaluator{
+		MaxResets: c.Int("max-resets"),
+		Top:       c.Int("top"),
+	}
+	if ce.MaxResets < 0 {
+		return nil, fmt.Errorf("Invalid --max-resets %d, should be 0 or more", ce.MaxResets)
+	}
+	return ce, nil
+}
+
+// resets() counts the times the value of a metric went down within the window
+func resets(m *Metric) int {
+	n := 0
+	for i := 1; i < len(m.Points); i++ {
+		if m.Points[i].Value < m.Points[i-1].Value {
+			n++
+		}
+	}
+	return n
+}
+
+// Evaluate() implements Evaluator
+func (ce *CounterEvaluator) Evaluate(ms Metrics) *Evaluation {
+	counts := make(map[*Metric]int, len(ms))
+	total := 0
+	o, c := Metrics{}, Metrics{}
+	for _, m := range ms {
+		counts[m] = resets(m)
+		total += counts[m]
+		if counts[m] > ce.MaxResets {
+			c = append(c, m)
+		} else {
+			o = append(o, m)
+		}
+	}
+	log.Debugf("#c: %d, #o: %d\n", len(c), len(o))
+
+	// helper func, sorts metrics with the most resets first, and keeps the first Top of them
+	top := func(ms Metrics) Metrics {
+		sort.Slice(ms, func(i, j int) bool {
+			ci, cj := counts[ms[i]], counts[ms[j]]
+			return ci > cj || (ci == cj && ms[i].Path < ms[j].Path)
+		})
+		if ce.Top > 0 && len(ms) > ce.Top {
+			return ms[:ce.Top]
+		}
+		return ms
+	}
+
+	ev := &Evaluation{Crit: fmt.Sprintf("%d", ce.MaxResets)}
+	ev.Perf = []PerfData{
+		{Label: "resets", Value: float64(total), Unknown: len(ms) == 0, Count: true},
+		{Label: "num_matching_metrics", Value: float64(len(c)), Count: true},
+	}
+	switch {
+	case len(ms) == 0:
+		ev.Status = E_UNKNOWN
+		ev.Summary = "No values to evaluate"
+	case len(c) > 0:
+		worst := top(c)[0]
+		ev.Status = E_CRITICAL
+		ev.Summary = fmt.Sprintf("%d counters went down more than %d times, e.g. %s %d times", len(c), ce.MaxResets, worst.Path, counts[worst])
+	default:
+		ev.Status = E_OK
+		ev.Summary = fmt.Sprintf("%d counters with %d resets in total, none more than %d times", len(o), total, ce.MaxResets)
+		ev.Perf[1].Value = float64(len(o))
+	}
+
+	ev.C = top(c)
+	ev.W = Metrics{}
+	ev.O = top(o)
+	return ev
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DEF_FLUSH_INTERVAL time.Duration = time.Second
+)
+
+// Scheduler runs the checks of one config at their intervals, until stopped
+type Scheduler struct {
+	checks []*ConfiguredCheck
+	sinks  []Sink
+	notify *Notifier // kept across reloads
+	hooks  []Webhook
+	tm     *Telemetry
+	co     *Coalescer // shares requests in flight between the checks, as they run at their intervals
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewScheduler() prepares the checks and opens the sinks of a config
+func NewScheduler(app *cli.App, cfg *Config, tm *Telemetry, notify *Notifier) (*Scheduler, error) {
+	checks, err := cfg.Prepare(app)
+	if err != nil {
+		return nil, err
+	}
+	format, _ := GetFormatter(cfg.Output) // checked by LoadConfig()
+	s := &Scheduler{checks: checks, notify: notify, hooks: cfg.Webhooks, tm: tm, co: NewFlightCoalescer(), stop: make(chan struct{})}
+	for _, file := range cfg.Sinks {
+		sink, err := NewSink(file, format)
+		if err != nil {
+			s.closeSinks()
+			return nil, fmt.Errorf("Unable to open sink %q: %v", file, err)
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+	return s, nil
+}
+
+// Start() runs each check right away, and then at its interval
+func (s *Scheduler) Start() {
+	now := time.Now().UnixNano()
+	for _, cc := range s.checks {
+		atomic.StoreInt64(&cc.lastRun, now) // so they're not overdue before their first run
+		s.wg.Add(1)
+		go func(cc *ConfiguredCheck) {
+			defer s.wg.Done()
+			t := time.NewTicker(cc.Interval)
+			defer t.Stop()
+			for {
+				s.run(cc, s.co)
+				select {
+				case <-s.stop:
+					return
+				case <-t.C:
+				}
+			}
+		}(cc)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(DEF_FLUSH_INTERVAL)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				s.flushSinks()
+			}
+		}
+	}()
+}
+
+// RunOnce() runs all checks once in parallel, hands their results to the sinks, followed by a summary
+// of them all, and returns the summary
+func (s *Scheduler) RunOnce() *Result {
+	// checks querying the same thing get the same response, instead of asking for it again
+	co := NewCoalescer()
+	defer func() {
+		if n := co.Saved(); n > 0 {
+			log.Infof("%d requests answered with the response to an identical one", n)
+		}
+	}()
+
+	results := make([]*Result, len(s.checks))
+	var wg sync.WaitGroup
+	for i, cc := range s.checks {
+		wg.Add(1)
+		go func(i int, cc *ConfiguredCheck) {
+			defer wg.Done()
+			results[i] = s.run(cc, co)
+		}(i, cc)
+	}
+	wg.Wait()
+
+	sum := batchSummary(results)
+	for _, sink := range s.sinks {
+		if err := sink.Write(sum); err != nil {
+			log.Errorf("Unable to write summary: %v", err)
+		}
+	}
+	return sum
+}
+
+// batchSummary() sums up the results of a batch run into one, in the worst status of them all,
+// so the batch can be watched as one service
+func batchSummary(results []*Result) *Result {
+	counts := make(map[int]int)
+	ecode := E_OK
+	var failed []string
+	for _, r := range results {
+		counts[r.Status]++
+		ecode = worstStatus(ecode, r.Status)
+		if r.Status != E_OK {
+			failed = append(failed, fmt.Sprintf("%s %s", r.Name, statusText(r.Status)))
+		}
+	}
+	sum := &Result{
+		Name:     "batch",
+		Status:   ecode,
+		ExitCode: ecode,
+		Summary: fmt.Sprintf("%d checks, %d %s, %d %s, %d %s, %d %s", len(results),
+			counts[E_CRITICAL], S_CRITICAL, counts[E_WARNING], S_WARNING, counts[E_UNKNOWN], S_UNKNOWN, counts[E_OK], S_OK),
+	}
+	for _, ecode := range []int{E_OK, E_WARNING, E_CRITICAL, E_UNKNOWN} {
+		sum.Perf = append(sum.Perf, PerfData{Label: strings.ToLower(statusText(ecode)), Value: float64(counts[ecode]), Count: true})
+	}
+	if len(failed) > 0 {
+		sum.Long = strings.Join(failed, "\n") + "\n"
+	}
+	return sum
+}
+
+// run() runs a check once, sharing its requests through co, and hands the result to the sinks
+func (s *Scheduler) run(cc *ConfiguredCheck, co *Coalescer) *Result {
+	s.tm.Started()
+	t_start := time.Now()
+	r := checkWith(withCoalescer(context.Background(), co), cc.Ctx)
+	s.tm.Done(cc.Name, r, time.Since(t_start).Seconds())
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&cc.lastRun, now)
+	if r.Failure != "" {
+		atomic.StoreInt32(&cc.failing, 1)
+	} else {
+		atomic.StoreInt32(&cc.failing, 0)
+		atomic.StoreInt64(&cc.lastOK, now)
+	}
+	log.Infof("%s: %s: %s", cc.Name, statusText(r.Status), r.Summary)
+	for _, sink := range s.sinks {
+		if err := sink.Write(r); err != nil {
+			log.Errorf("%s: Unable to write result: %v", cc.Name, err)
+		}
+	}
+	s.notify.Notify(r, cc.linker(), s.hooks)
+	return r
+}
+
+// Overdue() returns the names of the checks that should have finished a run by now, but haven't.
+// A check gets two intervals plus its timeout before it's overdue.
+func (s *Scheduler) Overdue() []string {
+	var names []string
+	for _, cc := range s.checks {
+		tmout := time.Duration(cc.Ctx.Float64("timeout") * float64(time.Second))
+		last := time.Unix(0, atomic.LoadInt64(&cc.lastRun))
+		if time.Since(last) > 2*cc.Interval+tmout {
+			names = append(names, cc.Name)
+		}
+	}
+	return names
+}
+
+// Stop() lets the checks running finish, then closes the sinks, which flushes them
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	s.closeSinks()
+}
+
+func (s *Scheduler) flushSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Flush(); err != nil {
+			log.Errorf("Unable to flush sink: %v", err)
+		}
+	}
+}
+
+func (s *Scheduler) closeSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			log.Errorf("Unable to close sink: %v", err)
+		}
+	}
+}
+
+// loadScheduler() reads the config file and prepares a Scheduler for it
+func loadScheduler(app *cli.App, file string, tm *Telemetry, notify *Notifier) (*Scheduler, error) {
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewScheduler(app, cfg, tm, notify)
+}
+
+// run_daemon() runs the checks of a config file until terminated. SIGHUP reloads the config,
+// SIGTERM and SIGINT let running checks finish before exiting.
+func run_daemon(c *cli.Context) error {
+	file := c.String("config")
+	if file == "" {
+		return cli.NewExitError("No config file given, use --config", E_UNKNOWN)
+	}
+	// one tape can't hold the runs of many checks, which would all save their result to it
+	if conn.Tape != nil {
+		return cli.NewExitError("--record and --replay are for a single check, not the daemon", E_UNKNOWN)
+	}
+
+	tm := NewTelemetry() // kept across reloads, as is the state of the checks the webhooks are told about
+	nf := NewNotifier()
+	defer nf.Close(DEF_WEBHOOK_TIMEOUT)
+	s, err := loadScheduler(c.App, file, tm, nf)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to load config: %v", err), E_UNKNOWN)
+	}
+
+	// run each check once and exit in the worst status, if requested
+	if c.Bool("once") {
+		sum := s.RunOnce()
+		s.closeSinks()
+		nf.Close(DEF_WEBHOOK_TIMEOUT)
+		exit(sum.ExitCode)
+	}
+
+	// answer probes and serve telemetry on the HTTP listener, if requested
+	hs := &HealthServer{}
+	var served chan error // gets why the listener stopped serving
+	if listen := c.String("listen"); listen != "" {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to listen: %v", err), E_UNKNOWN)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", hs)
+		mux.Handle("/readyz", hs)
+		mux.Handle("/metrics", tm)
+		served = make(chan error, 1)
+		go func() {
+			served <- http.Serve(l, mux)
+		}()
+		log.Infof("Listening on %s", l.Addr())
+	}
+
+	// take over the signals from startProfile(), as exiting is ours to do here
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	// helper func
+	notify := func(state string) {
+		if err := sdNotify(state); err != nil {
+			log.Errorf("Unable to notify systemd: %v", err)
+		}
+	}
+
+	// ping the systemd watchdog only while all checks keep running, so a hung scheduler gets restarted
+	var watchdog <-chan time.Time
+	if wi := sdWatchdogInterval(); wi > 0 {
+		t := time.NewTicker(wi)
+		defer t.Stop()
+		watchdog = t.C
+	}
+
+	log.Infof("Running %d checks from %q", len(s.checks), file)
+	s.Start()
+	hs.Set(s)
+	notify(fmt.Sprintf("READY=1\nSTATUS=Running %d checks", len(s.checks)))
+
+	for {
+		select {
+		case err := <-served:
+			// the probes would fail, so stop the same way as when told to, rather than running on unwatched
+			log.Errorf("Stopped listening: %v", err)
+			notify("STOPPING=1")
+			s.Stop()
+			return cli.NewExitError(fmt.Sprintf("Stopped listening: %v", err), E_UNKNOWN)
+		case <-watchdog:
+			if overdue := s.Overdue(); len(overdue) > 0 {
+				log.Warnf("Not pinging the watchdog, checks overdue: %v", overdue)
+				continue
+			}
+			notify("WATCHDOG=1")
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Infof("Got %s, waiting for running checks to finish", sig)
+				notify("STOPPING=1")
+				s.Stop()
+				return nil
+			}
+			// a broken config keeps the old one running, so we don't stop checking
+			ns, err := loadScheduler(c.App, file, tm, nf)
+			if err != nil {
+				log.Errorf("Unable to reload config, keeping the old one: %v", err)
+				continue
+			}
+			notify("RELOADING=1")
+			s.Stop()
+			s = ns
+			log.Infof("Reloaded, running %d checks from %q", len(s.checks), file)
+			s.Start()
+			hs.Set(s)
+			notify(fmt.Sprintf("READY=1\nSTATUS=Running %d checks", len(s.checks)))
+		}
+	}
+}
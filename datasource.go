@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Datasource is a backend we can get metrics from
+type Datasource interface {
+	// Fetch() returns the latest value of each series matching target within the time window
+	Fetch(ctx context.Context, target string, window Window) (Metrics, error)
+}
+
+// Window is the time range to fetch, relative to now
+type Window struct {
+	Period string        // how long, a relative time in Graphite format, like 5min
+	Offset time.Duration // how long before now it ends
+	period time.Duration // Period parsed, only needed with an Offset
+}
+
+// NewWindow() returns the window of the given length, ending offset before now.
+// offset is a relative time in Graphite format too, "" to end now.
+func NewWindow(period, offset string) (Window, error) {
+	w := Window{Period: period}
+	if offset == "" {
+		return w, nil
+	}
+	var err error
+	if w.Offset, err = graphiteDuration(offset); err != nil {
+		return w, fmt.Errorf("Invalid offset: %v", err)
+	}
+	if w.period, err = graphiteDuration(period); err != nil {
+		return w, fmt.Errorf("Invalid time period: %v", err)
+	}
+	return w, nil
+}
+
+// From() returns how long before now the window starts, in Graphite format
+func (w Window) From() string {
+	if w.Offset == 0 {
+		return w.Period
+	}
+	return fmt.Sprintf("%ds", int64((w.period + w.Offset).Seconds()))
+}
+
+// Until() returns how long before now the window ends, in Graphite format, "" for now
+func (w Window) Until() string {
+	if w.Offset == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%ds", int64(w.Offset.Seconds()))
+}
+
+// String() describes the window, for messages
+func (w Window) String() string {
+	if w.Offset == 0 {
+		return w.Period
+	}
+	return fmt.Sprintf("%s ending %s ago", w.Period, w.Offset)
+}
+
+// DatasourceFactory creates a Datasource for the backend at the given base URL
+type DatasourceFactory func(base string) Datasource
+
+var datasources = make(map[string]DatasourceFactory)
+
+// RegisterDatasource() makes a backend available by name, for --backend
+func RegisterDatasource(name string, f DatasourceFactory) {
+	datasources[name] = f
+}
+
+// DatasourceNames() returns the names of all registered backends, sorted
+func DatasourceNames() []string {
+	names := make([]string, 0, len(datasources))
+	for name := range datasources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDatasource() creates a Datasource for the named backend
+func NewDatasource(name, base string) (Datasource, error) {
+	f, ok := datasources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (options: %s)", name, strings.Join(DatasourceNames(), ", "))
+	}
+	return f(base), nil
+}
+
+// getbody() fetches a URL and returns the body of a successful response, or an error from
+// the response otherwise. The body must be closed by the caller.
+// With a Coalescer in ctx, as in a batch run, requests for the same URL are made only once.
+func getbody(ctx context.Context, url string) (io.ReadCloser, error) {
+	fetch := func() ([]byte, error) {
+		return readbody(ctx, url)
+	}
+	var data []byte
+	var err error
+	if co := coalescerFrom(ctx); co != nil {
+		var shared bool
+		data, shared, err = co.Do(ctx, url, fetch)
+		if b := budgetFrom(ctx); shared && err == nil && b != nil {
+			err = b.Use(int64(len(data))) // it takes the same space for each check
+		}
+		if t := timingFrom(ctx); shared && t != nil {
+			t.URL, t.Status, t.Size = redactURL(url), "shared with an identical request", len(data)
+		}
+	} else {
+		data, err = fetch()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readbody() fetches a URL and reads all of the body of a successful response
+func readbody(ctx context.Context, url string) ([]byte, error) {
+	var cached *cachedResponse
+	var header http.Header
+	if conn.Cache != nil {
+		var err error
+		if cached, err = conn.Cache.Get(url); err != nil {
+			log.Warnf("Unable to read cached response: %v", err)
+		} else if cached != nil {
+			header = cached.conditions()
+		}
+	}
+	t := timingFrom(ctx)
+	if t != nil {
+		t.URL = redactURL(url)
+	}
+	resp, err := geturlWith(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if t != nil {
+		t.Status = resp.Status
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		log.Debugf("Not modified, using the cached response: %s", url)
+		if t != nil {
+			t.Status += ", cached"
+			t.Size = len(cached.Body)
+		}
+		if b := budgetFrom(ctx); b != nil {
+			if err := b.Use(int64(len(cached.Body))); err != nil {
+				return nil, err
+			}
+		}
+		return cached.Body, nil
+	}
+	if err := respError(resp); err != nil {
+		return nil, err
+	}
+	// read it all here, to tell the download from the parsing
+	var body io.Reader = resp.Body
+	if conn.IdleTimeout > 0 {
+		ir := newIdleReader(resp.Body, conn.IdleTimeout)
+		defer ir.Close()
+		body = ir
+	}
+	if b := budgetFrom(ctx); b != nil {
+		body = &budgetReader{r: body, b: b}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		t.Size = len(data)
+		t.BodyRead()
+	}
+	if conn.Cache != nil {
+		if err := conn.Cache.Put(url, resp.Header, data); err != nil {
+			log.Warnf("Unable to cache response: %v", err)
+		}
+	}
+	return data, nil
+}
+
+type nullKey struct{}
+
+// withNull() returns a context that has the requests made with it note the series they got without
+// any values into null
+func withNull(ctx context.Context, null *[]string) context.Context {
+	return context.WithValue(ctx, nullKey{}, null)
+}
+
+// noteNull() notes the paths of series without values, if the context asks for it
+func noteNull(ctx context.Context, paths []string) {
+	if null, ok := ctx.Value(nullKey{}).(*[]string); ok {
+		*null = append(*null, paths...)
+	}
+}
+
+// mergeLatest() adds metrics to a map by path, keeping the newest of any duplicates
+func mergeLatest(mmap map[string]*Metric, ms Metrics) {
+	for _, m := range ms {
+		if cm, ok := mmap[m.Path]; ok {
+			mmap[m.Path] = m.Latest(cm) // replace existing metric with current, if newer
+		} else {
+			mmap[m.Path] = m // first hit, init
+		}
+	}
+}
+
+// parse() fetches all targets from the datasource in parallel, and merges the results into one response.
+// The response time is that of the slowest request, and the first error wins.
+// Designed to run in a separate goroutine, and hence uses a result channel instead or returning anything
+func parse(ctx context.Context, ds Datasource, targets []string, window Window, chRes chan GraphiteResponse) {
+	chSub := make(chan GraphiteResponse, len(targets))
+	for i := range targets {
+		go func(target string) {
+			gr := GraphiteResponse{Timing: &Timing{}}
+			t_start := time.Now()
+			gr.MS, gr.Err = ds.Fetch(withSkip(withNull(withTiming(ctx, gr.Timing), &gr.Null), &gr.Skip), target, window)
+			gr.RT = time.Duration(time.Now().Sub(t_start)).Seconds()
+			gr.Timing.Done()
+			if b := budgetFrom(ctx); b != nil && gr.Err == nil {
+				gr.Err = b.Use(gr.MS.Size())
+			}
+			chSub <- gr
+		}(targets[i])
+	}
+
+	gr := GraphiteResponse{}
+	mmap := make(map[string]*Metric) // the same series may be matched by more than one target
+	var null []string
+	for range targets {
+		res := <-chSub
+		if res.RT > gr.RT || gr.Timing == nil {
+			gr.RT = res.RT
+			gr.Timing = res.Timing
+		}
+		if res.Timing != nil {
+			gr.Cert = soonerExpiring(gr.Cert, res.Timing.Cert)
+			gr.Requests = append(gr.Requests, res.Timing)
+		}
+		if res.Err != nil && gr.Err == nil {
+			gr.Err = res.Err
+		}
+		mergeLatest(mmap, res.MS)
+		null = append(null, res.Null...)
+		gr.Skip += res.Skip
+	}
+
+	// copy unique metrics from map to struct
+	for i := range mmap {
+		gr.MS = append(gr.MS, mmap[i])
+	}
+	// the map leaves them in random order, which would make the output differ between runs
+	gr.MS.SortByPath()
+	// series without values from one target may have them from another
+	seen := make(map[string]bool)
+	for _, path := range null {
+		if mmap[path] == nil && !seen[path] {
+			gr.Null = append(gr.Null, path)
+			seen[path] = true
+		}
+	}
+	sort.Strings(gr.Null)
+	sort.Slice(gr.Requests, func(i, j int) bool { return gr.Requests[i].URL < gr.Requests[j].URL })
+
+	chRes <- gr
+}
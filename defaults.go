@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DEF_DEFAULTS_NAME string = "check_graphite/defaults.yaml"
+	DEF_DEFAULTS_ETC  string = "/etc/" + DEF_DEFAULTS_NAME
+)
+
+// site wide defaults for flags, set in app.Before, and applied beneath the flags given for each check
+var defaults map[string][]string
+
+// defaultsFiles() returns the files to read defaults from, the system wide one first, so the one of
+// the user overrides it
+func defaultsFiles() []string {
+	files := []string{DEF_DEFAULTS_ETC}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			dir = filepath.Join(home, ".config")
+		}
+	}
+	if dir != "" {
+		files = append(files, filepath.Join(dir, DEF_DEFAULTS_NAME))
+	}
+	return files
+}
+
+// LoadDefaults() reads defaults for flags from YAML files, keyed by the long flag name, e.g.:
+//
+//	hostname: graphite.example.com
+//	protocol: https
+//	port: 443
+//	header: ["X-Scope-OrgID: ops"]
+//	http-user: nagios
+//	ca-file: /etc/ssl/certs/internal-ca.pem
+//
+// A flag in a later file overrides the same flag in an earlier one. Files that don't exist are skipped.
+func LoadDefaults(files []string) (map[string][]string, error) {
+	defs := make(map[string][]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var raw map[string]interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for name, v := range raw {
+			switch v := v.(type) {
+			case []interface{}:
+				vals := make([]string, len(v))
+				for i := range v {
+					vals[i] = fmt.Sprint(v[i])
+				}
+				defs[name] = vals
+			case map[interface{}]interface{}:
+				return nil, fmt.Errorf("%s: %s: should be a value or a list of values", file, name)
+			default:
+				defs[name] = []string{fmt.Sprint(v)}
+			}
+		}
+	}
+	return defs, nil
+}
+
+// applyDefaults() sets the flags in defs that weren't given on the command line or in the environment
+func applyDefaults(c *cli.Context, defs map[string][]string) error {
+	for name, vals := range defs {
+		if c.IsSet(name) {
+			continue
+		}
+		for _, v := range vals {
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("Invalid default for %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
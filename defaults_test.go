@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	defs := map[string][]string{
+		"hostname": {"graphite.example.com"},
+		"port":     {"8080"},
+		"warning":  {"80"},
+		"header":   {"X-A: 1", "X-B: 2"},
+	}
+	tests := []struct {
+		args     []string
+		hostname string
+		port     uint64
+		header   []string
+	}{
+		{[]string{}, "graphite.example.com", 8080, []string{"X-A: 1", "X-B: 2"}},
+		{[]string{"-H", "given"}, "given", 8080, []string{"X-A: 1", "X-B: 2"}},
+		{[]string{"--port", "2003"}, "graphite.example.com", 2003, []string{"X-A: 1", "X-B: 2"}},
+		{[]string{"--header", "X-C: 3"}, "graphite.example.com", 8080, []string{"X-C: 3"}},
+	}
+	for _, tt := range tests {
+		c, err := parseCheck(testApp(), "test", tt.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if err := applyDefaults(c, defs); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if got := c.String("hostname"); got != tt.hostname {
+			t.Errorf("%v: got hostname %q, want %q", tt.args, got, tt.hostname)
+		}
+		if got := c.Uint64("port"); got != tt.port {
+			t.Errorf("%v: got port %d, want %d", tt.args, got, tt.port)
+		}
+		if got := c.StringSlice("header"); !reflect.DeepEqual(got, tt.header) {
+			t.Errorf("%v: got headers %q, want %q", tt.args, got, tt.header)
+		}
+	}
+
+	c, err := parseCheck(testApp(), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDefaults(c, map[string][]string{"port": {"http"}}); err == nil {
+		t.Errorf("got no error for an invalid default")
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etc := filepath.Join(dir, "etc.yaml")
+	user := filepath.Join(dir, "user.yaml")
+	ioutil.WriteFile(etc, []byte("hostname: graphite\nport: 8080\nheader: [\"X-A: 1\"]\n"), 0600)
+	ioutil.WriteFile(user, []byte("port: 443\n"), 0600)
+
+	defs, err := LoadDefaults([]string{etc, user, filepath.Join(dir, "missing.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"hostname": {"graphite"}, "port": {"443"}, "header": {"X-A: 1"}}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("got %v, want %v", defs, want)
+	}
+
+	ioutil.WriteFile(user, []byte("hostname:\n  a: b\n"), 0600)
+	if _, err := LoadDefaults([]string{user}); err == nil {
+		t.Errorf("got no error for a map as a value")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Graphite API implementations that differ from graphite-web in ways that matter to us
+const (
+	DL_GRAPHITE  string = "graphite"
+	DL_CARBONAPI string = "carbonapi"
+	DL_VM        string = "victoriametrics"
+	VM_PING_PATH string = "/metrics/find?query=*" // VictoriaMetrics has no /version
+)
+
+var (
+	htmlTitleRE = regexp.MustCompile(`(?is)<title>(.*?)</title>`)
+	htmlExcRE   = regexp.MustCompile(`(?is)<th>Exception Value:</th>\s*<td><pre>(.*?)</pre>`)
+	htmlTagRE   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// validDialect() returns the given dialect if it's one we know of, otherwise DL_GRAPHITE
+func validDialect(dialect string) string {
+	switch dialect {
+	case DL_CARBONAPI, DL_VM:
+		return dialect
+	default:
+		return DL_GRAPHITE
+	}
+}
+
+// unsupported() returns an error if the current dialect is known to not have the given feature
+func unsupported(feature string) error {
+	switch {
+	case feature == "events" && conn.Dialect != DL_GRAPHITE:
+		return fmt.Errorf("the events API is not supported by %s", conn.Dialect)
+	}
+	return nil
+}
+
+// respError() returns nil for a successful response, otherwise an error with the message from the
+// body, extracted according to how the current dialect formats errors
+func respError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	body := strings.TrimSpace(string(data))
+
+	var msg string
+	switch conn.Dialect {
+	case DL_VM:
+		// sometimes JSON, sometimes plain text
+		var jerr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &jerr) == nil && jerr.Error != "" {
+			msg = jerr.Error
+		} else {
+			msg = body
+		}
+	case DL_CARBONAPI:
+		msg = body
+	default:
+		// graphite-web gives a Django error page, so dig out the interesting part
+		if sm := htmlExcRE.FindStringSubmatch(body); sm != nil {
+			msg = html.UnescapeString(htmlTagRE.ReplaceAllString(sm[1], ""))
+		} else if sm := htmlTitleRE.FindStringSubmatch(body); sm != nil {
+			msg = html.UnescapeString(strings.TrimSpace(sm[1]))
+		} else {
+			msg = htmlTagRE.ReplaceAllString(body, "")
+		}
+	}
+
+	// keep it to one reasonably short line, as it ends up in the status line
+	msg = strings.Join(strings.Fields(msg), " ")
+	if len(msg) > 200 {
+		msg = msg[:200] + "..."
+	}
+	if msg == "" {
+		return fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	return fmt.Errorf("Unexpected HTTP status: %s: %s", resp.Status, msg)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_DISCOVERY_TIMEOUT time.Duration = 5 * time.Second  // max time to look up endpoints
+	DEF_CONSUL_ADDR       string        = "127.0.0.1:8500" // the local Consul agent
+)
+
+// Discovery finds the endpoints of the backend, for when they're not given as a fixed address
+type Discovery interface {
+	// Endpoints() returns the addresses of the backend, as "host:port", in order of preference
+	Endpoints(ctx context.Context) ([]string, error)
+	// String() describes where the endpoints come from, for logging
+	String() string
+}
+
+// SRVDiscovery finds the endpoints in DNS SRV records
+type SRVDiscovery struct {
+	Name string // e.g. _graphite._tcp.example.com
+}
+
+// Endpoints() returns the targets of the SRV records, by priority and randomized by weight within a priority
+func (sd *SRVDiscovery) Endpoints(ctx context.Context) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", sd.Name)
+	if err != nil {
+		return nil, err
+	}
+	eps := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		eps = append(eps, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return eps, nil
+}
+
+func (sd *SRVDiscovery) String() string {
+	return "SRV " + sd.Name
+}
+
+// ConsulDiscovery finds the endpoints as the healthy instances of a service in Consul
+type ConsulDiscovery struct {
+	Addr    string // of the Consul agent, with or without scheme
+	Service string
+	Token   string // ACL token, if needed
+}
+
+// consulEntry is the part of an entry from the Consul health API that we need
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Endpoints() returns the instances of the service passing their health checks, shuffled to spread the load
+func (cd *ConsulDiscovery) Endpoints(ctx context.Context) ([]string, error) {
+	base := cd.Addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	u := strings.TrimSuffix(base, "/") + "/v1/health/service/" + url.PathEscape(cd.Service) + "?passing=1"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if cd.Token != "" {
+		req.Header.Set("X-Consul-Token", cd.Token)
+	}
+	// not httpclient(), which would dial through discovery again
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	eps := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		eps = append(eps, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+	}
+	rand.Shuffle(len(eps), func(i, j int) { eps[i], eps[j] = eps[j], eps[i] })
+	return eps, nil
+}
+
+func (cd *ConsulDiscovery) String() string {
+	return "Consul service " + cd.Service
+}
+
+// discover() returns the endpoints from conn.Discovery, failing if there are none
+func discover(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, DEF_DISCOVERY_TIMEOUT)
+	defer cancel()
+	eps, err := conn.Discovery.Endpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to discover the backend from %s: %v", conn.Discovery, err)
+	}
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("No backend found from %s", conn.Discovery)
+	}
+	log.Debugf("Discovered backend endpoints from %s: %v", conn.Discovery, eps)
+	return eps, nil
+}
+
+// discoveredHost() returns the preferred endpoint as host and port, for the URL to the backend
+func discoveredHost() (string, uint64, error) {
+	eps, err := discover(context.Background())
+	if err != nil {
+		return "", 0, err
+	}
+	host, sport, err := net.SplitHostPort(eps[0])
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	return host, port, err
+}
+
+// failoverDial() connects to addr, or when it's a discovered endpoint that doesn't answer,
+// to the other discovered endpoints in order of preference
+func failoverDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	eps, err := discover(ctx)
+	if err != nil {
+		return resolveDial(ctx, network, addr)
+	}
+	known := false
+	for _, ep := range eps {
+		if ep == addr {
+			known = true
+		}
+	}
+	if !known {
+		return resolveDial(ctx, network, addr)
+	}
+
+	c, err := resolveDial(ctx, network, addr)
+	for _, ep := range eps {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if ep == addr {
+			continue
+		}
+		log.Warnf("Unable to connect to %s, failing over to %s: %v", addr, ep, err)
+		addr = ep
+		c, err = resolveDial(ctx, network, ep)
+	}
+	return c, err
+}
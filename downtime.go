@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Monitoring systems we can ask about downtimes, for --downtime-check
+const (
+	DT_OP5     string = "op5"
+	DT_ICINGA2 string = "icinga2"
+)
+
+// Silencer tells if alerts for a host or service are silenced in the monitoring system, by a
+// scheduled downtime or an acknowledgement
+type Silencer interface {
+	// Silenced() returns why alerts are silenced, or "" if they're not. service may be "" to only ask about the host.
+	Silenced(host, service string) (string, error)
+}
+
+// op5Status is the part of the op5 status of a host or service that we need
+type op5Status struct {
+	ScheduledDowntimeDepth int `json:"scheduled_downtime_depth"`
+	Acknowledged           int `json:"acknowledged"`
+}
+
+// Silenced() asks the op5 status API
+func (oc *Op5Client) Silenced(host, service string) (string, error) {
+	var hs op5Status
+	code, err := oc.call(http.MethodGet, "/status/host/"+url.PathEscape(host), nil, &hs)
+	if err != nil {
+		return "", err
+	}
+	if code != http.StatusNotFound && hs.ScheduledDowntimeDepth > 0 {
+		return fmt.Sprintf("host %s is in scheduled downtime", host), nil
+	}
+	if service == "" {
+		return "", nil
+	}
+	var ss op5Status
+	code, err = oc.call(http.MethodGet, "/status/service/"+url.PathEscape(host+";"+service), nil, &ss)
+	if err != nil || code == http.StatusNotFound {
+		return "", err
+	}
+	switch {
+	case ss.ScheduledDowntimeDepth > 0:
+		return fmt.Sprintf("service %s is in scheduled downtime", service), nil
+	case ss.Acknowledged > 0:
+		return fmt.Sprintf("service %s is acknowledged", service), nil
+	}
+	return "", nil
+}
+
+// IcingaClient talks to the Icinga 2 REST API
+type IcingaClient struct {
+	URL      string // e.g. https://icinga.example.com:5665
+	User     string
+	Password string
+}
+
+// icingaObjects is the response of the Icinga 2 objects API, with the attributes we need
+type icingaObjects struct {
+	Results []struct {
+		Attrs struct {
+			DowntimeDepth   float64 `json:"downtime_depth"`
+			Acknowledgement float64 `json:"acknowledgement"`
+		} `json:"attrs"`
+	} `json:"results"`
+}
+
+// object() gets the downtime and acknowledgement attributes of an object, nil if it doesn't exist
+func (ic *IcingaClient) object(kind, name string) (*icingaObjects, error) {
+	u := strings.TrimSuffix(ic.URL, "/") + "/v1/objects/" + kind + "/" + url.PathEscape(name) + "?attrs=downtime_depth&attrs=acknowledgement"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UA)
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(ic.User, ic.Password)
+
+	log.Debugf("Icinga API: GET %s", u)
+	resp, err := httpclient(u).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: %s: %s", u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var objs icingaObjects
+	if err := json.NewDecoder(resp.Body).Decode(&objs); err != nil {
+		return nil, err
+	}
+	return &objs, nil
+}
+
+// Silenced() asks the Icinga 2 objects API
+func (ic *IcingaClient) Silenced(host, service string) (string, error) {
+	objs, err := ic.object("hosts", host)
+	if err != nil {
+		return "", err
+	}
+	if objs != nil && len(objs.Results) > 0 && objs.Results[0].Attrs.DowntimeDepth > 0 {
+		return fmt.Sprintf("host %s is in scheduled downtime", host), nil
+	}
+	if service == "" {
+		return "", nil
+	}
+	objs, err = ic.object("services", host+"!"+service)
+	if err != nil || objs == nil || len(objs.Results) == 0 {
+		return "", err
+	}
+	switch {
+	case objs.Results[0].Attrs.DowntimeDepth > 0:
+		return fmt.Sprintf("service %s is in scheduled downtime", service), nil
+	case objs.Results[0].Attrs.Acknowledgement > 0:
+		return fmt.Sprintf("service %s is acknowledged", service), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	ESC_TRIGGER string = "trigger"
+	ESC_RESOLVE string = "resolve"
+
+	DEF_PAGERDUTY_URL string = "https://events.pagerduty.com/v2/enqueue"
+	DEF_OPSGENIE_URL  string = "https://api.opsgenie.com"
+)
+
+// Incident is one to open or close in an incident management service, for a check entering or
+// leaving CRITICAL
+type Incident struct {
+	Action  string // ESC_TRIGGER or ESC_RESOLVE
+	Key     string // the same for all events of a check, for the service to tell which incident is meant
+	Check   string
+	Source  string // the host the check is for
+	Summary string
+	Metric  string // the one in the worst state, if any
+	Value   float64
+	Link    string // to the graph of the metric
+	Labels  []Label
+}
+
+// details() returns what's known about the event besides its summary, for the incident
+func (inc *Incident) details() map[string]string {
+	details := map[string]string{"check": inc.Check}
+	if inc.Metric != "" {
+		details["metric"] = inc.Metric
+		details["value"] = fmt.Sprintf("%g", inc.Value)
+	}
+	for _, l := range inc.Labels {
+		details[l.Key] = l.Value
+	}
+	return details
+}
+
+// Escalator opens and closes incidents in an incident management service
+type Escalator interface {
+	Send(inc *Incident) error
+}
+
+// dedupKey() returns the key for the incidents of a check, from its name and identity
+func dedupKey(name, checkid string) string {
+	h := fnv.New32a()
+	h.Write([]byte(checkid))
+	return fmt.Sprintf("%s/%08x", name, h.Sum32())
+}
+
+// eventSource() returns the host an event is from, this one if the check doesn't say
+func eventSource(host string) string {
+	if host != "" {
+		return host
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "check_graphite"
+}
+
+// Escalate() sends the incident to each escalator, if the status means the check entered or left CRITICAL
+// since the last one sent. WARNING leaves it, UNKNOWN neither enters nor leaves. Without the state, it's
+// sent every run, which is harmless as the dedup key makes it the same incident.
+func Escalate(st *State, escs []Escalator, inc *Incident, status int) error {
+	var escalated bool
+	if st != nil {
+		if _, err := st.Get("escalated", &escalated); err != nil {
+			return err
+		}
+	}
+	switch {
+	case status == E_CRITICAL && (st == nil || !escalated):
+		inc.Action = ESC_TRIGGER
+	case (status == E_OK || status == E_WARNING) && (st == nil || escalated):
+		inc.Action = ESC_RESOLVE
+	default:
+		return nil
+	}
+	for _, esc := range escs {
+		if err := esc.Send(inc); err != nil {
+			return err // not remembered as sent, so all are tried again next run
+		}
+	}
+	if st != nil {
+		return st.Put("escalated", inc.Action == ESC_TRIGGER)
+	}
+	return nil
+}
+
+// PagerDuty sends events to the PagerDuty Events API v2
+type PagerDuty struct {
+	URL        string
+	RoutingKey string // of the integration of the service
+}
+
+func (pd *PagerDuty) Send(inc *Incident) error {
+	body := map[string]interface{}{
+		"routing_key":  pd.RoutingKey,
+		"event_action": inc.Action,
+		"dedup_key":    inc.Key,
+	}
+	if inc.Action == ESC_TRIGGER {
+		body["payload"] = map[string]interface{}{
+			"summary":        fmt.Sprintf("%s: %s", inc.Check, inc.Summary),
+			"source":         inc.Source,
+			"severity":       "critical",
+			"component":      inc.Metric,
+			"custom_details": inc.details(),
+		}
+		if inc.Link != "" {
+			body["links"] = []map[string]string{{"href": inc.Link, "text": "Graph"}}
+		}
+	}
+	return postJSON(pd.URL, nil, body)
+}
+
+// OpsGenie creates and closes alerts with the OpsGenie Alert API
+type OpsGenie struct {
+	URL    string // e.g. https://api.eu.opsgenie.com for the EU instance
+	APIKey string
+}
+
+func (og *OpsGenie) Send(inc *Incident) error {
+	header := http.Header{"Authorization": {"GenieKey " + og.APIKey}}
+	base := strings.TrimSuffix(og.URL, "/") + "/v2/alerts"
+	if inc.Action == ESC_RESOLVE {
+		return postJSON(base+"/"+url.PathEscape(inc.Key)+"/close?identifierType=alias", header, map[string]string{
+			"source": inc.Source,
+			"note":   inc.Summary,
+		})
+	}
+	desc := inc.Summary
+	if inc.Link != "" {
+		desc += "\n\nGraph: " + inc.Link
+	}
+	msg := fmt.Sprintf("%s: %s", inc.Check, inc.Summary)
+	if len(msg) > 130 {
+		msg = msg[:127] + "..." // the most OpsGenie takes
+	}
+	return postJSON(base, header, map[string]interface{}{
+		"message":     msg,
+		"alias":       inc.Key,
+		"description": desc,
+		"source":      inc.Source,
+		"details":     inc.details(),
+		"priority":    "P1",
+	})
+}
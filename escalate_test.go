@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeEscalator remembers what it was sent, and fails if told to
+type fakeEscalator struct {
+	sent []string
+	fail bool
+}
+
+func (fe *fakeEscalator) Send(inc *Incident) error {
+	if fe.fail {
+		return fmt.Errorf("unavailable")
+	}
+	fe.sent = append(fe.sent, inc.Action)
+	return nil
+}
+
+func TestEscalate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each run is a status, and what's sent for it, "" for nothing, carrying the state over
+	tests := []struct {
+		name string
+		runs []int
+		want []string
+	}{
+		{"ok stays quiet", []int{E_OK, E_OK}, []string{"", ""}},
+		{"critical triggers once", []int{E_CRITICAL, E_CRITICAL}, []string{ESC_TRIGGER, ""}},
+		{"ok resolves", []int{E_CRITICAL, E_OK, E_OK}, []string{ESC_TRIGGER, ESC_RESOLVE, ""}},
+		{"warning resolves", []int{E_CRITICAL, E_WARNING}, []string{ESC_TRIGGER, ESC_RESOLVE}},
+		{"unknown neither", []int{E_CRITICAL, E_UNKNOWN, E_CRITICAL, E_UNKNOWN, E_OK}, []string{ESC_TRIGGER, "", "", "", ESC_RESOLVE}},
+		{"unknown first", []int{E_UNKNOWN, E_WARNING, E_CRITICAL}, []string{"", "", ESC_TRIGGER}},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("state%d.json", i))
+		for j, status := range tt.runs {
+			st, err := OpenState(context.Background(), file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fe := &fakeEscalator{}
+			if err := Escalate(st, []Escalator{fe}, &Incident{Key: "k"}, status); err != nil {
+				t.Fatalf("%s: run %d: %v", tt.name, j+1, err)
+			}
+			if err := st.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if len(fe.sent) > 0 {
+				got = fe.sent[0]
+			}
+			if len(fe.sent) > 1 || got != tt.want[j] {
+				t.Errorf("%s: run %d: sent %v, want %q", tt.name, j+1, fe.sent, tt.want[j])
+			}
+		}
+	}
+}
+
+func TestEscalateFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := OpenState(context.Background(), filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// a trigger that didn't go through is tried again on the next run
+	fe := &fakeEscalator{fail: true}
+	if err := Escalate(st, []Escalator{fe}, &Incident{}, E_CRITICAL); err == nil {
+		t.Errorf("got no error from a failed escalator")
+	}
+	fe.fail = false
+	if err := Escalate(st, []Escalator{fe}, &Incident{}, E_CRITICAL); err != nil || len(fe.sent) != 1 || fe.sent[0] != ESC_TRIGGER {
+		t.Errorf("got %v, %v after a failed trigger, want it triggered", fe.sent, err)
+	}
+}
+
+func TestEscalateStateless(t *testing.T) {
+	// without the state every run is sent, other than UNKNOWN
+	for status, want := range map[int]string{E_OK: ESC_RESOLVE, E_WARNING: ESC_RESOLVE, E_CRITICAL: ESC_TRIGGER, E_UNKNOWN: ""} {
+		fe := &fakeEscalator{}
+		if err := Escalate(nil, []Escalator{fe}, &Incident{}, status); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if len(fe.sent) > 0 {
+			got = fe.sent[0]
+		}
+		if got != want {
+			t.Errorf("status %d: sent %q, want %q", status, got, want)
+		}
+	}
+}
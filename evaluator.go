@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	EV_THRESHOLD string = "threshold"
+)
+
+// How to sum up the values of many metrics, for --aggregate
+const (
+	AGG_AVG    string = "avg"
+	AGG_MEDIAN string = "median"
+)
+
+// Evaluation is what an Evaluator made of a set of metrics
+type Evaluation struct {
+	Status  int        // state of the check
+	Summary string     // status line, without status word and perfdata
+	O, W, C Metrics    // metrics by state, each sorted worst first, possibly only the worst ones
+	Perf    []PerfData // perfdata about the values, response time is added by the caller
+	Warn    string     // thresholds in perfdata form, empty if not applicable,
+	Crit    string     // for outputs showing each metric on its own
+}
+
+// Evaluator classifies metrics and decides the state of a check from them
+type Evaluator interface {
+	Evaluate(ms Metrics) *Evaluation
+}
+
+// EvaluatorFactory creates an Evaluator from the options given on the command line
+type EvaluatorFactory func(c *cli.Context) (Evaluator, error)
+
+var evaluators = make(map[string]EvaluatorFactory)
+
+// RegisterEvaluator() makes an evaluation strategy available by name, for --evaluator
+func RegisterEvaluator(name string, f EvaluatorFactory) {
+	evaluators[name] = f
+}
+
+// EvaluatorNames() returns the names of all registered evaluators, sorted
+func EvaluatorNames() []string {
+	names := make([]string, 0, len(evaluators))
+	for name := range evaluators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEvaluator() creates the named Evaluator
+func NewEvaluator(name string, c *cli.Context) (Evaluator, error) {
+	f, ok := evaluators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown evaluator %q (options: %s)", name, strings.Join(EvaluatorNames(), ", "))
+	}
+	return f(c)
+}
+
+// evaluatorName() returns the evaluator to use, as given, or as implied by the flags of another one
+func evaluatorName(c *cli.Context) string {
+	if c.IsSet("evaluator") {
+		return c.String("evaluator")
+	}
+	switch {
+	case c.IsSet("expect"):
+		return EV_EXPECT
+	case c.IsSet("band"):
+		return EV_SEASONAL
+	case c.IsSet("forecast-horizon"):
+		return EV_FORECAST
+	}
+	return c.String("evaluator")
+}
+
+func init() {
+	RegisterEvaluator(EV_THRESHOLD, NewThresholdEvaluator)
+}
+
+// ThresholdEvaluator compares each metric to static thresholds, and changes state when
+// enough of them breach, by count and percentage of all metrics
+type ThresholdEvaluator struct {
+	WCond, CCond     string
+	Warn, Crit       float64
+	LowWarn, LowCrit float64
+	HasWarn, HasCrit bool
+	HasLowWarn       bool
+	HasLowCrit       bool
+	WarnPct, CritPct float64
+	WarnCnt, CritCnt int
+	Top              int     // how many metrics to keep in each state, 0 for all
+	PerfMin, PerfMax string  // the range values can possibly have, for perfdata, empty if unknown
+	Aggregate        string  // how to sum up values, AGG_AVG or AGG_MEDIAN
+	Across           float64 // percentile of all values to judge instead of each metric, 0 to judge each
+}
+
+// NewThresholdEvaluator() creates a ThresholdEvaluator from the threshold flags
+func NewThresholdEvaluator(c *cli.Context) (Evaluator, error) {
+	te := &ThresholdEvaluator{
+		WCond:      c.String("if-warning"),
+		CCond:      c.String("if-critical"),
+		Warn:       c.Float64("warning"),
+		Crit:       c.Float64("critical"),
+		LowWarn:    c.Float64("low-warning"),
+		LowCrit:    c.Float64("low-critical"),
+		HasWarn:    c.IsSet("warning") || c.IsSet("w"),
+		HasCrit:    c.IsSet("critical") || c.IsSet("c"),
+		HasLowWarn: c.IsSet("low-warning"),
+		HasLowCrit: c.IsSet("low-critical"),
+		WarnPct:    c.Float64("warning-pct"),
+		CritPct:    c.Float64("critical-pct"),
+		WarnCnt:    c.Int("warning-count"),
+		CritCnt:    c.Int("critical-count"),
+		Top:        c.Int("top"),
+		PerfMin:    c.String("perf-min"),
+		PerfMax:    c.String("perf-max"),
+		Aggregate:  c.String("aggregate"),
+	}
+	if spec := c.String("aggregate-across"); spec != "" {
+		p, err := ParsePercentile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --aggregate-across: %v", err)
+		}
+		te.Across = p
+	}
+
+	// separate conditions for warning and critical fall back to the common one
+	if te.WCond == "" {
+		te.WCond = c.String("if")
+	}
+	if te.CCond == "" {
+		te.CCond = c.String("if")
+	}
+	te.WCond = validCondition(te.WCond)
+	te.CCond = validCondition(te.CCond)
+
+	if te.Aggregate != AGG_AVG && te.Aggregate != AGG_MEDIAN {
+		return nil, fmt.Errorf("Invalid --aggregate %q (options: %s, %s)", te.Aggregate, AGG_AVG, AGG_MEDIAN)
+	}
+
+	for _, lim := range []string{te.PerfMin, te.PerfMax} {
+		if _, err := strconv.ParseFloat(lim, 64); lim != "" && err != nil {
+			return nil, fmt.Errorf("Invalid perfdata limit %q, should be a number", lim)
+		}
+	}
+
+	if err := validateThresholds(te.HasWarn, te.HasCrit, te.HasLowWarn, te.HasLowCrit, te.WCond, te.CCond,
+		te.Warn, te.Crit, te.LowWarn, te.LowCrit); err != nil {
+		return nil, fmt.Errorf("Invalid thresholds: %v", err)
+	}
+	return te, nil
+}
+
+// Predicates() returns what makes a metric warning and critical. A threshold not given never triggers.
+func (te *ThresholdEvaluator) Predicates() (wpred, cpred Predicate) {
+	wpred = Never
+	cpred = Never
+	if te.HasWarn {
+		wpred = Threshold(te.WCond, te.Warn)
+	}
+	if te.HasCrit {
+		cpred = Threshold(te.CCond, te.Crit)
+	}
+	// lower band, triggering on values below it regardless of condition
+	if te.HasLowWarn {
+		wpred = Any(wpred, Threshold(CMP_LT, te.LowWarn))
+	}
+	if te.HasLowCrit {
+		cpred = Any(cpred, Threshold(CMP_LT, te.LowCrit))
+	}
+	return
+}
+
+// aggregate() sums up the values of metrics as given by Aggregate
+func (te *ThresholdEvaluator) aggregate(ms Metrics) float64 {
+	if te.Aggregate == AGG_MEDIAN {
+		return ms.Median()
+	}
+	return ms.Avg()
+}
+
+// Evaluate() implements Evaluator
+func (te *ThresholdEvaluator) Evaluate(ms Metrics) *Evaluation {
+	wpred, cpred := te.Predicates()
+	o, w, c := ms.FilterOffenders(wpred, cpred)
+
+	ev := &Evaluation{
+		Warn: perfRange(te.WCond, te.Warn, te.HasWarn, te.LowWarn, te.HasLowWarn),
+		Crit: perfRange(te.CCond, te.Crit, te.HasCrit, te.LowCrit, te.HasLowCrit),
+	}
+
+	nc := len(c)
+	nw := len(w)
+	no := len(o)
+	log.Debugf("#c: %d, #w: %d, #o: %d\n", nc, nw, no)
+
+	// helper func, returns how big a part of all matched metrics n is, in percent
+	pct := func(n int) float64 {
+		if len(ms) == 0 {
+			return 0
+		}
+		return float64(n) / float64(len(ms)) * 100
+	}
+
+	// helper func
+	perf := func(bucket Metrics) []PerfData {
+		return []PerfData{
+			{Label: "value", Value: te.aggregate(bucket), Unknown: len(bucket) == 0, Warn: ev.Warn, Crit: ev.Crit,
+				Min: te.PerfMin, Max: te.PerfMax},
+			{Label: "num_matching_metrics", Value: float64(len(bucket)), Count: true},
+		}
+	}
+
+	// helper func, describes the thresholds of a state that were given, e.g. "above the critical threshold
+	// of 90.00 or below 20.00", or "below the low critical threshold of 20.00" for a lower band alone
+	breach := func(state, cond string, t float64, hasT bool, low float64, hasLow bool) string {
+		state = strings.ToLower(state)
+		switch {
+		case !hasT:
+			return fmt.Sprintf("below the low %s threshold of %.02f", state, low)
+		case hasLow:
+			return fmt.Sprintf("%s the %s threshold of %.02f or below %.02f", dirWord(cond), state, t, low)
+		}
+		return fmt.Sprintf("%s the %s threshold of %.02f", dirWord(cond), state, t)
+	}
+	cbreach := breach(S_CRITICAL, te.CCond, te.Crit, te.HasCrit, te.LowCrit, te.HasLowCrit)
+	wbreach := breach(S_WARNING, te.WCond, te.Warn, te.HasWarn, te.LowWarn, te.HasLowWarn)
+
+	// critical offenders are past the warning threshold as well, if the thresholds point the same way
+	nwarn := nw
+	if upward(te.WCond) == upward(te.CCond) {
+		nwarn += nc
+	}
+
+	// With the default count limits of 1 and percentage limits of 0, any offender is enough to change state
+	switch {
+	case len(ms) == 0:
+		ev.Status = E_UNKNOWN
+		ev.Summary = "No values to evaluate"
+		ev.Perf = perf(Metrics{}) // value unknown
+	case te.Across > 0:
+		// the percentile of all decides, so a known number of stragglers can be tolerated
+		v := ms.Percentile(te.Across)
+		pname := "p" + strconv.FormatFloat(te.Across, 'f', -1, 64)
+		ev.Summary = fmt.Sprintf("%s of %d metrics at %.02f", pname, len(ms), v)
+		switch {
+		case cpred(v):
+			ev.Status = E_CRITICAL
+			ev.Summary += ", " + cbreach
+		case wpred(v):
+			ev.Status = E_WARNING
+			ev.Summary += ", " + wbreach
+		default:
+			ev.Status = E_OK
+			if nw+nc > 0 {
+				ev.Summary += fmt.Sprintf(" (%d metrics, %.01f%%, breaching thresholds)", nw+nc, pct(nw+nc))
+			}
+		}
+		ev.Perf = perf(ms)
+		ev.Perf[0].Value = v
+	case nc > 0 && nc >= te.CritCnt && pct(nc) > te.CritPct:
+		ev.Status = E_CRITICAL
+		ev.Summary = fmt.Sprintf("%d metrics are %s", nc, cbreach)
+		ev.Perf = perf(c)
+	case (te.HasWarn || te.HasLowWarn) && nwarn > 0 && nwarn >= te.WarnCnt && pct(nwarn) > te.WarnPct:
+		// critical offenders only end up here when there are too few of them to trigger CRITICAL
+		ev.Status = E_WARNING
+		ev.Summary = fmt.Sprintf("%d metrics are %s", nwarn, wbreach)
+		if nwarn > nw {
+			ev.Perf = perf(append(append(Metrics{}, c...), w...))
+		} else {
+			ev.Perf = perf(w)
+		}
+	default:
+		var onote string // "offender note"
+		if nw+nc > 0 {
+			onote = fmt.Sprintf(" (%d metrics, %.01f%%, breaching thresholds)", nw+nc, pct(nw+nc))
+		}
+		ev.Status = E_OK
+		agg := fmt.Sprintf("%.02f on average", o.Avg())
+		if te.Aggregate == AGG_MEDIAN {
+			agg = fmt.Sprintf("a median of %.02f", o.Median())
+		}
+		ev.Summary = fmt.Sprintf("%d metrics at %s, min: %.02f, max: %.02f%s", no, agg, o.Min(), o.Max(), onote)
+		ev.Perf = perf(o)
+	}
+
+	// the statistics above are for all metrics, but only the top ones are kept to show
+	ev.C = c.TopFor(te.CCond, te.Top)
+	ev.W = w.TopFor(te.WCond, te.Top)
+	ev.O = o.TopFor(te.WCond, te.Top)
+	return ev
+}
+
+// perfRange() returns a threshold as a range as per the Nagios plugin guidelines, alerting on the
+// values the condition triggers on, and also below low if hasLow. Empty if there's no threshold.
+// A range can only be open at one end, so with a lower band ge and le are taken as gt and lt.
+func perfRange(cond string, t float64, hasT bool, low float64, hasLow bool) string {
+	num := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	switch {
+	case !hasT && !hasLow:
+		return ""
+	case !hasT:
+		return num(low) + ":"
+	case hasLow && (cond == CMP_GT || cond == CMP_GE):
+		return num(low) + ":" + num(t)
+	case hasLow:
+		return num(math.Max(t, low)) + ":"
+	}
+	switch cond {
+	case CMP_GT:
+		return "~:" + num(t)
+	case CMP_GE:
+		return "@" + num(t) + ":"
+	case CMP_LE:
+		return "@~:" + num(t)
+	default:
+		return num(t) + ":"
+	}
+}
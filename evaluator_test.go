@@ -0,0 +1,181 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// series() returns a metric with a datapoint per minute, its value the last one
+func series(path string, vals ...float64) *Metric {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &Metric{Path: path}
+	for i, v := range vals {
+		m.Points = append(m.Points, Point{TS: t0.Add(time.Duration(i) * time.Minute), Value: v})
+	}
+	if len(vals) > 0 {
+		m.Value = vals[len(vals)-1]
+		m.TS = m.Points[len(m.Points)-1].TS
+	}
+	return m
+}
+
+// values() returns a metric per value, with one datapoint each
+func values(vals ...float64) Metrics {
+	ms := Metrics{}
+	for i, v := range vals {
+		ms = append(ms, series(string(rune('a'+i)), v))
+	}
+	return ms
+}
+
+func TestThresholdEvaluator(t *testing.T) {
+	// -w 80 -c 90, as the flags default to
+	te := func(mod func(te *ThresholdEvaluator)) *ThresholdEvaluator {
+		te := &ThresholdEvaluator{
+			WCond: CMP_GT, CCond: CMP_GT,
+			Warn: 80, Crit: 90,
+			HasWarn: true, HasCrit: true,
+			WarnCnt: 1, CritCnt: 1,
+			Aggregate: AGG_AVG,
+		}
+		if mod != nil {
+			mod(te)
+		}
+		return te
+	}
+	tests := []struct {
+		name   string
+		te     *ThresholdEvaluator
+		ms     Metrics
+		status int
+		nw, nc int
+	}{
+		{"no metrics", te(nil), Metrics{}, E_UNKNOWN, 0, 0},
+		{"all ok", te(nil), values(10, 20, 30), E_OK, 0, 0},
+		{"one warning", te(nil), values(10, 85), E_WARNING, 1, 0},
+		{"one critical", te(nil), values(10, 85, 95), E_CRITICAL, 1, 1},
+		{"on the threshold", te(nil), values(80, 90), E_WARNING, 1, 0},
+		{"too few critical, but past warning", te(func(te *ThresholdEvaluator) {
+			te.CritCnt = 3
+		}), values(10, 95, 95), E_WARNING, 0, 2},
+		{"enough critical", te(func(te *ThresholdEvaluator) {
+			te.CritCnt = 3
+		}), values(95, 95, 95), E_CRITICAL, 0, 3},
+		{"too few critical, no warning threshold", te(func(te *ThresholdEvaluator) {
+			te.HasWarn, te.CritCnt = false, 3
+		}), values(10, 95, 95), E_OK, 0, 2},
+		{"warning and critical count together", te(func(te *ThresholdEvaluator) {
+			te.CritCnt, te.WarnCnt = 3, 2
+		}), values(10, 85, 95), E_WARNING, 1, 1},
+		{"too few warning", te(func(te *ThresholdEvaluator) {
+			te.WarnCnt = 2
+		}), values(10, 85), E_OK, 1, 0},
+		{"warning percentage not exceeded", te(func(te *ThresholdEvaluator) {
+			te.WarnPct = 50
+		}), values(10, 20, 85, 85), E_OK, 2, 0},
+		{"warning percentage exceeded", te(func(te *ThresholdEvaluator) {
+			te.WarnPct = 50
+		}), values(10, 85, 85, 85), E_WARNING, 3, 0},
+		{"critical percentage not exceeded", te(func(te *ThresholdEvaluator) {
+			te.CritPct = 50
+		}), values(10, 95), E_WARNING, 0, 1},
+		{"below", te(func(te *ThresholdEvaluator) {
+			te.WCond, te.CCond, te.Warn, te.Crit = CMP_LT, CMP_LT, 20, 10
+		}), values(50, 15), E_WARNING, 1, 0},
+		{"below critical", te(func(te *ThresholdEvaluator) {
+			te.WCond, te.CCond, te.Warn, te.Crit = CMP_LT, CMP_LT, 20, 10
+		}), values(50, 5), E_CRITICAL, 0, 1},
+		{"opposite directions don't add up", te(func(te *ThresholdEvaluator) {
+			te.WCond, te.Warn, te.CritCnt = CMP_LT, 20, 2
+		}), values(50, 95), E_OK, 0, 1},
+		{"lower band", te(func(te *ThresholdEvaluator) {
+			te.HasLowWarn, te.LowWarn = true, 5
+		}), values(50, 2), E_WARNING, 1, 0},
+		{"lower band only", te(func(te *ThresholdEvaluator) {
+			te.HasWarn, te.HasCrit, te.HasLowCrit, te.LowCrit = false, false, true, 5
+		}), values(50, 2), E_CRITICAL, 0, 1},
+		{"percentile across all", te(func(te *ThresholdEvaluator) {
+			te.Across = 50
+		}), values(10, 20, 95), E_OK, 0, 1},
+	}
+	for _, tt := range tests {
+		ev := tt.te.Evaluate(tt.ms)
+		if ev.Status != tt.status {
+			t.Errorf("%s: got status %d (%s), want %d", tt.name, ev.Status, ev.Summary, tt.status)
+		}
+		if len(ev.W) != tt.nw || len(ev.C) != tt.nc {
+			t.Errorf("%s: got %d warning and %d critical metrics, want %d and %d", tt.name, len(ev.W), len(ev.C), tt.nw, tt.nc)
+		}
+	}
+}
+
+func TestThresholdEvaluatorWarningCount(t *testing.T) {
+	// -c 90 --critical-count 3 with 2 metrics past critical is a WARNING about those 2, with their value
+	te := &ThresholdEvaluator{
+		WCond: CMP_GT, CCond: CMP_GT,
+		Warn: 80, Crit: 90,
+		HasWarn: true, HasCrit: true,
+		WarnCnt: 1, CritCnt: 3,
+		Aggregate: AGG_AVG,
+	}
+	ev := te.Evaluate(values(10, 92, 98))
+	if want := "2 metrics are above the warning threshold of 80.00"; ev.Summary != want {
+		t.Errorf("got summary %q, want %q", ev.Summary, want)
+	}
+	if ev.Perf[0].Value != 95 || ev.Perf[1].Value != 2 {
+		t.Errorf("got value %v of %v metrics in perfdata, want 95 of 2", ev.Perf[0].Value, ev.Perf[1].Value)
+	}
+}
+
+func TestPerfRange(t *testing.T) {
+	tests := []struct {
+		cond   string
+		t      float64
+		hasT   bool
+		low    float64
+		hasLow bool
+		want   string
+	}{
+		{CMP_GT, 80, false, 0, false, ""},
+		{CMP_GT, 80, true, 0, false, "~:80"},
+		{CMP_GE, 80, true, 0, false, "@80:"},
+		{CMP_LT, 80, true, 0, false, "80:"},
+		{CMP_LE, 80, true, 0, false, "@~:80"},
+		{CMP_GT, 0.5, true, 0, false, "~:0.5"},
+		{CMP_GT, 0, false, 10, true, "10:"},
+		{CMP_GT, 80, true, 10, true, "10:80"},
+		{CMP_GE, 80, true, 10, true, "10:80"},
+		{CMP_LT, 5, true, 10, true, "10:"},
+		{CMP_LT, 20, true, 10, true, "20:"},
+	}
+	for _, tt := range tests {
+		if got := perfRange(tt.cond, tt.t, tt.hasT, tt.low, tt.hasLow); got != tt.want {
+			t.Errorf("perfRange(%s, %v, %v, %v, %v) = %q, want %q", tt.cond, tt.t, tt.hasT, tt.low, tt.hasLow, got, tt.want)
+		}
+	}
+}
+
+func TestThresholdEvaluatorSummary(t *testing.T) {
+	// only the thresholds given are described
+	tests := []struct {
+		te   *ThresholdEvaluator
+		ms   Metrics
+		want string
+	}{
+		{&ThresholdEvaluator{CCond: CMP_GT, HasLowCrit: true, LowCrit: 20, CritCnt: 1, Aggregate: AGG_AVG},
+			values(50, 10), "1 metrics are below the low critical threshold of 20.00"},
+		{&ThresholdEvaluator{CCond: CMP_GT, Crit: 90, HasCrit: true, HasLowCrit: true, LowCrit: 20, CritCnt: 1, Aggregate: AGG_AVG},
+			values(50, 10), "1 metrics are above the critical threshold of 90.00 or below 20.00"},
+		{&ThresholdEvaluator{WCond: CMP_GT, HasLowWarn: true, LowWarn: 20, WarnCnt: 1, Aggregate: AGG_AVG},
+			values(50, 10), "1 metrics are below the low warning threshold of 20.00"},
+		{&ThresholdEvaluator{WCond: CMP_LT, Warn: 30, HasWarn: true, WarnCnt: 1, Aggregate: AGG_AVG},
+			values(50, 10), "1 metrics are below the warning threshold of 30.00"},
+		{&ThresholdEvaluator{CCond: CMP_GT, HasLowCrit: true, LowCrit: 20, CritCnt: 1, Aggregate: AGG_AVG, Across: 50},
+			values(5, 10, 50), "p50 of 3 metrics at 10.00, below the low critical threshold of 20.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.te.Evaluate(tt.ms).Summary; got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	URL_EVTMPL string = "/events/get_data?tags=%s&from=-%s" // events path template
+)
+
+// Event is a single entry from the Graphite events API
+type Event struct {
+	ID   int         `json:"id"`
+	When float64     `json:"when"`
+	What string      `json:"what"`
+	Data string      `json:"data"`
+	Tags interface{} `json:"tags"` // older Graphite versions give a space separated string, newer a list
+}
+
+type Events []Event
+
+type EventsResponse struct {
+	ES  Events
+	RT  float64
+	Err error
+}
+
+// TagString() returns the tags of an event as a space separated string, regardless of format
+func (e Event) TagString() string {
+	switch tags := e.Tags.(type) {
+	case string:
+		return tags
+	case []interface{}:
+		strs := make([]string, 0, len(tags))
+		for i := range tags {
+			strs = append(strs, fmt.Sprint(tags[i]))
+		}
+		return strings.Join(strs, " ")
+	default:
+		return ""
+	}
+}
+
+// Dump() prettyprints a slice of events
+func (es Events) Dump(w io.Writer) {
+	for i := range es {
+		ts := time.Unix(int64(es[i].When), 0)
+		fmt.Fprintf(w, "%s  %s  [%s]\n", ts.Format(G_DATEFORMAT), es[i].What, es[i].TagString())
+	}
+}
+
+// get_events() fetches events from Graphite and decodes them from JSON
+// Designed to run in a separate goroutine, just like parse()
+func get_events(ctx context.Context, url string, chRes chan EventsResponse) {
+	er := EventsResponse{}
+	t_start := time.Now()
+	resp, err := geturl(ctx, url)
+	er.RT = time.Duration(time.Now().Sub(t_start)).Seconds()
+
+	if err != nil {
+		er.Err = err
+		chRes <- er
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := respError(resp); err != nil {
+		er.Err = err
+		chRes <- er
+		return
+	}
+
+	er.Err = json.NewDecoder(resp.Body).Decode(&er.ES)
+	chRes <- er
+}
+
+// run_events() checks the number of events with given tags within the time period
+func run_events(c *cli.Context) {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	tags := c.String("tags")
+	period := c.String("timeperiod")
+	condition := validCondition(c.String("if"))
+	warn := c.Float64("warning")
+	crit := c.Float64("critical")
+	haswarn := c.IsSet("warning") || c.IsSet("w")
+	hascrit := c.IsSet("critical") || c.IsSet("c")
+
+	if err := unsupported("events"); err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	if tags == "" {
+		fmt.Printf("%s: No tags given\n", S_UNKNOWN)
+		exit(E_UNKNOWN)
+	}
+	if err := validateThresholds(haswarn, hascrit, false, false, condition, condition,
+		warn, crit, 0, 0); err != nil {
+		fmt.Printf("%s: Invalid thresholds: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	url := base + fmt.Sprintf(URL_EVTMPL, url.QueryEscape(tags), period)
+	log.Debugf("URL: %s\n", url)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	chRes := make(chan EventsResponse, 1) // buffered, so a late response doesn't block after a timeout
+
+	go get_events(ctx, url, chRes)
+
+	select {
+	case res := <-chRes:
+		if res.Err != nil {
+			fmt.Printf("%s: Error fetching events: %q", S_CRITICAL, res.Err)
+			exit(E_CRITICAL)
+		}
+
+		n := len(res.ES)
+		var s_warn, s_crit string
+		if haswarn {
+			s_warn = fmt.Sprintf("%f", warn)
+		}
+		if hascrit {
+			s_crit = fmt.Sprintf("%f", crit)
+		}
+		perf := fmt.Sprintf("|events=%d;%s;%s;0; response_time=%fs;%f;%f;",
+			n, s_warn, s_crit, res.RT, tmout/2, tmout)
+
+		var buf bytes.Buffer
+		if n > 0 {
+			fmt.Fprintf(&buf, "===> Events:\n")
+			res.ES.Dump(&buf)
+			fmt.Fprintf(&buf, "\n")
+		}
+
+		msg_tmpl := "%s: %d events tagged %q within %s, %s the %s threshold of %.0f %s\n\n%s"
+		if hascrit && checkIf(condition, float64(n), crit) {
+			fmt.Printf(msg_tmpl, S_CRITICAL, n, tags, period, dirWord(condition),
+				strings.ToLower(S_CRITICAL), crit, perf, buf.String())
+			exit(E_CRITICAL)
+		}
+		if haswarn && checkIf(condition, float64(n), warn) {
+			fmt.Printf(msg_tmpl, S_WARNING, n, tags, period, dirWord(condition),
+				strings.ToLower(S_WARNING), warn, perf, buf.String())
+			exit(E_WARNING)
+		}
+		fmt.Printf("%s: %d events tagged %q within %s %s\n\n%s", S_OK, n, tags, period, perf, buf.String())
+		exit(E_OK)
+	case <-ctx.Done():
+		fmt.Printf("%s: Timed out after %d seconds", S_CRITICAL, int(tmout))
+		exit(E_CRITICAL)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	URL_EXTMPL string = "/metrics/expand?query=%s&leavesOnly=%d" // expand path template
+)
+
+type ExpandResponse struct {
+	Results []string `json:"results"`
+}
+
+// expand() asks Graphite which series a query resolves to
+func expand(ctx context.Context, url string) ([]string, error) {
+	resp, err := geturl(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := respError(resp); err != nil {
+		return nil, err
+	}
+
+	er := ExpandResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+		return nil, err
+	}
+	sort.Strings(er.Results)
+	return er.Results, nil
+}
+
+// run_expand() lists the series a metric path matches, to verify what a check would cover
+func run_expand(c *cli.Context) error {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	mpath := c.String("metricpath")
+	if mpath == "" {
+		mpath = c.GlobalString("metricpath")
+	}
+	leaves := 1
+	if c.Bool("all") {
+		leaves = 0
+	}
+
+	if mpath == "" {
+		return cli.NewExitError("No metric path given", E_UNKNOWN)
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	url := base + fmt.Sprintf(URL_EXTMPL, url.QueryEscape(mpath), leaves)
+	log.Debugf("URL: %s\n", url)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	paths, err := expand(ctx, url)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to expand %q: %v", mpath, err), E_UNKNOWN)
+	}
+	for i := range paths {
+		fmt.Println(paths[i])
+	}
+	fmt.Fprintf(os.Stderr, "%q matches %d series\n", mpath, len(paths))
+	if len(paths) == 0 {
+		return cli.NewExitError("", E_WARNING)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	EV_EXPECT string = "expect"
+)
+
+func init() {
+	RegisterEvaluator(EV_EXPECT, NewExpectEvaluator)
+}
+
+// ExpectEvaluator requires the latest value of each metric to be a given constant, give or take a
+// tolerance, for gauges that report configuration, like replica counts or feature flags.
+// Any metric off is CRITICAL.
+type ExpectEvaluator struct {
+	Expect    float64
+	Tolerance float64
+	Top       int // how many metrics to keep in each state, 0 for all
+}
+
+// NewExpectEvaluator() creates an ExpectEvaluator from --expect and --tolerance
+func NewExpectEvaluator(c *cli.Context) (Evaluator, error) {
+	if !c.IsSet("expect") {
+		return nil, fmt.Errorf("The %s evaluator needs --expect", EV_EXPECT)
+	}
+	ee := &ExpectEvaluator{
+		Expect:    c.Float64("expect"),
+		Tolerance: c.Float64("tolerance"),
+		Top:       c.Int("top"),
+	}
+	if ee.Tolerance < 0 {
+		return nil, fmt.Errorf("Invalid --tolerance %g, should be 0 or more", ee.Tolerance)
+	}
+	return ee, nil
+}
+
+// off() tells how far a value is from the expected one
+func (ee *ExpectEvaluator) off(val float64) float64 {
+	return math.Abs(val - ee.Expect)
+}
+
+// top() sorts metrics by how far they're off, furthest first, and returns the first Top of them
+func (ee *ExpectEvaluator) top(ms Metrics) Metrics {
+	sort.Slice(ms, func(i, j int) bool {
+		oi, oj := ee.off(ms[i].Value), ee.off(ms[j].Value)
+		return oi > oj || (oi == oj && ms[i].Path < ms[j].Path)
+	})
+	if ee.Top > 0 && len(ms) > ee.Top {
+		return ms[:ee.Top]
+	}
+	return ms
+}
+
+// Evaluate() implements Evaluator
+func (ee *ExpectEvaluator) Evaluate(ms Metrics) *Evaluation {
+	o, w, c := ms.FilterOffenders(Never, func(val float64) bool { return ee.off(val) > ee.Tolerance })
+	log.Debugf("#c: %d, #o: %d\n", len(c), len(o))
+
+	num := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	ev := &Evaluation{Crit: num(ee.Expect-ee.Tolerance) + ":" + num(ee.Expect+ee.Tolerance)}
+	var tnote string // "tolerance note"
+	if ee.Tolerance > 0 {
+		tnote = fmt.Sprintf(" (+/- %g)", ee.Tolerance)
+	}
+
+	// helper func
+	perf := func(bucket Metrics) []PerfData {
+		return []PerfData{
+			{Label: "value", Value: bucket.Avg(), Unknown: len(bucket) == 0, Crit: ev.Crit},
+			{Label: "num_matching_metrics", Value: float64(len(bucket)), Count: true},
+		}
+	}
+
+	switch {
+	case len(ms) == 0:
+		ev.Status = E_UNKNOWN
+		ev.Summary = "No values to evaluate"
+		ev.Perf = perf(Metrics{})
+	case len(c) > 0:
+		worst := ee.top(c)[0]
+		ev.Status = E_CRITICAL
+		ev.Summary = fmt.Sprintf("%d metrics differ from the expected value of %g%s, e.g. %s at %g",
+			len(c), ee.Expect, tnote, worst.Path, worst.Value)
+		ev.Perf = perf(c)
+	default:
+		ev.Status = E_OK
+		ev.Summary = fmt.Sprintf("%d metrics at the expected value of %g%s", len(o), ee.Expect, tnote)
+		ev.Perf = perf(o)
+	}
+
+	ev.C = ee.top(c)
+	ev.W = w
+	ev.O = ee.top(o)
+	return ev
+}
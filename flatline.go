@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+)
+
+// Flatlined() returns the metrics whose value hasn't changed at all during the last d of their series,
+// which for sensors and heartbeats usually means whatever sends them is stuck, even if values keep coming.
+// Series not going back d can't tell, and are left out.
+func Flatlined(ms Metrics, d time.Duration) Metrics {
+	flat := Metrics{}
+	for _, m := range ms {
+		if len(m.Points) < 2 {
+			continue
+		}
+		last := m.Points[len(m.Points)-1]
+		cutoff := last.TS.Add(-d)
+		// the first point to look at is the latest one at or before the cutoff, so the whole of d is covered
+		first := -1
+		for i, p := range m.Points {
+			if p.TS.After(cutoff) {
+				break
+			}
+			first = i
+		}
+		if first < 0 {
+			continue
+		}
+		changed := false
+		for _, p := range m.Points[first:] {
+			if p.Value != last.Value {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			flat = append(flat, m)
+		}
+	}
+	return flat
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlatlined(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Metric
+		d    time.Duration
+		flat bool
+	}{
+		{"unchanged", series("a", 5, 5, 5, 5, 5, 5, 5), 5 * time.Minute, true},
+		{"changed within", series("a", 5, 5, 5, 5, 6, 5, 5), 5 * time.Minute, false},
+		{"changed before", series("a", 1, 2, 5, 5, 5, 5, 5), 4 * time.Minute, true},
+		{"changed right at the start", series("a", 1, 2, 5, 5, 5, 5, 5), 5 * time.Minute, false},
+		{"not going back far enough", series("a", 5, 5, 5), 5 * time.Minute, false},
+		{"one datapoint", series("a", 5), time.Minute, false},
+		{"no datapoints", series("a"), time.Minute, false},
+	}
+	for _, tt := range tests {
+		got := Flatlined(Metrics{tt.m}, tt.d)
+		if (len(got) == 1) != tt.flat {
+			t.Errorf("%s: got %d flatlined, want flatlined: %v", tt.name, len(got), tt.flat)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"time"
+)
+
+const (
+	EV_FORECAST string = "forecast"
+)
+
+func init() {
+	RegisterEvaluator(EV_FORECAST, NewForecastEvaluator)
+}
+
+// ForecastEvaluator fits a straight line to each series, and judges metrics by the thresholds of the
+// ThresholdEvaluator as they are now, or as the line says they will be at the end of the horizon,
+// whichever is worse. Like "the disk will be full in 4h".
+type ForecastEvaluator struct {
+	*ThresholdEvaluator
+	Horizon time.Duration
+}
+
+// NewForecastEvaluator() creates a ForecastEvaluator from the threshold flags and --forecast-horizon
+func NewForecastEvaluator(c *cli.Context) (Evaluator, error) {
+	spec := c.String("forecast-horizon")
+	if spec == "" {
+		return nil, fmt.Errorf("The %s evaluator needs --forecast-horizon", EV_FORECAST)
+	}
+	horizon, err := graphiteDuration(spec)
+	if err != nil || horizon <= 0 {
+		return nil, fmt.Errorf("Invalid --forecast-horizon %q, should be a time period like 4h", spec)
+	}
+	te, err := NewThresholdEvaluator(c)
+	if err != nil {
+		return nil, err
+	}
+	return &ForecastEvaluator{ThresholdEvaluator: te.(*ThresholdEvaluator), Horizon: horizon}, nil
+}
+
+// linearFit() returns the line best fitting the series of m by least squares, as the value at its latest
+// datapoint and the change per second. ok is false with too few datapoints to tell.
+func linearFit(m *Metric) (at, slope float64, ok bool) {
+	n := float64(len(m.Points))
+	if n < 2 {
+		return 0, 0, false
+	}
+	last := m.Points[len(m.Points)-1].TS
+	var sx, sy, sxx, sxy float64
+	for _, p := range m.Points {
+		x := p.TS.Sub(last).Seconds() // 0 at the latest datapoint
+		sx += x
+		sy += p.Value
+		sxx += x * x
+		sxy += x * p.Value
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0, 0, false
+	}
+	slope = (n*sxy - sx*sy) / d
+	return (sy - slope*sx) / n, slope, true
+}
+
+// Evaluate() implements Evaluator
+func (fe *ForecastEvaluator) Evaluate(ms Metrics) *Evaluation {
+	wpred, cpred := fe.Predicates()
+	state := func(val float64) int {
+		switch {
+		case cpred(val):
+			return E_CRITICAL
+		case wpred(val):
+			return E_WARNING
+		}
+		return E_OK
+	}
+
+	// judge copies, with the forecast value where it's worse than the current one
+	judged := make(Metrics, 0, len(ms))
+	var soonest time.Duration
+	var soonestM *Metric
+	for _, m := range ms {
+		jm := *m
+		at, slope, ok := linearFit(m)
+		if ok {
+			ahead := at + slope*fe.Horizon.Seconds()
+			if s := state(ahead); s > state(m.Value) {
+				jm.Value = ahead
+				// find when the line gets into that state, to tell how soon it's coming
+				lo, hi := 0.0, fe.Horizon.Seconds()
+				for i := 0; i < 32; i++ {
+					mid := (lo + hi) / 2
+					if state(at+slope*mid) >= s {
+						hi = mid
+					} else {
+						lo = mid
+					}
+				}
+				eta := time.Duration(hi * float64(time.Second))
+				if soonestM == nil || eta < soonest {
+					soonest, soonestM = eta, m
+				}
+			}
+		}
+		judged = append(judged, &jm)
+	}
+
+	ev := fe.ThresholdEvaluator.Evaluate(judged)
+	if soonestM != nil {
+		ev.Summary += fmt.Sprintf(" (forecast %s ahead, e.g. %s in %s)", fe.Horizon, soonestM.Path, soonest.Round(time.Minute))
+	}
+	return ev
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	OUT_NAGIOS  string = "nagios"
+	OUT_ICINGA2 string = "icinga2"
+	OUT_CHECKMK string = "checkmk"
+	OUT_JSON    string = "json"
+	DEF_CHKNAME string = "check_graphite"
+)
+
+// PerfData is a single performance data item
+type PerfData struct {
+	Label   string
+	Value   float64
+	UOM     string // unit of measurement
+	Warn    string // thresholds and limits are strings, as they may be ranges or left out
+	Crit    string
+	Min     string
+	Max     string
+	Count   bool // integer value, like a number of metrics
+	Unknown bool // the value couldn't be determined, shown as U
+}
+
+// Result is the outcome of a check, for a Formatter to present
+type Result struct {
+	Name     string // name of the check, for formats that carry it
+	Host     string // host the check is for, if known
+	Status   int    // state of the check
+	ExitCode int    // what to exit with, which may differ from Status for UNKNOWN
+	Summary  string // the status line, without status word and perfdata
+	Long     string // long output
+	Perf     []PerfData
+	PerfLong []PerfData // perfdata for after the long output, like that of each metric
+	O, W, C  Metrics    // metrics by state
+	New      Metrics    // metrics not seen before
+	Warn     string     // thresholds in perfdata form, for formats showing each metric on its own
+	Crit     string
+	RT       float64 // response time
+	Failure  string  // why the check couldn't be evaluated, like FAIL_TIMEOUT, empty when it could
+	Labels   []Label // given with --label, for downstream routing
+}
+
+// Formatter presents a Result in some output format
+type Formatter interface {
+	Format(r *Result) string
+}
+
+var formatters = make(map[string]Formatter)
+
+// RegisterFormatter() makes an output format available by name, for --output
+func RegisterFormatter(name string, f Formatter) {
+	formatters[name] = f
+}
+
+// FormatterNames() returns the names of all registered output formats, sorted
+func FormatterNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetFormatter() returns the named output format
+func GetFormatter(name string) (Formatter, error) {
+	f, ok := formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q (options: %s)", name, strings.Join(FormatterNames(), ", "))
+	}
+	return f, nil
+}
+
+func init() {
+	RegisterFormatter(OUT_NAGIOS, NagiosFormatter{})
+	RegisterFormatter(OUT_ICINGA2, Icinga2Formatter{})
+	RegisterFormatter(OUT_CHECKMK, CheckMKFormatter{})
+	RegisterFormatter(OUT_JSON, JSONFormatter{})
+}
+
+// String() formats a perfdata item as per the Nagios plugin guidelines, leaving out trailing empty fields
+func (pd PerfData) String() string {
+	var val string
+	if pd.Unknown {
+		val = "U"
+	} else if pd.Count {
+		val = fmt.Sprintf("%d", int64(pd.Value))
+	} else {
+		val = fmt.Sprintf("%f", pd.Value)
+	}
+	fields := []string{val + pd.UOM, pd.Warn, pd.Crit, pd.Min, pd.Max}
+	for len(fields) > 1 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return perfLabel(pd.Label) + "=" + strings.Join(fields, ";")
+}
+
+// relabel() renames perfdata items by the names map, and prefixes all labels
+func relabel(pds []PerfData, names map[string]string, prefix string) {
+	for i := range pds {
+		if name, ok := names[pds[i].Label]; ok {
+			pds[i].Label = name
+		}
+		pds[i].Label = prefix + pds[i].Label
+	}
+}
+
+// perfString() joins perfdata items with the given separator
+func perfString(pds []PerfData, sep string) string {
+	strs := make([]string, 0, len(pds))
+	for _, pd := range pds {
+		strs = append(strs, pd.String())
+	}
+	return strings.Join(strs, sep)
+}
+
+// Metrics() returns all metrics in the result, worst state first
+func (r *Result) Metrics() Metrics {
+	ms := make(Metrics, 0, len(r.C)+len(r.W)+len(r.O))
+	return append(append(append(ms, r.C...), r.W...), r.O...)
+}
+
+// NagiosFormatter gives the classic plugin output: status line with perfdata, then long output
+type NagiosFormatter struct{}
+
+func (NagiosFormatter) Format(r *Result) string {
+	var perf string
+	if len(r.Perf) > 0 {
+		perf = " |" + perfString(r.Perf, " ")
+	}
+	// perfdata can go on after the long output, following a |, one item per line
+	var perflong string
+	if len(r.PerfLong) > 0 {
+		perflong = "| " + perfString(r.PerfLong, "\n") + "\n"
+	}
+	if r.Long == "" {
+		if perflong != "" {
+			perflong = "\n" + perflong
+		}
+		return fmt.Sprintf("%s: %s%s\n%s", statusText(r.Status), r.summary(), perf, perflong)
+	}
+	return fmt.Sprintf("%s: %s%s\n\n%s%s", statusText(r.Status), r.summary(), perf, r.Long, perflong)
+}
+
+// summary() returns the status line, with the labels appended, if any
+func (r *Result) summary() string {
+	if len(r.Labels) == 0 {
+		return r.Summary
+	}
+	return r.Summary + " " + labelString(r.Labels)
+}
+
+// allPerf() returns all perfdata of the result, for formats without room for some after the long output
+func (r *Result) allPerf() []PerfData {
+	return append(append([]PerfData{}, r.Perf...), r.PerfLong...)
+}
+
+// Icinga2Formatter gives a body for the process-check-result action of the Icinga2 API,
+// for submitting the result as a passive check
+type Icinga2Formatter struct{}
+
+func (Icinga2Formatter) Format(r *Result) string {
+	perf := make([]string, 0, len(r.Perf)+len(r.PerfLong))
+	for _, pd := range r.allPerf() {
+		perf = append(perf, pd.String())
+	}
+	body := map[string]interface{}{
+		"exit_status":      r.ExitCode,
+		"plugin_output":    strings.TrimRight(fmt.Sprintf("%s: %s\n%s", statusText(r.Status), r.summary(), r.Long), "\n"),
+		"performance_data": perf,
+		"check_source":     r.Name,
+	}
+	data, _ := json.Marshal(body)
+	return string(data) + "\n"
+}
+
+// CheckMKFormatter gives the output of a Check_MK local check
+type CheckMKFormatter struct{}
+
+// checkmkLevel() turns a threshold range into the plain number a local check takes, which Check_MK
+// alerts on at or above. Ranges alerting on anything else, like below a value, can't be given, so are left out.
+func checkmkLevel(rng string) string {
+	var num string
+	switch {
+	case rng == "":
+		return ""
+	case !strings.ContainsAny(rng, "~@:"):
+		num = rng // already one, as for the response time
+	case strings.HasPrefix(rng, "~:"):
+		num = strings.TrimPrefix(rng, "~:")
+	case strings.HasPrefix(rng, "@") && strings.HasSuffix(rng, ":") && !strings.HasPrefix(rng, "@~"):
+		num = strings.TrimSuffix(strings.TrimPrefix(rng, "@"), ":")
+	default:
+		return ""
+	}
+	if _, err := strconv.ParseFloat(num, 64); err != nil {
+		return ""
+	}
+	return num
+}
+
+func (CheckMKFormatter) Format(r *Result) string {
+	perf := "-"
+	if all := r.allPerf(); len(all) > 0 {
+		strs := make([]string, 0, len(all))
+		for _, pd := range all {
+			pd.UOM = "" // not allowed in local checks
+			pd.Warn, pd.Crit = checkmkLevel(pd.Warn), checkmkLevel(pd.Crit)
+			strs = append(strs, pd.String())
+		}
+		perf = strings.Join(strs, "|")
+	}
+	name := r.Name
+	if strings.ContainsAny(name, " \t") {
+		name = "\"" + name + "\""
+	}
+	// long output goes in the details, as escaped newlines
+	detail := r.summary()
+	if long := strings.TrimRight(r.Long, "\n"); long != "" {
+		detail += "\\n" + strings.Replace(long, "\n", "\\n", -1)
+	}
+	return fmt.Sprintf("%d %s %s %s\n", r.ExitCode, name, perf, detail)
+}
+
+// JSONFormatter gives the whole result as JSON, for further processing
+type JSONFormatter struct{}
+
+type jsonPerf struct {
+	Label string  `json:"label"`
+	Value float64 `json:"value"`
+	UOM   string  `json:"uom,omitempty"`
+	Warn  string  `json:"warn,omitempty"`
+	Crit  string  `json:"crit,omitempty"`
+	Min   string  `json:"min,omitempty"`
+	Max   string  `json:"max,omitempty"`
+}
+
+type jsonMetric struct {
+	Path      string  `json:"path"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+	State     string  `json:"state"`
+	New       bool    `json:"new,omitempty"`
+}
+
+func (JSONFormatter) Format(r *Result) string {
+	out := struct {
+		Name         string            `json:"name"`
+		Status       string            `json:"status"`
+		ExitCode     int               `json:"exit_code"`
+		Summary      string            `json:"summary"`
+		LongOutput   string            `json:"long_output,omitempty"`
+		ResponseTime float64           `json:"response_time"`
+		Perfdata     []jsonPerf        `json:"perfdata"`
+		Metrics      []jsonMetric      `json:"metrics"`
+		Labels       map[string]string `json:"labels,omitempty"`
+	}{
+		Name:         r.Name,
+		Status:       statusText(r.Status),
+		ExitCode:     r.ExitCode,
+		Summary:      r.Summary,
+		LongOutput:   r.Long,
+		ResponseTime: r.RT,
+		Perfdata:     []jsonPerf{},
+		Metrics:      []jsonMetric{},
+	}
+	if len(r.Labels) > 0 {
+		out.Labels = make(map[string]string, len(r.Labels))
+		for _, l := range r.Labels {
+			out.Labels[l.Key] = l.Value
+		}
+	}
+	for _, pd := range r.allPerf() {
+		out.Perfdata = append(out.Perfdata, jsonPerf{pd.Label, pd.Value, pd.UOM, pd.Warn, pd.Crit, pd.Min, pd.Max})
+	}
+	isnew := make(map[string]bool)
+	for _, m := range r.New {
+		isnew[m.Path] = true
+	}
+	for _, b := range buckets(r.O, r.W, r.C) {
+		for _, m := range b.MS {
+			out.Metrics = append(out.Metrics, jsonMetric{m.Path, m.Value, m.TS.Unix(), statusText(b.ECode), isnew[m.Path]})
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fmt.Sprintf("{\"status\":%q,\"summary\":%q}\n", S_UNKNOWN, err.Error())
+	}
+	return buf.String()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckmkLevel(t *testing.T) {
+	tests := []struct {
+		rng  string
+		want string
+	}{
+		{"", ""},
+		{"~:80", "80"},
+		{"@80:", "80"},
+		{"5.000000", "5.000000"},
+		{"80:", ""},
+		{"@~:80", ""},
+		{"10:80", ""},
+	}
+	for _, tt := range tests {
+		if got := checkmkLevel(tt.rng); got != tt.want {
+			t.Errorf("checkmkLevel(%q) = %q, want %q", tt.rng, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMKFormatter(t *testing.T) {
+	r := &Result{Name: "cpu", Status: E_WARNING, ExitCode: E_WARNING, Summary: "high",
+		Perf: []PerfData{{Label: "value", Value: 85, Warn: "~:80", Crit: "~:90", Min: "0", Max: "100"}}}
+	want := "1 cpu value=85.000000;80;90;0;100 high\n"
+	if got := (CheckMKFormatter{}).Format(r); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+)
+
+// longestGap() returns the most datapoints missing in a row within the series of m, given the step
+// between points. Null values count as missing, as they never make it into the series.
+func longestGap(m *Metric, step time.Duration) int {
+	longest := 0
+	for i := 1; i < len(m.Points); i++ {
+		d := m.Points[i].TS.Sub(m.Points[i-1].TS)
+		// rounded, as timestamps may jitter a bit between points
+		if n := int((d+step/2)/step) - 1; n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+// Gaps() returns the metrics missing more than max datapoints in a row within their series, catching
+// collection failing now and then, which the latest value alone doesn't tell. The metric with the
+// longest gap, and its length in points, is returned as well.
+func Gaps(ms Metrics, step time.Duration, max int) (gappy Metrics, worst *Metric, worstN int) {
+	gappy = Metrics{}
+	for _, m := range ms {
+		n := longestGap(m, step)
+		if n <= max {
+			continue
+		}
+		gappy = append(gappy, m)
+		if n > worstN {
+			worst, worstN = m, n
+		}
+	}
+	return gappy, worst, worstN
+}
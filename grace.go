@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LastGood is the last evaluation of a check that could be made, kept in the state for --grace
+type LastGood struct {
+	Time    time.Time  `json:"time"`
+	Status  int        `json:"status"`
+	Summary string     `json:"summary"`
+	Long    string     `json:"long,omitempty"`
+	Perf    []PerfData `json:"perf,omitempty"`
+}
+
+// LoadLastGood() reads the last good evaluation from the state, nil if there's none
+func LoadLastGood(st *State) (*LastGood, error) {
+	lg := &LastGood{}
+	found, err := st.Get("last_good", lg)
+	if err != nil || !found {
+		return nil, err
+	}
+	return lg, nil
+}
+
+// Save() puts the evaluation in the state
+func (lg *LastGood) Save(st *State) error {
+	return st.Put("last_good", lg)
+}
+
+// Stale() returns the last good evaluation in place of a failed run, if it's no older than grace,
+// marked as stale, with why the run failed, and exiting as exitcode says for its status. nil if it's too old.
+func (lg *LastGood) Stale(failed *Result, grace time.Duration, exitcode func(int) int) *Result {
+	age := time.Since(lg.Time)
+	if age > grace {
+		return nil
+	}
+	return &Result{
+		Name:     failed.Name,
+		Status:   lg.Status,
+		ExitCode: exitcode(lg.Status),
+		Summary: fmt.Sprintf("%s (STALE, from %s ago, within --grace %s: %s)", lg.Summary,
+			age.Round(time.Second), grace, failed.Summary),
+		Long:    lg.Long,
+		Perf:    lg.Perf,
+		RT:      failed.RT,
+		Failure: failed.Failure,
+		Labels:  failed.Labels,
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BE_GRAPHITE      string = "graphite"
+	BE_GRAPHITE_JSON string = "graphite-json"
+	URL_UNTILTMPL    string = "&until=-%s" // end of the window, when not now, for graph links
+)
+
+// graphiteDuration() parses a Graphite style relative time like 5min. Months and years are taken
+// to be 30 and 365 days, like Graphite does.
+func graphiteDuration(period string) (time.Duration, error) {
+	sm := periodRE.FindStringSubmatch(period)
+	if sm == nil {
+		return 0, fmt.Errorf("invalid time period %q, should be like 5min", period)
+	}
+	n, err := strconv.Atoi(sm[1])
+	if err != nil {
+		return 0, err
+	}
+	var unit time.Duration
+	switch {
+	case strings.HasPrefix(sm[2], "s"):
+		unit = time.Second
+	case strings.HasPrefix(sm[2], "min"):
+		unit = time.Minute
+	case strings.HasPrefix(sm[2], "h"):
+		unit = time.Hour
+	case strings.HasPrefix(sm[2], "d"):
+		unit = 24 * time.Hour
+	case strings.HasPrefix(sm[2], "w"):
+		unit = 7 * 24 * time.Hour
+	case strings.HasPrefix(sm[2], "mon"):
+		unit = 30 * 24 * time.Hour
+	case strings.HasPrefix(sm[2], "y"):
+		unit = 365 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("unknown time unit %q in %q", sm[2], period)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// GraphiteCSV gets metrics from the render API in CSV format
+type GraphiteCSV struct {
+	Base string
+}
+
+// GraphiteJSON gets metrics from the render API in JSON format, which is the only format
+// some implementations have
+type GraphiteJSON struct {
+	Base string
+}
+
+// JSONSeries is one series in the JSON format of the render API
+type JSONSeries struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"` // [value, timestamp], where value is null for missing data
+}
+
+func init() {
+	RegisterDatasource(BE_GRAPHITE, func(base string) Datasource {
+		if conn.Dialect == DL_VM {
+			return &GraphiteJSON{Base: base}
+		}
+		return &GraphiteCSV{Base: base}
+	})
+	RegisterDatasource(BE_GRAPHITE_JSON, func(base string) Datasource {
+		return &GraphiteJSON{Base: base}
+	})
+}
+
+// renderURL() returns the URL to the render API for a target in a window, in the given format
+func renderURL(base, target, format string, window Window) string {
+	q := url.Values{}
+	q.Set("target", target)
+	q.Set("format", format)
+	q.Set("from", "-"+window.From())
+	if until := window.Until(); until != "" {
+		q.Set("until", "-"+until)
+	}
+	return base + URL_RENDER + "?" + q.Encode()
+}
+
+// Fetch() reads the CSV response and converts it to Metrics
+func (g *GraphiteCSV) Fetch(ctx context.Context, target string, window Window) (Metrics, error) {
+	u := renderURL(g.Base, target, "csv", window)
+	log.Debugf("URL: %s", u)
+	body, err := getbody(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	rdr := csv.NewReader(body)
+	ss := make(seriesSet)
+
+	for row := 1; ; row++ {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("parse(): %#v", rec)
+		if len(rec) == 3 && rec[0] != "" {
+			ss.Seen(rec[0]) // even if the value is empty, i.e. null
+		}
+		if len(rec) == 3 && rec[0] != "" && rec[2] == "" {
+			continue // null, nothing wrong with that
+		}
+		m, err := NewMetricFromCSV(rec)
+		if err != nil {
+			if err := malformed(ctx, target, fmt.Sprintf("%d %q", row, strings.Join(rec, ",")), err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ss.Add(m.Path, m.TS, m.Value)
+	}
+	noteNull(ctx, ss.Null())
+	return ss.Metrics(), nil
+}
+
+// Fetch() reads the JSON response and converts it to Metrics
+func (g *GraphiteJSON) Fetch(ctx context.Context, target string, window Window) (Metrics, error) {
+	u := renderURL(g.Base, target, "json", window)
+	log.Debugf("URL: %s", u)
+	body, err := getbody(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var series []JSONSeries
+	if err := json.NewDecoder(body).Decode(&series); err != nil {
+		return nil, err
+	}
+
+	ss := make(seriesSet)
+	for _, js := range series {
+		ss.Seen(js.Target)
+		for _, dp := range js.Datapoints {
+			if dp[0] == nil || dp[1] == nil {
+				continue
+			}
+			ss.Add(js.Target, time.Unix(int64(*dp[1]), 0), *dp[0])
+		}
+	}
+	noteNull(ctx, ss.Null())
+	return ss.Metrics(), nil
+}
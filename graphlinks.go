@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"time"
+)
+
+const (
+	URL_RENDERTMPL   string = "/render?target=%s&from=-%s&width=800&height=400" // graph as PNG
+	URL_COMPOSERTMPL string = "/composer/?target=%s&from=-%s"                   // graph in the Graphite UI
+)
+
+// GraphLinker makes links to graphs of metrics in Graphite, for the same time window as the check
+type GraphLinker struct {
+	Base   string
+	Window Window
+}
+
+// until() returns the end of the window as a URL parameter, if not now
+func (gl *GraphLinker) until() string {
+	if until := gl.Window.Until(); until != "" {
+		return fmt.Sprintf(URL_UNTILTMPL, until)
+	}
+	return ""
+}
+
+// Render() returns the URL to a PNG graph of the metric
+func (gl *GraphLinker) Render(path string) string {
+	return gl.Base + fmt.Sprintf(URL_RENDERTMPL, url.QueryEscape(path), gl.Window.From()) + gl.until()
+}
+
+// Composer() returns the URL to the metric in the Graphite composer, to look closer at it
+func (gl *GraphLinker) Composer(path string) string {
+	return gl.Base + fmt.Sprintf(URL_COMPOSERTMPL, url.QueryEscape(path), gl.Window.From()) + gl.until()
+}
+
+// html_section() writes a titled table of metrics as HTML, each linked to its graph.
+// If maxlines is above 0, only that many metrics are listed, with a note on how many were left out.
+// With points, the number of datapoints of each metric and the age of the newest are shown as well.
+// Each of cols adds a cell with what it has for the path of each metric, like add_column() does for text.
+func html_section(buf *bytes.Buffer, title string, ms Metrics, gl *GraphLinker, maxlines int, points bool, cols ...map[string]string) {
+	if len(ms) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "<b>%s</b><br/>\n<table>\n", html.EscapeString(title))
+	shown := ms
+	if maxlines > 0 && len(ms) > maxlines {
+		shown = ms[:maxlines]
+	}
+	for _, m := range shown {
+		fmt.Fprintf(buf, "<tr><td><a href=\"%s\" target=\"_blank\">%s</a></td><td align=\"right\">%.4f</td><td>%s</td>",
+			html.EscapeString(gl.Composer(m.Path)), html.EscapeString(m.Path), m.Value, m.TS.Format(G_DATEFORMAT))
+		if points {
+			fmt.Fprintf(buf, "<td>%d points, newest %s ago</td>", len(m.Points), time.Since(m.TS).Round(time.Second))
+		}
+		for _, col := range cols {
+			fmt.Fprintf(buf, "<td>%s</td>", html.EscapeString(col[m.Path]))
+		}
+		fmt.Fprintf(buf, "<td><a href=\"%s\" target=\"_blank\">graph</a></td></tr>\n", html.EscapeString(gl.Render(m.Path)))
+	}
+	fmt.Fprintf(buf, "</table>\n")
+	if len(shown) < len(ms) {
+		fmt.Fprintf(buf, "(%d more metrics not shown, see --max-lines)<br/>\n", len(ms)-len(shown))
+	}
+}
+
+// html_output() is long_output() as HTML, for op5 extinfo pages, with links to the graph of each metric
+func html_output(o, w, c Metrics, gl *GraphLinker, maxlines int, points bool, cols ...map[string]string) string {
+	var buf bytes.Buffer
+	html_section(&buf, "Metrics in state "+S_CRITICAL+":", c, gl, maxlines, points, cols...)
+	html_section(&buf, "Metrics in state "+S_WARNING+":", w, gl, maxlines, points, cols...)
+	html_section(&buf, "Metrics in state "+S_OK+":", o, gl, maxlines, points, cols...)
+	return buf.String()
+}
+
+// graph_links() lists the URL to the graph of each metric, for plain long output
+func graph_links(ms Metrics, gl *GraphLinker, align int) string {
+	if len(ms) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "===> Graphs of metrics in state %s:\n", S_CRITICAL)
+	for _, m := range ms {
+		fmt.Fprintf(&buf, "%-*s %s\n", align, m.Path, gl.Render(m.Path))
+	}
+	fmt.Fprintf(&buf, "\n")
+	return buf.String()
+}
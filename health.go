@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health is what /healthz and /readyz answer, with status 200 when Status is "ok" and 503 otherwise
+type Health struct {
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	Checks      int        `json:"checks"`
+	Overdue     []string   `json:"overdue,omitempty"` // checks that should have finished a run by now
+	Failing     []string   `json:"failing,omitempty"` // checks whose last run got no answer, or couldn't run
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// HealthServer answers health and readiness probes for the scheduler currently running
+type HealthServer struct {
+	mu sync.Mutex
+	s  *Scheduler
+}
+
+// Set() makes s the scheduler to report on, e.g. after a reload
+func (hs *HealthServer) Set(s *Scheduler) {
+	hs.mu.Lock()
+	hs.s = s
+	hs.mu.Unlock()
+}
+
+func (hs *HealthServer) current() *Scheduler {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.s
+}
+
+// Failing() returns the names of the checks whose last run had a Failure
+func (s *Scheduler) Failing() []string {
+	var names []string
+	for _, cc := range s.checks {
+		if atomic.LoadInt32(&cc.failing) != 0 {
+			names = append(names, cc.Name)
+		}
+	}
+	return names
+}
+
+// LastSuccess() returns when a check last got an answer from the backend, zero if never
+func (s *Scheduler) LastSuccess() time.Time {
+	var last int64
+	for _, cc := range s.checks {
+		if t := atomic.LoadInt64(&cc.lastOK); t > last {
+			last = t
+		}
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// staleAfter() returns how old the last success may be before we consider the backend unreachable,
+// which is what it takes for the slowest check to be overdue
+func (s *Scheduler) staleAfter() time.Duration {
+	var max time.Duration
+	for _, cc := range s.checks {
+		tmout := time.Duration(cc.Ctx.Float64("timeout") * float64(time.Second))
+		if d := 2*cc.Interval + tmout; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// health() reports on the scheduler, and on the backend as well when ready is set
+func (hs *HealthServer) health(ready bool) *Health {
+	s := hs.current()
+	if s == nil {
+		return &Health{Status: "starting"}
+	}
+	h := &Health{
+		Status:  "ok",
+		Checks:  len(s.checks),
+		Overdue: s.Overdue(),
+		Failing: s.Failing(),
+	}
+	last := s.LastSuccess()
+	if !last.IsZero() {
+		h.LastSuccess = &last
+	}
+	switch {
+	case len(h.Overdue) > 0:
+		h.Status, h.Reason = "unhealthy", "checks are overdue, the scheduler may be stuck"
+	case !ready:
+	case last.IsZero():
+		h.Status, h.Reason = "not ready", "no check has got an answer from the backend yet"
+	case time.Since(last) > s.staleAfter():
+		h.Status, h.Reason = "not ready", "no check has got an answer from the backend for a while"
+	}
+	return h
+}
+
+// ServeHTTP() answers /healthz for liveness, and /readyz for readiness, which includes the backend
+func (hs *HealthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var h *Health
+	switch r.URL.Path {
+	case "/healthz":
+		h = hs.health(false)
+	case "/readyz":
+		h = hs.health(true)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
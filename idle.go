@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// IdleError is returned when a response stalls for longer than --idle-timeout
+type IdleError struct {
+	Idle time.Duration
+}
+
+func (e *IdleError) Error() string {
+	return fmt.Sprintf("No data received for %s, see --idle-timeout", e.Idle)
+}
+
+// idleReader closes the body it reads when no bytes arrive for a while, which ends a Read
+// blocked on it, with an *IdleError
+type idleReader struct {
+	rc      io.ReadCloser
+	idle    time.Duration
+	timer   *time.Timer
+	expired int32 // accessed atomically
+}
+
+// newIdleReader() starts watching rc
+func newIdleReader(rc io.ReadCloser, idle time.Duration) *idleReader {
+	ir := &idleReader{rc: rc, idle: idle}
+	ir.timer = time.AfterFunc(idle, func() {
+		atomic.StoreInt32(&ir.expired, 1)
+		rc.Close()
+	})
+	return ir
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.rc.Read(p)
+	if n > 0 {
+		ir.timer.Reset(ir.idle)
+	}
+	if err != nil && atomic.LoadInt32(&ir.expired) == 1 {
+		return n, &IdleError{Idle: ir.idle}
+	}
+	return n, err
+}
+
+// Close() stops watching, and closes the body
+func (ir *idleReader) Close() error {
+	ir.timer.Stop()
+	return ir.rc.Close()
+}
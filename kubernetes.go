@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEF_K8S_TOKEN_FILE string = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DEF_K8S_PORT       int    = 80
+)
+
+// KubeService is a Kubernetes service, as given with --k8s-service
+type KubeService struct {
+	Namespace string
+	Name      string
+	Port      int
+}
+
+// parseKubeService() parses a service as NAMESPACE/NAME[:PORT]
+func parseKubeService(spec string) (*KubeService, error) {
+	ks := &KubeService{Port: DEF_K8S_PORT}
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid --k8s-service %q, expected NAMESPACE/NAME[:PORT]", spec)
+	}
+	ks.Namespace, ks.Name = parts[0], parts[1]
+	if i := strings.LastIndex(ks.Name, ":"); i >= 0 {
+		port, err := strconv.Atoi(ks.Name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port in --k8s-service %q: %v", spec, err)
+		}
+		ks.Name, ks.Port = ks.Name[:i], port
+	}
+	return ks, nil
+}
+
+// ProxyPath() returns the path to the service through the API server proxy
+func (ks *KubeService) ProxyPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/services/%s:%d/proxy", ks.Namespace, ks.Name, ks.Port)
+}
+
+// Endpoints() returns the addresses the service name resolves to in the cluster DNS,
+// which for a headless service are those of the pods
+func (ks *KubeService) Endpoints(ctx context.Context) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, ks.Name+"."+ks.Namespace+".svc")
+	if err != nil {
+		return nil, err
+	}
+	eps := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		eps = append(eps, net.JoinHostPort(addr, strconv.Itoa(ks.Port)))
+	}
+	return eps, nil
+}
+
+func (ks *KubeService) String() string {
+	return "Kubernetes service " + ks.Namespace + "/" + ks.Name
+}
+
+// kubeAPIServer() returns the URL to the API server from inside the cluster
+func kubeAPIServer() (string, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return "", fmt.Errorf("KUBERNETES_SERVICE_HOST is not set, not running in a Kubernetes cluster?")
+	}
+	if port == "" {
+		port = "443"
+	}
+	return "https://" + net.JoinHostPort(host, port), nil
+}
+
+// kubeToken() reads the token of the service account mounted in the pod
+func kubeToken() (string, error) {
+	data, err := ioutil.ReadFile(DEF_K8S_TOKEN_FILE)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
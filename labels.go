@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Label is a key=value pair given with --label, carried along in the output for event pipelines
+// to route alerts on, without having to make sense of the metric paths
+type Label struct {
+	Key   string
+	Value string
+}
+
+// parseLabels() parses key=value pairs, keeping the order they were given in
+func parseLabels(specs []string) ([]Label, error) {
+	labels := make([]Label, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid --label %q, should be key=value", spec)
+		}
+		l := Label{Key: spec[:i], Value: spec[i+1:]}
+		// a | would end the status line early, in the eyes of Nagios
+		if strings.ContainsAny(l.Key, " \t\n|") || strings.ContainsAny(l.Value, "\n|") {
+			return nil, fmt.Errorf("Invalid --label %q, no whitespace in the key and no | or newlines allowed", spec)
+		}
+		if seen[l.Key] {
+			return nil, fmt.Errorf("Invalid --label %q, %s given more than once", spec, l.Key)
+		}
+		seen[l.Key] = true
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+// labelString() returns the labels for the status line, like [team=db env=prod], or "" without any
+func labelString(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	strs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		v := l.Value
+		if strings.ContainsAny(v, " \t\"") {
+			v = strconv.Quote(v)
+		}
+		strs = append(strs, l.Key+"="+v)
+	}
+	return "[" + strings.Join(strs, " ") + "]"
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// durationFlags are the flags of a check that take a Graphite style time period
+var durationFlags = []string{"timeperiod", "offset", "flatline", "gap-step", "long-window", "forecast-horizon", "forget-series"}
+
+// LintError is a problem found in a config file, and where
+type LintError struct {
+	File  string
+	Line  int    // 0 if not known
+	Check string // name of the check, if the problem is with one
+	Msg   string
+}
+
+func (le LintError) String() string {
+	loc := le.File
+	if le.Line > 0 {
+		loc += fmt.Sprintf(":%d", le.Line)
+	}
+	if le.Check != "" {
+		return fmt.Sprintf("%s: check %q: %s", loc, le.Check, le.Msg)
+	}
+	return fmt.Sprintf("%s: %s", loc, le.Msg)
+}
+
+// LintConfig() validates a config file as far as possible without running the checks, and returns all
+// problems found, not only the first like LoadConfig() does
+func LintConfig(app *cli.App, file string) ([]LintError, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var errs []LintError
+	// helper func
+	report := func(line int, check, format string, a ...interface{}) {
+		errs = append(errs, LintError{File: file, Line: line, Check: check, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		// unknown keys and such, with the lines in the message
+		report(0, "", "%v", strings.TrimPrefix(err.Error(), "yaml: "))
+		return errs, nil
+	}
+	lines := strings.Split(string(data), "\n")
+	// helper func, finds the line the nth key with the given value is at, counting from 0, 0 if not found
+	lineOf := func(key, value string, nth int) int {
+		re := regexp.MustCompile(`^\s*(-\s+)?` + regexp.QuoteMeta(key) + `:\s*["']?` + regexp.QuoteMeta(value) + `["']?\s*(#.*)?$`)
+		for i, l := range lines {
+			if re.MatchString(l) {
+				if nth == 0 {
+					return i + 1
+				}
+				nth--
+			}
+		}
+		return 0
+	}
+
+	if cfg.Interval != "" {
+		if d, err := time.ParseDuration(cfg.Interval); err != nil || d <= 0 {
+			report(lineOf("interval", cfg.Interval, 0), "", "invalid interval %q", cfg.Interval)
+		}
+	}
+	if cfg.Output != "" {
+		if _, err := GetFormatter(cfg.Output); err != nil {
+			report(lineOf("output", cfg.Output, 0), "", "%v", err)
+		}
+	}
+	if len(cfg.Checks) == 0 {
+		report(0, "", "no checks configured")
+	}
+	for _, r := range cfg.Routes {
+		if err := r.validate(); err != nil {
+			report(lineOf("prefix", r.Prefix, 0), "", "%v", err)
+		}
+	}
+	for _, wh := range cfg.Webhooks {
+		if err := wh.validate(); err != nil {
+			report(lineOf("url", wh.URL, 0), "", "%v", err)
+		}
+	}
+
+	seen := make(map[string]int) // number of checks by name so far
+	first := make(map[string]int)
+	for i, chk := range cfg.Checks {
+		line := lineOf("name", chk.Name, seen[chk.Name])
+		seen[chk.Name]++
+		if chk.Name == "" {
+			report(0, "", "check #%d has no name", i+1)
+			continue
+		}
+		if n, ok := first[chk.Name]; ok {
+			report(line, chk.Name, "configured more than once, first as check #%d", n)
+			continue
+		}
+		first[chk.Name] = i + 1
+		if chk.Interval != "" {
+			if d, err := time.ParseDuration(chk.Interval); err != nil || d <= 0 {
+				report(line, chk.Name, "invalid interval %q", chk.Interval)
+			}
+		}
+		args := chk.Args
+		for _, b := range chk.Bands {
+			args = append(args, "--band", b.String())
+		}
+		ctx, err := checkContext(app, chk.Name, args)
+		if err != nil {
+			report(line, chk.Name, "%v", err)
+			continue
+		}
+		for _, msg := range lintCheck(ctx) {
+			report(line, chk.Name, "%s", msg)
+		}
+		for _, name := range processFlagsIn(app, args) {
+			report(line, chk.Name, "--%s can't be given per check, only on the command line of the daemon", name)
+		}
+	}
+	return errs, nil
+}
+
+// lintCheck() returns what's wrong with the flags of a check, as far as can be told without running it
+func lintCheck(c *cli.Context) []string {
+	var msgs []string
+	if err := validateArgs(c); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	ev, err := NewEvaluator(evaluatorName(c), c)
+	if err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if te, ok := ev.(*ThresholdEvaluator); ok {
+		// thresholds that can never change the state
+		if te.WarnPct >= 100 {
+			msgs = append(msgs, fmt.Sprintf("--warning-pct %g can never be exceeded, so WARNING is unreachable", te.WarnPct))
+		}
+		if te.CritPct >= 100 {
+			msgs = append(msgs, fmt.Sprintf("--critical-pct %g can never be exceeded, so CRITICAL is unreachable", te.CritPct))
+		}
+		if te.HasWarn && te.HasLowWarn && (te.WCond == CMP_GT || te.WCond == CMP_GE) && te.LowWarn > te.Warn {
+			msgs = append(msgs, fmt.Sprintf("--low-warning %g is above --warning %g, so every value is WARNING", te.LowWarn, te.Warn))
+		}
+		if te.HasCrit && te.HasLowCrit && (te.CCond == CMP_GT || te.CCond == CMP_GE) && te.LowCrit > te.Crit {
+			msgs = append(msgs, fmt.Sprintf("--low-critical %g is above --critical %g, so every value is CRITICAL", te.LowCrit, te.Crit))
+		}
+	}
+	for _, name := range durationFlags {
+		if v := c.String(name); v != "" {
+			if _, err := graphiteDuration(v); err != nil {
+				msgs = append(msgs, fmt.Sprintf("--%s: %v", name, err))
+			}
+		}
+	}
+	// plain paths, not function calls, can be checked for broken patterns
+	if mpath := c.String("metricpath"); mpath != "" && !strings.ContainsAny(mpath, "()") {
+		if _, err := globRE(mpath); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid metric path %q: %v", mpath, err))
+		}
+	}
+	return msgs
+}
+
+// run_lint() lints the config file given, and exits non-zero if anything's wrong with it
+func run_lint(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		return cli.NewExitError("No config file given", E_UNKNOWN)
+	}
+	// the flags of checks are those of the app itself, not of this subcommand
+	root := c
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	errs, err := LintConfig(root.App, file)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to read config: %v", err), E_UNKNOWN)
+	}
+	for _, le := range errs {
+		fmt.Println(le)
+	}
+	if len(errs) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problems found", len(errs)), E_CRITICAL)
+	}
+	fmt.Printf("%s: OK\n", file)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintConfigProcessFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte("checks:\n  - name: a\n    args: [-m, a.b, --header, \"X-A: 1\"]\n  - name: b\n    args: [-m, a.c]\n"), 0600)
+
+	errs, err := LintConfig(testApp(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test app lacks most flags, so only look at what's reported about the process wide ones
+	var found []LintError
+	for _, le := range errs {
+		if strings.Contains(le.Msg, "per check") {
+			found = append(found, le)
+		}
+	}
+	if len(found) != 1 || found[0].Check != "a" || found[0].Line != 2 || !strings.Contains(found[0].Msg, "--header") {
+		t.Errorf("got %v, want --header reported for check a on line 2", found)
+	}
+}
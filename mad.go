@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"math"
+	"sort"
+)
+
+const (
+	EV_MAD        string = "mad"
+	MAD_MINPOINTS int    = 3 // fewer datapoints than this can't tell what's normal
+)
+
+func init() {
+	RegisterEvaluator(EV_MAD, NewMADEvaluator)
+}
+
+// MADEvaluator judges the latest value of each metric by how many median absolute deviations (MAD) it is
+// from the median of its series in the window. Unlike the standard deviation, the MAD isn't blown up by
+// the odd huge value, which makes it work for heavy-tailed series like latencies.
+type MADEvaluator struct {
+	Warn, Crit float64 // number of MADs, 0 for no threshold
+	Top        int     // how many metrics to keep in each state, 0 for all
+}
+
+// NewMADEvaluator() creates a MADEvaluator from --mad-warning and --mad-critical
+func NewMADEvaluator(c *cli.Context) (Evaluator, error) {
+	me := &MADEvaluator{
+		Warn: c.Float64("mad-warning"),
+		Crit: c.Float64("mad-critical"),
+		Top:  c.Int("top"),
+	}
+	if me.Warn <= 0 && me.Crit <= 0 {
+		return nil, fmt.Errorf("The %s evaluator needs --mad-warning or --mad-critical", EV_MAD)
+	}
+	if me.Warn < 0 || me.Crit < 0 || (me.Warn > 0 && me.Crit > 0 && me.Crit < me.Warn) {
+		return nil, fmt.Errorf("Invalid MAD thresholds, should be above 0, and critical not below warning")
+	}
+	return me, nil
+}
+
+// madScore() returns how many MADs the latest value of m is from the median of its series. A series
+// without any deviation gets 0 for the same value, and infinity for any other.
+func madScore(m *Metric) float64 {
+	if len(m.Points) < MAD_MINPOINTS {
+		return 0
+	}
+	vals := make([]float64, len(m.Points))
+	for i := range m.Points {
+		vals[i] = m.Points[i].Value
+	}
+	median := reducers["median"](vals)
+	for i := range vals {
+		vals[i] = math.Abs(vals[i] - median)
+	}
+	mad := reducers["median"](vals)
+	dev := math.Abs(m.Value - median)
+	if mad == 0 {
+		if dev == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return dev / mad
+}
+
+// Evaluate() implements Evaluator
+func (me *MADEvaluator) Evaluate(ms Metrics) *Evaluation {
+	scores := make(map[*Metric]float64, len(ms))
+	for _, m := range ms {
+		scores[m] = madScore(m)
+	}
+	o, w, c := Metrics{}, Metrics{}, Metrics{}
+	var largest float64
+	for _, m := range ms {
+		switch {
+		case me.Crit > 0 && scores[m] > me.Crit:
+			c = append(c, m)
+		case me.Warn > 0 && scores[m] > me.Warn:
+			w = append(w, m)
+		default:
+			o = append(o, m)
+		}
+		if !math.IsInf(scores[m], 1) && scores[m] > largest {
+			largest = scores[m]
+		}
+	}
+	log.Debugf("#c: %d, #w: %d, #o: %d\n", len(c), len(w), len(o))
+
+	// helper func, sorts metrics furthest off first, and keeps the first Top of them
+	top := func(ms Metrics) Metrics {
+		sort.Slice(ms, func(i, j int) bool {
+			si, sj := scores[ms[i]], scores[ms[j]]
+			return si > sj || (si == sj && ms[i].Path < ms[j].Path)
+		})
+		if me.Top > 0 && len(ms) > me.Top {
+			return ms[:me.Top]
+		}
+		return ms
+	}
+
+	ev := &Evaluation{}
+	if me.Warn > 0 {
+		ev.Warn = fmt.Sprintf("%g", me.Warn)
+	}
+	if me.Crit > 0 {
+		ev.Crit = fmt.Sprintf("%g", me.Crit)
+	}
+	ev.Perf = []PerfData{
+		{Label: "mads", Value: largest, Unknown: len(ms) == 0, Warn: ev.Warn, Crit: ev.Crit},
+		{Label: "num_matching_metrics", Value: float64(len(ms)), Count: true},
+	}
+
+	// helper func, describes how far off the worst metric is
+	worst := func(bucket Metrics, limit float64) string {
+		m := top(bucket)[0]
+		return fmt.Sprintf("%d metrics more than %g MADs from their median, e.g. %s at %.02f (%.01f MADs)",
+			len(bucket), limit, m.Path, m.Value, scores[m])
+	}
+
+	switch {
+	case len(ms) == 0:
+		ev.Status = E_UNKNOWN
+		ev.Summary = "No values to evaluate"
+	case len(c) > 0:
+		ev.Status = E_CRITICAL
+		ev.Summary = worst(c, me.Crit)
+		ev.Perf[1].Value = float64(len(c))
+	case len(w) > 0:
+		ev.Status = E_WARNING
+		ev.Summary = worst(w, me.Warn)
+		ev.Perf[1].Value = float64(len(w))
+	default:
+		ev.Status = E_OK
+		ev.Summary = fmt.Sprintf("%d metrics within %.01f MADs from their median", len(o), largest)
+	}
+
+	ev.C = top(c)
+	ev.W = top(w)
+	ev.O = top(o)
+	return ev
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_SMTP_SERVER string = "localhost:25"
+)
+
+// Mailer sends results by mail, for when the check is run from cron on a host with no monitoring
+// server to alert anyone
+type Mailer struct {
+	Server   string // host:port
+	User     string // for SMTP AUTH, none if empty
+	Password string
+	From     string
+	To       []string
+}
+
+// NewMailer() creates a Mailer for the recipients, from check_graphite@this host if from is empty
+func NewMailer(server, user, password, from string, to []string) *Mailer {
+	if from == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		from = "check_graphite@" + host
+	}
+	return &Mailer{Server: server, User: user, Password: password, From: from, To: to}
+}
+
+// validateAddresses() tells which address, if any, isn't one
+func validateAddresses(addrs []string) error {
+	for _, a := range addrs {
+		if _, err := mail.ParseAddress(a); err != nil {
+			return fmt.Errorf("Invalid mail address %q: %v", a, err)
+		}
+	}
+	return nil
+}
+
+// message() returns the mail, with the headers and CRLF line endings SMTP wants
+func (m *Mailer) message(subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// Send() mails the body to the recipients, using STARTTLS if the server offers it
+func (m *Mailer) Send(subject, body string) error {
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, err := net.SplitHostPort(m.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("Invalid mail address %q: %v", m.From, err)
+	}
+	to := make([]string, len(m.To))
+	for i, a := range m.To {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			return fmt.Errorf("Invalid mail address %q: %v", a, err)
+		}
+		to[i] = addr.Address
+	}
+	return smtp.SendMail(m.Server, auth, from.Address, to, m.message(subject, body))
+}
+
+// mailSubject() returns the subject for a result: its status, name and summary, on one line
+func mailSubject(r *Result) string {
+	subject := fmt.Sprintf("%s: %s: %s", statusText(r.Status), r.Name, r.summary())
+	if i := strings.IndexAny(subject, "\r\n"); i >= 0 {
+		subject = subject[:i]
+	}
+	if len(subject) > 200 {
+		subject = subject[:197] + "..."
+	}
+	return subject
+}
@@ -2,19 +2,25 @@ package main
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
 	"crypto/tls"
-	"encoding/csv"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/cli" // renamed from codegansta
+	"html"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,9 +32,8 @@ const (
 	DEF_ADR      string  = "graphite.wirelesscar.net"
 	DEF_PERIOD   string  = "301s"
 	DEF_PORT     int     = 80
-	URL_ATMPL    string  = "%s://%s:%d"                                    // address template
-	URL_PTMPL    string  = "/render?target=%s&amp;format=csv&amp;from=-%s" // path template
-	URL_TMPL     string  = "%s://%s:%d/render?target=%s&amp;format=csv&amp;from=-%s"
+	URL_ATMPL    string  = "%s://%s:%d" // address template
+	URL_RENDER   string  = "/render"    // path of the render API
 	CMP_LT       string  = "lt"
 	CMP_GT       string  = "gt"
 	CMP_LE       string  = "le"
@@ -47,17 +52,40 @@ const (
 // Note that TS and Value have switched order here compared the format one uses for posting TO Graphite
 // I don't know why it returns it in a different order than it receives it, but good to be aware of.
 type Metric struct {
-	Path  string
-	TS    time.Time
-	Value float64
+	Path   string
+	TS     time.Time
+	Value  float64
+	Points []Point // all datapoints of the series in the window, oldest first
 }
 
 type Metrics []*Metric
 
+// Copy() returns a copy of the metrics and their datapoints, for transformations to change
+func (ms Metrics) Copy() Metrics {
+	cp := make(Metrics, len(ms))
+	for i, m := range ms {
+		mc := *m
+		mc.Points = append([]Point{}, m.Points...)
+		cp[i] = &mc
+	}
+	return cp
+}
+
+// Bucket is a slice of metrics all in the same state
+type Bucket struct {
+	MS    Metrics
+	ECode int
+}
+
 type GraphiteResponse struct {
-	MS  Metrics
-	RT  float64
-	Err error
+	MS       Metrics
+	RT       float64
+	Err      error
+	Timing   *Timing           // phases of the slowest request
+	Cert     *x509.Certificate // the server certificate that expires first, if https
+	Null     []string          // paths of series matched, but without any values in the window
+	Skip     int               // number of malformed rows skipped
+	Requests []*Timing         // all requests made, by URL
 }
 
 // Run debugging with not-so-light function calls through this, to avoid running
@@ -82,36 +110,97 @@ func (ms Metrics) LongestKey() int {
 }
 
 // Dump() prettyprints a slice of metrics
-func (ms Metrics) Dump(w io.Writer, ralign int) {
+func (ms Metrics) Dump(w io.Writer, ralign int, points bool) {
 	for i := range ms {
+		if points {
+			fmt.Fprintf(w, fmt.Sprintf("%s%d%s", "%-", ralign, "s % 12.4f %d  %d points, newest %s ago\n"), ms[i].Path, ms[i].Value, ms[i].TS.Unix(),
+				len(ms[i].Points), time.Since(ms[i].TS).Round(time.Second))
+			continue
+		}
 		fmt.Fprintf(w, fmt.Sprintf("%s%d%s", "%-", ralign, "s % 12.4f %d\n"), ms[i].Path, ms[i].Value, ms[i].TS.Unix())
 	}
 }
 
-// FilterOffenders() splits a slice of metrics into 3 new slices based on values in regard to thresholds
-func (ms Metrics) FilterOffenders(condition string, warn, crit float64) (o, w, c Metrics) {
+// FilterOffenders() splits a slice of metrics into 3 new slices based on values in regard to thresholds.
+// A metric matching crit ends up in c, otherwise a metric matching warn ends up in w, and the rest in o.
+// The returned slices are not sorted, see SortFor().
+func (ms Metrics) FilterOffenders(warn, crit Predicate) (o, w, c Metrics) {
 	o = Metrics{} // those in OK state
 	w = Metrics{} // those in WARNING state
 	c = Metrics{} // those in CRITICAL state
 	for i := range ms {
-		if checkIf(condition, ms[i].Value, crit) {
+		if crit(ms[i].Value) {
 			c = append(c, ms[i])
-		} else if checkIf(condition, ms[i].Value, warn) {
+		} else if warn(ms[i].Value) {
 			w = append(w, ms[i])
 		} else {
 			o = append(o, ms[i])
 		}
 	}
+	return o, w, c
+}
+
+// buckets() returns the slices from FilterOffenders() along with their state, worst first
+func buckets(o, w, c Metrics) []Bucket {
+	return []Bucket{{c, E_CRITICAL}, {w, E_WARNING}, {o, E_OK}}
+}
+
+// worseFor() returns a func telling whether metric a is more in breach of the given condition than b.
+// Equal values are ordered by path, so output is the same from run to run.
+func worseFor(condition string) func(a, b *Metric) bool {
 	if condition == CMP_GT || condition == CMP_GE {
-		sort.Sort(sort.Reverse(o))
-		sort.Sort(sort.Reverse(w))
-		sort.Sort(sort.Reverse(c))
-	} else {
-		sort.Sort(o)
-		sort.Sort(w)
-		sort.Sort(c)
+		return func(a, b *Metric) bool {
+			return a.Value > b.Value || (a.Value == b.Value && a.Path < b.Path)
+		}
 	}
-	return o, w, c
+	return func(a, b *Metric) bool {
+		return a.Value < b.Value || (a.Value == b.Value && a.Path < b.Path)
+	}
+}
+
+// SortFor() sorts a slice of metrics so that the values most in breach of the given condition comes first
+func (ms Metrics) SortFor(condition string) {
+	worse := worseFor(condition)
+	sort.Slice(ms, func(i, j int) bool { return worse(ms[i], ms[j]) })
+}
+
+// SortByPath() sorts a slice of metrics by path, for a stable order independent of values
+func (ms Metrics) SortByPath() {
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Path < ms[j].Path })
+}
+
+// metricHeap keeps the least offending of the metrics selected by TopFor() at the root
+type metricHeap struct {
+	Metrics
+	worse func(a, b *Metric) bool
+}
+
+func (h *metricHeap) Less(i, j int) bool { return h.worse(h.Metrics[j], h.Metrics[i]) }
+func (h *metricHeap) Push(x interface{}) { h.Metrics = append(h.Metrics, x.(*Metric)) }
+func (h *metricHeap) Pop() interface{} {
+	m := h.Metrics[len(h.Metrics)-1]
+	h.Metrics = h.Metrics[:len(h.Metrics)-1]
+	return m
+}
+
+// TopFor() returns the n metrics most in breach of the given condition, sorted like SortFor() does.
+// Only the selected metrics are sorted, so it's cheap for a small n. n <= 0 means all.
+func (ms Metrics) TopFor(condition string, n int) Metrics {
+	if n <= 0 || n >= len(ms) {
+		ms.SortFor(condition)
+		return ms
+	}
+	worse := worseFor(condition)
+	h := &metricHeap{Metrics: append(Metrics{}, ms[:n]...), worse: worse}
+	heap.Init(h)
+	for _, m := range ms[n:] {
+		if worse(m, h.Metrics[0]) {
+			h.Metrics[0] = m
+			heap.Fix(h, 0)
+		}
+	}
+	h.Metrics.SortFor(condition)
+	return h.Metrics
 }
 
 // Max() returns the highest value in a slice of metrics
@@ -149,6 +238,31 @@ func (ms Metrics) Avg() float64 {
 	return total / float64(l)
 }
 
+// Median() returns the median value of all values in a slice of metrics, which unlike the average
+// isn't thrown off by a single outlier
+func (ms Metrics) Median() float64 {
+	if len(ms) == 0 {
+		return 0
+	}
+	vals := make([]float64, len(ms))
+	for i := range ms {
+		vals[i] = ms[i].Value
+	}
+	return reducers["median"](vals)
+}
+
+// Percentile() returns the pth percentile of all values in a slice of metrics
+func (ms Metrics) Percentile(p float64) float64 {
+	if len(ms) == 0 {
+		return 0
+	}
+	vals := make([]float64, len(ms))
+	for i := range ms {
+		vals[i] = ms[i].Value
+	}
+	return percentile(vals, p)
+}
+
 // Latest() returns the latest/newest of 2 metrics based on its timestamp field
 func (m *Metric) Latest(nm *Metric) *Metric {
 	if m.TS.After(nm.TS) {
@@ -168,7 +282,7 @@ func (ms Metrics) Swap(i, j int) {
 }
 
 func (ms Metrics) Less(i, j int) bool {
-	return ms[i].Value < ms[j].Value
+	return ms[i].Value < ms[j].Value || (ms[i].Value == ms[j].Value && ms[i].Path < ms[j].Path)
 }
 
 // NewMetric() creates a new Metric and return its pointer
@@ -209,6 +323,83 @@ func NewMetricFromCSV(csv []string) (*Metric, error) {
 	return NewMetric(csv[0], ts, val), nil
 }
 
+// Predicate tells if a value is in breach of something
+type Predicate func(val float64) bool
+
+// Threshold() returns a Predicate checking a value against a threshold based on condition/direction parameter
+func Threshold(condition string, threshold float64) Predicate {
+	return func(val float64) bool {
+		return checkIf(condition, val, threshold)
+	}
+}
+
+// Any() returns a Predicate that is true if any of the given predicates are true
+func Any(ps ...Predicate) Predicate {
+	return func(val float64) bool {
+		for _, p := range ps {
+			if p(val) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Never is a Predicate that is never true, used for thresholds not given
+func Never(val float64) bool {
+	return false
+}
+
+// validateThresholds() checks that the given thresholds make sense together
+func validateThresholds(haswarn, hascrit, haslowwarn, haslowcrit bool, wcond, ccond string,
+	warn, crit, lowwarn, lowcrit float64) error {
+	if !haswarn && !hascrit && !haslowwarn && !haslowcrit {
+		return errors.New("no warning or critical threshold given")
+	}
+	// ordering only makes sense to check when both levels trigger in the same direction
+	if haswarn && hascrit && wcond == ccond {
+		if (wcond == CMP_GT || wcond == CMP_GE) && warn > crit {
+			return fmt.Errorf("warning (%v) is above critical (%v), while triggering on values %s them",
+				warn, crit, dirWord(wcond))
+		}
+		if (wcond == CMP_LT || wcond == CMP_LE) && warn < crit {
+			return fmt.Errorf("warning (%v) is below critical (%v), while triggering on values %s them",
+				warn, crit, dirWord(wcond))
+		}
+	}
+	if haslowwarn && haslowcrit && lowwarn < lowcrit {
+		return fmt.Errorf("low warning (%v) is below low critical (%v)", lowwarn, lowcrit)
+	}
+	return nil
+}
+
+// validCondition() returns the given condition if it's one we know of, otherwise the default CMP_LT
+func validCondition(condition string) string {
+	if condition != CMP_GT && condition != CMP_GE && condition != CMP_LE {
+		return CMP_LT
+	}
+	return condition
+}
+
+// upward() tells if a condition triggers on values above the threshold
+func upward(condition string) bool {
+	return condition == CMP_GT || condition == CMP_GE
+}
+
+// dirWord() returns a human readable "direction word" for a condition
+func dirWord(condition string) string {
+	switch condition {
+	case CMP_LT:
+		return "below"
+	case CMP_LE:
+		return "below or equal to"
+	case CMP_GE:
+		return "above or equal to"
+	default:
+		return "above"
+	}
+}
+
 // checkIf() checks if a value is less than or bigger than a threshold based on condition/direction parameter
 func checkIf(condition string, val, threshold float64) bool {
 	switch condition {
@@ -225,288 +416,1146 @@ func checkIf(condition string, val, threshold float64) bool {
 	}
 }
 
-// geturl() fetches a URL and returns the HTTP response
-func geturl(url string) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	req.Header.Set("User-Agent", UA)
+// ConnOptions are settings for how to reach the backend, common for all checks and subcommands
+type ConnOptions struct {
+	inflight    int64             // requests in flight, accessed atomically, first for alignment
+	queued      int64             // requests waiting for a slot in Inflight, accessed atomically
+	Header      http.Header       // extra headers for all requests to the backend
+	ProxyPath   string            // path to insert between the address and the API paths, e.g. for a Grafana proxy
+	Dialect     string            // which Graphite API implementation we talk to
+	Tape        *Tape             // records responses, or replays them instead of asking the backend
+	Inflight    chan struct{}     // one slot per concurrent request allowed, nil for no limit
+	Limiter     *RateLimiter      // limits the rate of requests, and backs off when the backend asks us to
+	Resolve     map[string]string // addresses to connect to instead of looking up hosts, from --resolve
+	Discovery   Discovery         // finds the backend endpoints, nil to use the address given
+	Prefix      string            // URL prefix to use when none is given, e.g. to the Kubernetes API server
+	SourceIP    *net.TCPAddr      // local address to connect from, nil to leave it to the OS
+	Timeout     time.Duration     // limit for each request, body included, 0 for none but that of the check
+	IdleTimeout time.Duration     // limit for waiting on the next bytes of a response, 0 for none
+	Cache       *ResponseCache    // reuses responses the backend says are unchanged, nil for no caching
+	TLS         *tls.Config       // for https, nil to not verify the certificate
+}
 
-	tr := &http.Transport{DisableKeepAlives: true} // we're not reusing the connection, so don't let it hang open
-	if strings.Index(url, "https") >= 0 {
-		// Verifying certs is not the job of this plugin,
-		// so we save ourselves a lot of grief by skipping any SSL verification
-		// Could be a good idea for later to set this at runtime instead
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-	client := &http.Client{Transport: tr}
+// set from the global flags in app.Before, and only read after that, as checks may run concurrently.
+// What belongs to one run, like a Coalescer, is passed in its context instead.
+var conn = ConnOptions{Header: make(http.Header), Dialect: DL_GRAPHITE, Limiter: &RateLimiter{}}
 
-	return client.Do(req)
+// grafanaProxyPath() returns the path to a Grafana datasource proxy, by numeric ID or by UID
+func grafanaProxyPath(ds string) string {
+	if _, err := strconv.Atoi(ds); err == nil {
+		return "/api/datasources/proxy/" + ds
+	}
+	return "/api/datasources/proxy/uid/" + ds
 }
 
-// parse() reads a http response and converts it from CSV to Metrics if successful
-// Designed to run in a separate goroutine, and hence uses a result channel instead or returning anything
-func parse(url string, chRes chan GraphiteResponse) {
-	gr := GraphiteResponse{}
-	t_start := time.Now()
-	resp, err := geturl(url)
-	gr.RT = time.Duration(time.Now().Sub(t_start)).Seconds()
+// geturl() fetches a URL and returns the HTTP response
+func geturl(ctx context.Context, url string) (*http.Response, error) {
+	return geturlWith(ctx, url, nil)
+}
 
+// geturlWith() is geturl() with extra headers for the request, like for a conditional request
+func geturlWith(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		gr.Err = err
-		chRes <- gr
-		return
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if t := timingFrom(ctx); t != nil {
+		req = req.WithContext(httptrace.WithClientTrace(ctx, t.trace()))
+	}
+	req.Header.Set("User-Agent", UA)
+	for k, v := range conn.Header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
 	}
 
-	defer resp.Body.Close()
-	rdr := csv.NewReader(resp.Body)
-	mmap := make(map[string]*Metric) // used for filtering
+	if conn.Tape != nil && conn.Tape.replay {
+		return conn.Tape.Play(url)
+	}
 
-	for {
-		rec, err := rdr.Read()
-		if err == io.EOF {
+	var resp *http.Response
+	for try := 0; ; try++ {
+		if err := conn.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = send(ctx, req)
+		if err != nil || try == MAX_RETRIES {
 			break
 		}
-		if err != nil {
-			gr.Err = err
+		// back off if the backend asks us to, and try again if there's time
+		d, ok := retryAfter(resp)
+		if !ok {
 			break
 		}
-		log.Debugf("parse(): %#v", rec)
-		m, err := NewMetricFromCSV(rec)
-		if err != nil {
-			log.Debug(err)
-			continue
+		conn.Limiter.Backoff(d)
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < d {
+			break
 		}
+		log.Debugf("%s, retrying in %s: %s", resp.Status, d, url)
+		resp.Body.Close()
+	}
+	if conn.Tape != nil {
+		return conn.Tape.Record(url, resp, err)
+	}
+	return resp, err
+}
 
-		cm, ok := mmap[m.Path]
-		if ok {
-			mmap[m.Path] = m.Latest(cm) // replace existing metric with current, if newer
+// send() sends a request to the backend, when there's a free slot if the number of concurrent requests is limited
+func send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if conn.Inflight != nil {
+		atomic.AddInt64(&conn.queued, 1)
+		select {
+		case conn.Inflight <- struct{}{}:
+			atomic.AddInt64(&conn.queued, -1)
+		case <-ctx.Done():
+			atomic.AddInt64(&conn.queued, -1)
+			return nil, ctx.Err()
+		}
+	}
+	atomic.AddInt64(&conn.inflight, 1)
+	resp, err := httpclient(req.URL.String()).Do(req)
+	atomic.AddInt64(&conn.inflight, -1)
+	if conn.Inflight != nil {
+		if err != nil {
+			<-conn.Inflight
 		} else {
-			mmap[m.Path] = m // first hit, init
+			// the request is in flight until its body is read
+			resp.Body = &slotBody{ReadCloser: resp.Body}
 		}
 	}
+	return resp, err
+}
 
-	// copy unique metrics from map to struct
-	for i := range mmap {
-		gr.MS = append(gr.MS, mmap[i])
-	}
+// slotBody frees the slot of a request in conn.Inflight when closed
+type slotBody struct {
+	io.ReadCloser
+	once sync.Once
+}
 
-	chRes <- gr
+func (sb *slotBody) Close() error {
+	sb.once.Do(func() { <-conn.Inflight })
+	return sb.ReadCloser.Close()
 }
 
-// long_output() pretty prints 3 metric slices for usage in op5 long output on extinfo page
-func long_output(o, w, c Metrics, align int) string {
-	var buf bytes.Buffer
-	if len(c) > 0 {
-		fmt.Fprintf(&buf, "===> Metrics in state %s:\n", S_CRITICAL)
-		c.Dump(&buf, align)
-		fmt.Fprintf(&buf, "\n")
+// httpclient() returns a HTTP client set up for the given URL
+func httpclient(url string) *http.Client {
+	tr := &http.Transport{DisableKeepAlives: true} // we're not reusing the connection, so don't let it hang open
+	if conn.Discovery != nil {
+		tr.DialContext = failoverDial
+	} else if len(conn.Resolve) > 0 || conn.SourceIP != nil {
+		tr.DialContext = resolveDial
 	}
-	if len(w) > 0 {
-		fmt.Fprintf(&buf, "===> Metrics in state %s:\n", S_WARNING)
-		w.Dump(&buf, align)
-		fmt.Fprintf(&buf, "\n")
+	if strings.Index(url, "https") >= 0 {
+		// Verifying certs is not the job of this plugin unless asked to with --tls-verify or --ca-file,
+		// so we save ourselves a lot of grief by skipping any SSL verification by default
+		if conn.TLS != nil {
+			tr.TLSClientConfig = conn.TLS.Clone()
+		} else {
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
 	}
-	if len(o) > 0 {
-		fmt.Fprintf(&buf, "===> Metrics in state %s:\n", S_OK)
-		o.Dump(&buf, align)
+	// no bytes before the headers either is just as stalled
+	tr.ResponseHeaderTimeout = conn.IdleTimeout
+	return &http.Client{Transport: tr, Timeout: conn.Timeout}
+}
+
+// long_output() pretty prints 3 metric slices for usage in op5 long output on extinfo page.
+// If maxlines is above 0, only that many metrics are listed per state, with a note on how many were left out.
+// With points, the number of datapoints of each metric and the age of the newest are shown as well.
+func long_output(o, w, c Metrics, align, maxlines int, points bool) string {
+	var buf bytes.Buffer
+	for _, b := range []struct {
+		state string
+		ms    Metrics
+	}{{S_CRITICAL, c}, {S_WARNING, w}, {S_OK, o}} {
+		if len(b.ms) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "===> Metrics in state %s:\n", b.state)
+		if maxlines > 0 && len(b.ms) > maxlines {
+			b.ms[:maxlines].Dump(&buf, align, points)
+			fmt.Fprintf(&buf, "(%d more metrics in state %s not shown, see --max-lines)\n", len(b.ms)-maxlines, b.state)
+		} else {
+			b.ms.Dump(&buf, align, points)
+		}
 		fmt.Fprintf(&buf, "\n")
 	}
 	return buf.String()
 }
 
-// run_check() takes the CLI params and glue together all logic in the program
-func run_check(c *cli.Context) {
+// base_url() returns the URL prefix to Graphite, either as given, or put together from the other params
+func base_url(urlprefix, prot, host string, port uint64) (string, error) {
+	if urlprefix == "" {
+		urlprefix = conn.Prefix
+	}
+	if urlprefix != "" {
+		log.Debugf("Using URL prefix %q", urlprefix)
+		return strings.TrimSuffix(urlprefix, "/") + conn.ProxyPath, nil
+	}
+	if conn.Discovery != nil {
+		s_host, s_port, err := discoveredHost()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(URL_ATMPL, prot, s_host, s_port) + conn.ProxyPath, nil
+	}
+	log.Debug("No URL prefix, trying to parse other params")
+	if strings.Index(host, ":") >= 0 {
+		log.Debugf("Found port spec in host spec: %q", host)
+		s_host, s_port, err := net.SplitHostPort(host)
+		if err != nil {
+			return "", fmt.Errorf("Please check your host specification: %v", err)
+		}
+		host = s_host
+		port, err = strconv.ParseUint(s_port, 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("Unable to parse port: %v", err)
+		}
+	}
+	return fmt.Sprintf(URL_ATMPL, prot, host, port) + conn.ProxyPath, nil
+}
+
+// check() runs the check given by the flags in c, and returns its result
+func check(c *cli.Context) *Result {
+	return checkWith(context.Background(), c)
+}
+
+// checkWith() is check() with the requests made in the context of parent, e.g. to share them with other checks
+func checkWith(parent context.Context, c *cli.Context) *Result {
 	urlprefix := c.String("urlprefix")
 	prot := c.String("protocol")
 	host := c.String("hostname")
 	port := c.Uint64("port")
 	mpath := c.String("metricpath")
+	tfile := c.String("targets-file")
+	backend := c.String("backend")
 	period := c.String("timeperiod")
 	tmout := c.Float64("timeout")
-	condition := c.String("if")
-	warn := c.Float64("warning")
-	crit := c.Float64("critical")
 	unok := c.Bool("unknown-ok")
 	unwarn := c.Bool("unknown-warning")
 	uncrit := c.Bool("unknown-critical")
+	alertnew := c.Bool("alert-on-new")
+	statefile := c.String("state-file")
+	chkname := c.String("check-name")
+	timing := c.Bool("timing")
+	htmlout := c.Bool("output-html")
+	rtwarn := c.Float64("rt-warning")
+	rtcrit := c.Float64("rt-critical")
+	certdays := c.Int("cert-expiry")
+	spikewarn := c.Float64("spike-warning")
+	spikecrit := c.Float64("spike-critical")
+	labels, _ := parseLabels(c.StringSlice("label")) // checked by validateArgs()
 
-	if condition != CMP_GT && condition != CMP_GE && condition != CMP_LE {
-		condition = CMP_LT
-	}
+	deadline := time.Now().Add(time.Duration(tmout * float64(time.Second))) // to answer by, whatever we wait for
 
-	var url string
-	if urlprefix != "" {
-		log.Debugf("Using URL prefix %q", urlprefix)
-		url = fmt.Sprintf(urlprefix+URL_PTMPL, mpath, period)
-	} else {
-		log.Debug("No URL prefix, trying to parse other params")
-		if strings.Index(host, ":") >= 0 {
-			log.Debugf("Found port spec in host spec: %q", host)
-			s_host, s_port, err := net.SplitHostPort(host)
-			if err != nil {
-				log.Fatalf("Please check your host specification: %v", err)
-			}
-			host = s_host
-			port, err = strconv.ParseUint(s_port, 10, 16)
-			if err != nil {
-				log.Fatalf("Unable to parse port: %v", err)
+	// helper func, the exit code for a status, which for UNKNOWN may be mapped to another by the flags
+	exitCode := func(status int) int {
+		if status == E_UNKNOWN {
+			if unok {
+				return E_OK
+			} else if unwarn {
+				return E_WARNING
+			} else if uncrit {
+				return E_CRITICAL
 			}
 		}
-		url = fmt.Sprintf(URL_TMPL, prot, host, port, mpath, period)
+		return status
 	}
 
-	log.Debugf("URL: %s\n", url)
-	//log.Fatal("Debug abort\n")
+	// helper func, for when the check can't be run as given
+	fail := func(status int, class, format string, a ...interface{}) *Result {
+		return &Result{Name: chkname, Status: status, ExitCode: status, Summary: fmt.Sprintf(format, a...), Failure: class, Labels: labels}
+	}
 
-	chRes := make(chan GraphiteResponse)
-	defer close(chRes)
+	if err := validateArgs(c); err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+	}
 
-	// run in parallell
-	go parse(url, chRes)
+	var budget *Budget
+	if c.String("max-memory") != "" {
+		max, err := parseSize(c.String("max-memory"))
+		if err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+		budget = &Budget{Max: max}
+	}
+	var escalators []Escalator
+	if key := c.String("pagerduty-key"); key != "" {
+		escalators = append(escalators, &PagerDuty{URL: c.String("pagerduty-url"), RoutingKey: key})
+	}
+	if key := c.String("opsgenie-key"); key != "" {
+		escalators = append(escalators, &OpsGenie{URL: c.String("opsgenie-url"), APIKey: key})
+	}
+	op5 := &Op5Client{
+		URL:      c.String("op5-api"),
+		User:     c.String("op5-user"),
+		Password: c.String("op5-password"),
+		Host:     c.String("op5-host"),
+		Template: c.String("op5-template"),
+		Prefix:   c.String("op5-prefix"),
+	}
 
-	select {
-	case res := <-chRes:
-		if res.Err != nil {
-			fmt.Printf("%s: Error parsing result: %q", S_CRITICAL, res.Err)
-			os.Exit(E_CRITICAL)
+	evaluator, err := NewEvaluator(evaluatorName(c), c)
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+	}
+
+	var targets []string
+	if mpath != "" {
+		targets = append(targets, mpath)
+	}
+	if tfile != "" {
+		ftargets, err := ReadTargets(tfile)
+		if err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Unable to read targets: %v", err)
+		}
+		targets = append(targets, ftargets...)
+	}
+	vars, err := ParseVars(c.StringSlice("var"))
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+	}
+	if op5.URL != "" && op5.Host == "" {
+		op5.Host = vars["host"]
+		if op5.Host == "" {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "No op5 host given, use --op5-host or --var host=...")
+		}
+	}
+	window, err := NewWindow(period, c.String("offset"))
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+	}
+	perfnames, err := ParseVars(c.StringSlice("perf-label"))
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --perf-label: %v", err)
+	}
+	var occur *Occurrences
+	if spec := c.String("occurrences"); spec != "" {
+		if occur, err = ParseOccurrences(spec); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+	}
+	softretries := c.Int("soft-retries")
+	if softretries < 0 {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --soft-retries %d, should be 0 or more", softretries)
+	}
+	nomatchstatus, err := parseStatus(c.String("no-match-status"))
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --no-match-status: %v", err)
+	}
+	nullstatus, err := parseStatus(c.String("all-null-status"))
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --all-null-status: %v", err)
+	}
+	var guard *Guard
+	if spec := c.String("suppress-if"); spec != "" {
+		if guard, err = ParseGuard(spec); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+	}
+	suppressed, err := parseStatus(c.String("suppress-status"))
+	if err != nil || (suppressed != E_OK && suppressed != E_UNKNOWN) {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --suppress-status %q (options: %s, %s)", c.String("suppress-status"), S_OK, S_UNKNOWN)
+	}
+	var grace time.Duration
+	if spec := c.String("grace"); spec != "" {
+		if grace, err = time.ParseDuration(spec); err != nil || grace <= 0 {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --grace %q, should be a duration like 5m", spec)
+		}
+	}
+	var longwin *Window
+	if spec := c.String("long-window"); spec != "" {
+		lw, err := NewWindow(spec, c.String("offset"))
+		if err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --long-window: %v", err)
+		}
+		longwin = &lw
+	}
+	var flatdur time.Duration
+	if spec := c.String("flatline"); spec != "" {
+		if flatdur, err = graphiteDuration(spec); err != nil || flatdur <= 0 {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --flatline %q, should be a time period like 30min", spec)
+		}
+	}
+	forget, err := graphiteDuration(c.String("forget-series"))
+	if err != nil || forget <= 0 {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --forget-series %q, should be a time period like 7d", c.String("forget-series"))
+	}
+	flatstatus, err := parseStatus(c.String("flatline-status"))
+	if err != nil || (flatstatus != E_WARNING && flatstatus != E_CRITICAL) {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --flatline-status %q (options: %s, %s)", c.String("flatline-status"), S_WARNING, S_CRITICAL)
+	}
+	var gapstep time.Duration
+	if spec := c.String("gap-step"); spec != "" {
+		if gapstep, err = graphiteDuration(spec); err != nil || gapstep <= 0 {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --gap-step %q, should be a time period like 1min", spec)
+		}
+	}
+	var smooth *Smoothing
+	if spec := c.String("smooth"); spec != "" {
+		if smooth, err = ParseSmoothing(spec); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
 		}
+	}
+	var lastpts *LastPoints
+	if spec := c.String("last-points"); spec != "" {
+		if lastpts, err = ParseLastPoints(spec); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+	}
+	wrap := &Wrapping{TransformNull: c.String("transform-null"), KeepLast: -1}
+	if wrap.TransformNull != "" {
+		if _, err := strconv.ParseFloat(wrap.TransformNull, 64); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --transform-null %q, should be a number", wrap.TransformNull)
+		}
+	}
+	if c.IsSet("keep-last-value") {
+		wrap.KeepLast = c.Int("keep-last-value")
+		if wrap.KeepLast < 0 {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "Invalid --keep-last-value %d, should be 0 or more", wrap.KeepLast)
+		}
+	}
+	if spec := c.String("summarize"); spec != "" {
+		if err := wrap.ParseSummarize(spec); err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+	}
+	if !wrap.Empty() && backend == BE_OPENTSDB {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Graphite functions can't be used with the %s backend", backend)
+	}
+	var silencer Silencer
+	dthost := c.String("op5-host")
+	if dthost == "" {
+		dthost = vars["host"]
+	}
+	dtapi, dtuser, dtpass := c.String("downtime-api"), c.String("downtime-user"), c.String("downtime-password")
+	switch dt := c.String("downtime-check"); dt {
+	case "":
+	case DT_OP5:
+		if dtapi == "" {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "--downtime-check %s needs --downtime-api", dt)
+		}
+		silencer = &Op5Client{URL: dtapi, User: dtuser, Password: dtpass}
+	case DT_ICINGA2:
+		if dtapi == "" {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "--downtime-check %s needs --downtime-api", dt)
+		}
+		silencer = &IcingaClient{URL: dtapi, User: dtuser, Password: dtpass}
+	default:
+		return fail(E_UNKNOWN, FAIL_CONFIG, "Unknown --downtime-check %q (options: %s, %s)", dt, DT_OP5, DT_ICINGA2)
+	}
+	if silencer != nil && dthost == "" {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "No host to check for downtime, use --op5-host or --var host=...")
+	}
+	for i := range targets {
+		targets[i], err = ExpandMacros(targets[i], vars)
+		if err != nil {
+			return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+		}
+		if !wrap.Empty() && targets[i] != "" {
+			targets[i] = wrap.Wrap(targets[i])
+		}
+	}
 
-		align := res.MS.LongestKey()
-		o, w, c := res.MS.FilterOffenders(condition, warn, crit)
-		lo := long_output(o, w, c, align)
-		nc := len(c)
-		nw := len(w)
-		no := len(o)
-		log.Debugf("#c: %d, #w: %d, #o: %d\n", nc, nw, no)
-
-		// saving all values in a map to avoid running each calculation more than once
-		const (
-			K_A string = "avg"
-			K_U string = "upper"
-			K_L string = "lower"
-		)
-		vals := make(map[string]map[string]float64)
-		vals["c"] = make(map[string]float64)
-		vals["c"][K_A] = c.Avg()
-		vals["c"][K_L] = c.Min()
-		vals["c"][K_U] = c.Max()
-		vals["w"] = make(map[string]float64)
-		vals["w"][K_A] = w.Avg()
-		vals["w"][K_L] = w.Min()
-		vals["w"][K_U] = w.Max()
-		vals["o"] = make(map[string]float64)
-		vals["o"][K_A] = o.Avg()
-		vals["o"][K_L] = o.Min()
-		vals["o"][K_U] = o.Max()
-
-		// helper func
-		genperf := func(ecode int) string {
-			perf_tmpl := "|value=%f;%f;%f;%f;%f response_time=%fs;%f;%f; num_matching_metrics=%d;"
-			rt_warn := tmout / 2 // we don't really have a warning level for timeout, but only for the sake of perf output
-			var str string
-			// helper in helper func
-			_fmt := func(key string, count int) string {
-				return fmt.Sprintf(perf_tmpl, vals[key][K_A], warn, crit,
-					vals[key][K_L], vals[key][K_U], res.RT, rt_warn, tmout, count)
-			}
-			switch ecode {
-			case E_CRITICAL:
-				str = _fmt("c", nc)
-			case E_WARNING:
-				str = _fmt("w", nw)
-			case E_OK:
-				str = _fmt("o", no)
-			default:
-				str = fmt.Sprintf(perf_tmpl, 0.0, warn, crit, 0.0, 0.0, res.RT, rt_warn, tmout, 0)
-			}
-			return str
-		}
-
-		// helper func
-		nagios_result := func(ecode int) {
-			var dw string // "direction word"
-			if condition == CMP_LT {
-				dw = "below"
-			} else if condition == CMP_LE {
-				dw = "below or equal to"
-			} else if condition == CMP_GE {
-				dw = "above or equal to"
-			} else {
-				dw = "above"
-			}
-			msg_tmpl := "%d metrics are %s the %s threshold of %.02f %s"
-			var msg, status string
-			if ecode == E_CRITICAL {
-				status = S_CRITICAL
-				msg = fmt.Sprintf(msg_tmpl, nc, dw, strings.ToLower(S_CRITICAL), crit, genperf(ecode))
-			}
-			if ecode == E_WARNING {
-				status = S_WARNING
-				msg = fmt.Sprintf(msg_tmpl, nw, dw, strings.ToLower(S_WARNING), warn, genperf(ecode))
-			}
-			if ecode == E_OK {
-				status = S_OK
-				msg = fmt.Sprintf("%d metrics at %.02f on average, min: %.02f, max: %.02f %s",
-					no, vals["o"][K_A], vals["o"][K_L], vals["o"][K_U], genperf(ecode))
-			}
-			if ecode == E_UNKNOWN {
-				status = S_UNKNOWN
-				//msg = fmt.Sprintf("There's something strange in your neighbourhood, who ya gonna call?%s", genperf(ecode))
-				msg = fmt.Sprintf("No values in Graphite within %s range!%s", period, genperf(ecode))
-			}
-			fmt.Printf("%s: %s\n\n%s", status, msg, lo)
-			if ecode == E_UNKNOWN {
-				if unok {
-					os.Exit(E_OK)
-				} else if unwarn {
-					os.Exit(E_WARNING)
-				} else if uncrit {
-					os.Exit(E_CRITICAL)
-				} else {
-					os.Exit(E_UNKNOWN)
-				}
-			} else {
-				os.Exit(ecode)
-			}
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		class := FAIL_CONFIG
+		if conn.Discovery != nil {
+			class = FAIL_BACKEND // the endpoints couldn't be discovered
 		}
+		return fail(E_UNKNOWN, class, "%v", err)
+	}
+	ds, err := NewDatasource(backend, base)
+	if err != nil {
+		return fail(E_UNKNOWN, FAIL_CONFIG, "%v", err)
+	}
+	// identifies the check, e.g. for the default state file
+	checkid := fmt.Sprintf("%s %s %s %s", backend, base, window, strings.Join(targets, " "))
+	if statefile == "" {
+		statefile = StateFile(c.String("state-dir"), checkid)
+	}
 
-		// evaluate, print and exit
-		if nc > 0 {
-			nagios_result(E_CRITICAL)
+	// helper func, opens the state for features that keep some between runs, when first needed
+	var st *State
+	state := func() (*State, error) {
+		if st != nil {
+			return st, nil
 		}
-		if nw > 0 {
-			nagios_result(E_WARNING)
+		log.Debugf("Using state file %q", statefile)
+		// another run of the check holding the lock mustn't keep this one from answering in time
+		ctx, cancel := context.WithDeadline(parent, deadline)
+		defer cancel()
+		var err error
+		st, err = OpenState(ctx, statefile)
+		return st, err
+	}
+	defer func() {
+		if st != nil {
+			st.Close()
 		}
-		if no > 0 {
-			nagios_result(E_OK)
-		} else {
-			nagios_result(E_UNKNOWN)
+	}()
+	// helper func, bridges a failure to reach the backend with the last good evaluation, if requested
+	bridge := func(r *Result) *Result {
+		if grace == 0 {
+			return r
+		}
+		if _, err := state(); err != nil {
+			log.Warnf("Unable to read state file for --grace: %v", err)
+			return r
+		}
+		lg, err := LoadLastGood(st)
+		if err != nil {
+			log.Warnf("Unable to read state file for --grace: %v", err)
+			return r
+		}
+		if lg == nil {
+			return r
+		}
+		sr := lg.Stale(r, grace, exitCode)
+		if sr == nil {
+			return r
+		}
+		if c.Bool("quiet") {
+			sr.Long = ""
+		}
+		if c.Bool("no-perfdata") {
+			sr.Perf = nil
+		}
+		return sr
+	}
+	// helper func, opens or closes an incident when the check enters or leaves CRITICAL, if requested
+	escalate := func(status int, summary string, worst *Metric) {
+		if len(escalators) == 0 {
+			return
+		}
+		inc := &Incident{
+			Key:     dedupKey(chkname, checkid),
+			Check:   chkname,
+			Source:  eventSource(vars["host"]),
+			Summary: summary,
+			Labels:  labels,
+		}
+		if worst != nil {
+			gl := &GraphLinker{Base: base, Window: window}
+			inc.Metric, inc.Value, inc.Link = worst.Path, worst.Value, gl.Render(worst.Path)
+		}
+		if _, err := state(); err != nil {
+			log.Warnf("Unable to read state file, escalating regardless of the last run: %v", err)
+		}
+		if err := Escalate(st, escalators, inc, status); err != nil {
+			log.Errorf("Unable to escalate: %v", err)
 		}
-	case <-time.After(time.Second * time.Duration(tmout)):
-		fmt.Printf("%s: Timed out after %d seconds", S_CRITICAL, int(tmout))
-		os.Exit(E_CRITICAL)
 	}
-}
 
-func main() {
-	app := cli.NewApp()
-	app.Name = "check_graphite"
-	app.Version = VERSION
-	app.Author = "Odd E. Ebbesen"
-	app.Email = "odd.ebbesen@wirelesscar.com"
-	app.Usage = "Check Graphite values and alert in Nagios/op5"
+	ctx, cancel := context.WithTimeout(parent, time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	if budget != nil {
+		ctx = withBudget(ctx, budget)
+	}
+	if c.Bool("strict") {
+		ctx = withStrict(ctx)
+	}
 
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "hostname, H",
-			Value: DEF_ADR,
-			Usage: "Hostname or IP to check",
-		},
-		cli.IntFlag{
-			Name:  "port, p",
-			Value: DEF_PORT,
+	chRes := make(chan GraphiteResponse, 1) // buffered, so a late response doesn't block after a timeout
+
+	// run in parallell
+	go parse(ctx, ds, targets, window, chRes)
+	var chLong chan GraphiteResponse
+	if longwin != nil {
+		chLong = make(chan GraphiteResponse, 1)
+		go parse(ctx, ds, targets, *longwin, chLong)
+	}
+	var chGuard chan GraphiteResponse
+	if guard != nil {
+		chGuard = make(chan GraphiteResponse, 1)
+		go parse(ctx, ds, []string{guard.Target}, window, chGuard)
+	}
+
+	// helper func, saves the responses and what we made of them, if requested
+	record := func(r *Result) {
+		if conn.Tape == nil {
+			return
+		}
+		if err := conn.Tape.Save(r); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save recording: %v\n", err)
+		}
+	}
+
+	select {
+	case res := <-chRes:
+		var lres GraphiteResponse
+		if chLong != nil {
+			// both windows are needed, so wait for the other one as well
+			select {
+			case lres = <-chLong:
+			case <-ctx.Done():
+				lres = GraphiteResponse{Err: ctx.Err()}
+			}
+			if lres.RT > res.RT {
+				res.RT = lres.RT
+			}
+			if res.Err == nil {
+				res.Err = lres.Err
+			}
+			res.Skip += lres.Skip
+		}
+		if be, ok := res.Err.(*BudgetError); ok {
+			// not a problem with what we check, but with the check itself
+			r := fail(E_UNKNOWN, FAIL_BUDGET, "%s", be.Error())
+			r.RT = res.RT
+			record(r)
+			return r
+		}
+		if me, ok := res.Err.(*MalformedError); ok {
+			r := fail(E_UNKNOWN, FAIL_DATA, "%s", me.Error())
+			r.RT = res.RT
+			record(r)
+			return r
+		}
+		if res.Err != nil {
+			class, msg := FAIL_BACKEND, fmt.Sprintf("Error parsing result: %q", res.Err)
+			var ne net.Error
+			if ctx.Err() == context.DeadlineExceeded {
+				class, msg = FAIL_TIMEOUT, fmt.Sprintf("Timed out after %d seconds", int(tmout))
+			} else if ie, ok := res.Err.(*IdleError); ok {
+				class, msg = FAIL_TIMEOUT, ie.Error()
+			} else if errors.As(res.Err, &ne) && ne.Timeout() && conn.Timeout > 0 {
+				class, msg = FAIL_TIMEOUT, fmt.Sprintf("HTTP request timed out after %s, see --http-timeout", conn.Timeout)
+			}
+			r := fail(E_CRITICAL, class, "%s", msg)
+			r.RT = res.RT
+			record(r)
+			r = bridge(r)
+			escalate(r.Status, r.Summary, nil)
+			return r
+		}
+
+		// helper func, smooths and cuts down a copy of the series for the evaluator, so the
+		// detectors below see the raw datapoints
+		judged := func(ms Metrics) Metrics {
+			if smooth == nil && lastpts == nil {
+				return ms
+			}
+			ms = ms.Copy()
+			if smooth != nil {
+				smooth.Apply(ms)
+			}
+			if lastpts != nil {
+				lastpts.Apply(ms)
+			}
+			return ms
+		}
+		evms := judged(res.MS)
+		align := res.MS.LongestKey()
+		ev := evaluator.Evaluate(evms)
+		var lev *Evaluation
+		if longwin != nil {
+			lev = evaluator.Evaluate(judged(lres.MS))
+		}
+		// keep the values of each metric in the last runs, if requested, whatever the output shows of them
+		var hist *History
+		if n := c.Int("history"); n > 0 {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			hist, err = LoadHistory(st)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			hist.Update(evms, n)
+			if err := hist.Save(st); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to save state file: %v", err)
+			}
+		}
+		// columns next to each metric: its values in the last runs, and the shape of the problem within
+		// the window, if requested
+		var cols []map[string]string
+		if hist != nil {
+			col := make(map[string]string, len(hist.Values))
+			for path, vals := range hist.Values {
+				col[path] = sparkline(vals)
+			}
+			cols = append(cols, col)
+		}
+		if c.Bool("sparkline") {
+			offending := make(map[string]bool)
+			for _, m := range append(append(Metrics{}, ev.C...), ev.W...) {
+				offending[m.Path] = true
+			}
+			col := make(map[string]string)
+			for _, m := range res.MS {
+				if !offending[m.Path] {
+					continue
+				}
+				vals := make([]float64, len(m.Points))
+				for i, p := range m.Points {
+					vals[i] = p.Value
+				}
+				col[m.Path] = sparkline(vals)
+			}
+			cols = append(cols, col)
+		}
+		gl := &GraphLinker{Base: base, Window: window}
+		var lo string
+		if htmlout {
+			lo = html_output(ev.O, ev.W, ev.C, gl, c.Int("max-lines"), c.Bool("show-points"), cols...)
+		} else {
+			lo = long_output(ev.O, ev.W, ev.C, align, c.Int("max-lines"), c.Bool("show-points"))
+			for _, col := range cols {
+				lo = add_column(lo, col, align)
+			}
+			if c.Bool("graph-links") {
+				lo += graph_links(ev.C, gl, align)
+			}
+		}
+		if shown := len(ev.O) + len(ev.W) + len(ev.C); shown < len(res.MS) {
+			lo += fmt.Sprintf("(%d more metrics not shown, see --top)\n", len(res.MS)-shown)
+		}
+
+		// helper func, puts a section listing ms in front of the long output, as HTML if requested
+		section := func(title string, ms Metrics) {
+			var buf bytes.Buffer
+			if htmlout {
+				html_section(&buf, title+":", ms, gl, c.Int("max-lines"), c.Bool("show-points"))
+			} else {
+				fmt.Fprintf(&buf, "===> %s:\n", title)
+				ms.Dump(&buf, align, c.Bool("show-points"))
+				fmt.Fprintf(&buf, "\n")
+			}
+			lo = buf.String() + lo
+		}
+
+		// find series we haven't seen before, if requested
+		nm := Metrics{}
+		if alertnew {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			ss, found, err := LoadSeenSeries(st)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			nm = ss.Update(res.MS, forget)
+			if err := ss.Save(st); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to save state file: %v", err)
+			}
+			if !found {
+				// first run, so everything is new. Just record the baseline.
+				nm = Metrics{}
+			}
+			if len(nm) > 0 {
+				section("New metrics", nm)
+			}
+		}
+
+		nn := len(nm)
+		log.Debugf("#n: %d\n", nn)
+
+		// find series that stopped changing, if requested
+		flat := Metrics{}
+		if flatdur > 0 {
+			flat = Flatlined(res.MS, flatdur)
+			if len(flat) > 0 {
+				section("Flatlined metrics, unchanged for "+c.String("flatline"), flat)
+			}
+		}
+
+		// find series with datapoints missing, if requested
+		gappy := Metrics{}
+		var gapmsg string
+		if gapstep > 0 {
+			var worst *Metric
+			var worstN int
+			gappy, worst, worstN = Gaps(res.MS, gapstep, c.Int("max-gap"))
+			if len(gappy) > 0 {
+				gapmsg = fmt.Sprintf("%d metrics missing more than %d points in a row, at most %d in %s",
+					len(gappy), c.Int("max-gap"), worstN, worst.Path)
+				section("Metrics with gaps", gappy)
+			}
+		}
+
+		// find series jumping too much from one datapoint to the next, if requested
+		var spikew, spikec Metrics
+		var spike float64
+		if spikewarn > 0 || spikecrit > 0 {
+			spikew, spikec, spike = Spikes(res.MS, spikewarn, spikecrit)
+			if len(spikew)+len(spikec) > 0 {
+				section("Metrics with spikes", append(append(Metrics{}, spikec...), spikew...))
+			}
+		}
+
+		// show how the offenders changed since the previous run, if requested
+		var trend *Trend
+		if c.Bool("trend") || c.Bool("trend-perf") {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			var found bool
+			trend, found, err = LoadTrend(st)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			if found && c.Bool("trend") {
+				cond := c.String("if-warning")
+				if cond == "" {
+					cond = c.String("if")
+				}
+				tlo := trend_output(append(append(Metrics{}, ev.C...), ev.W...), trend.Values, cond, align)
+				if htmlout && tlo != "" {
+					tlo = "<pre>" + html.EscapeString(tlo) + "</pre>\n"
+				}
+				lo = tlo + lo
+			}
+		}
+
+		status := ev.Status
+		msg := ev.Summary
+		// alert only if the long window breaches as well, if requested
+		if lev != nil && status != E_UNKNOWN {
+			if lev.Status < status {
+				status = lev.Status
+			}
+			msg += fmt.Sprintf(" (%s over %s: %s)", statusText(lev.Status), longwin, lev.Summary)
+		}
+		if len(res.MS) == 0 && len(res.Null) > 0 {
+			// the series are there, but whatever feeds them has stopped
+			status = nullstatus
+			msg = fmt.Sprintf("%d series matched, but all their values within %s range are null", len(res.Null), window)
+			lo = "===> Series without values:\n" + strings.Join(res.Null, "\n") + "\n\n" + lo
+		} else if len(res.MS) == 0 {
+			//msg = fmt.Sprintf("There's something strange in your neighbourhood, who ya gonna call?")
+			status = nomatchstatus
+			msg = fmt.Sprintf("No series matched within %s range, check the metric path", window)
+		} else if nn > 0 {
+			if status == E_OK {
+				// only new metrics get us here, so the values stay those of the OK bucket
+				status = E_WARNING
+				msg = fmt.Sprintf("%d new metrics appeared", nn)
+			} else {
+				msg += fmt.Sprintf(", %d new metrics", nn)
+			}
+		}
+		if len(res.MS) > 0 && len(flat) > 0 {
+			if status == E_OK {
+				msg = fmt.Sprintf("%d metrics flatlined for %s", len(flat), c.String("flatline"))
+			} else {
+				msg += fmt.Sprintf(", %d metrics flatlined", len(flat))
+			}
+			if status < flatstatus {
+				status = flatstatus // but not UNKNOWN
+			}
+		}
+		if len(res.MS) > 0 && len(spikew)+len(spikec) > 0 {
+			spikestatus, limit, n := E_WARNING, spikewarn, len(spikew)
+			if len(spikec) > 0 {
+				spikestatus, limit, n = E_CRITICAL, spikecrit, len(spikec)
+			}
+			spikemsg := fmt.Sprintf("%d metrics jumped more than %.02f between datapoints, at most %.02f", n, limit, spike)
+			if status == E_OK {
+				msg = spikemsg
+			} else {
+				msg += ", " + spikemsg
+			}
+			if spikestatus > status {
+				status = spikestatus
+			}
+		}
+		if len(res.MS) > 0 && len(gappy) > 0 {
+			if status == E_OK {
+				status = E_WARNING
+				msg = gapmsg
+			} else {
+				msg += ", " + gapmsg
+			}
+		}
+		// hold back alerts, from the thresholds and the detectors above, until they are seen often enough, if requested
+		if occur != nil && len(res.MS) > 0 {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			var note string
+			status, note, err = occur.Filter(st, status)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			msg += note
+		}
+		// and until breached in enough runs in a row, if requested
+		if softretries > 1 && len(res.MS) > 0 {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			var note string
+			status, note, err = SoftRetries(st, softretries, status)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			msg += note
+		}
+
+		// alert on the response time of the backend as well, if requested
+		if status != E_UNKNOWN {
+			if rtcrit > 0 && res.RT > rtcrit && status < E_CRITICAL {
+				status = E_CRITICAL
+				msg += fmt.Sprintf(", response time %.3fs above the critical threshold of %.3fs", res.RT, rtcrit)
+			} else if rtwarn > 0 && res.RT > rtwarn && status < E_WARNING {
+				status = E_WARNING
+				msg += fmt.Sprintf(", response time %.3fs above the warning threshold of %.3fs", res.RT, rtwarn)
+			}
+		}
+
+		// warn about the certificate of the backend running out, if requested
+		if certdays > 0 && res.Cert != nil {
+			expiring, when := certExpiry(res.Cert, certdays)
+			if expiring {
+				if status == E_OK {
+					status = E_WARNING
+				}
+				msg += ", " + when
+			}
+			lo += when + "\n"
+		}
+
+		// no alerts while the guard metric says so, if requested
+		if guard != nil && status != E_OK {
+			var gres GraphiteResponse
+			select {
+			case gres = <-chGuard:
+			case <-ctx.Done():
+				gres.Err = ctx.Err()
+			}
+			if gres.Err != nil {
+				log.Warnf("Unable to check the guard metric: %v", gres.Err)
+				lo += fmt.Sprintf("Unable to check the guard metric %s: %v\n", guard.Target, gres.Err)
+			} else if holds, why := guard.Holds(gres.MS); holds {
+				msg += fmt.Sprintf(" (%s suppressed, %s)", statusText(status), why)
+				status = suppressed
+			}
+		}
+
+		// no alerts during downtime, if requested
+		if silencer != nil && status != E_OK {
+			reason, err := silencer.Silenced(dthost, chkname)
+			if err != nil {
+				log.Warnf("Unable to check for downtime: %v", err)
+				lo += fmt.Sprintf("Unable to check for downtime: %v\n", err)
+			} else if reason != "" {
+				msg += fmt.Sprintf(" (%s silenced, %s)", statusText(status), reason)
+				status = E_OK
+			}
+		}
+
+		// without thresholds for the response time, the timeout is the closest thing
+		rt_warn, rt_crit := tmout/2, tmout
+		if rtwarn > 0 {
+			rt_warn = rtwarn
+		}
+		if rtcrit > 0 {
+			rt_crit = rtcrit
+		}
+		perf := append(ev.Perf, PerfData{Label: "response_time", Value: res.RT, UOM: "s",
+			Warn: fmt.Sprintf("%f", rt_warn), Crit: fmt.Sprintf("%f", rt_crit)})
+		if spikewarn > 0 || spikecrit > 0 {
+			sp := PerfData{Label: "largest_jump", Value: spike, Unknown: len(res.MS) == 0}
+			if spikewarn > 0 {
+				sp.Warn = fmt.Sprintf("%f", spikewarn)
+			}
+			if spikecrit > 0 {
+				sp.Crit = fmt.Sprintf("%f", spikecrit)
+			}
+			perf = append(perf, sp)
+		}
+		if trend != nil {
+			// the change of the value in perfdata, where that is one
+			if c.Bool("trend-perf") && len(ev.Perf) > 0 && ev.Perf[0].Label == "value" {
+				delta := PerfData{Label: "value_delta", Unknown: trend.Value == nil || ev.Perf[0].Unknown}
+				if !delta.Unknown {
+					delta.Value = ev.Perf[0].Value - *trend.Value
+				}
+				perf = append(perf, delta)
+			}
+			trend.Values = make(map[string]float64, len(evms))
+			for _, m := range evms {
+				trend.Values[m.Path] = m.Value
+			}
+			trend.Value = nil
+			if len(ev.Perf) > 0 && ev.Perf[0].Label == "value" && !ev.Perf[0].Unknown {
+				v := ev.Perf[0].Value
+				trend.Value = &v
+			}
+			if err := trend.Save(st); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to save state file: %v", err)
+			}
+		}
+		// only when there's something to tell, so the perfdata of everyone else stays as it was
+		if res.Skip > 0 {
+			perf = append(perf, PerfData{Label: "skipped_rows", Value: float64(res.Skip), Count: true})
+			lo += fmt.Sprintf("Skipped %d malformed rows of the responses, see --strict\n", res.Skip)
+		}
+		if res.Timing != nil {
+			log.Debugf("Timing: %s", res.Timing)
+			if timing {
+				perf = append(perf, res.Timing.Perf()...)
+				lo += fmt.Sprintf("Timing of the slowest request: %s\n", res.Timing)
+			}
+		}
+		// how to reproduce the check, if requested
+		if c.Bool("footer") && len(res.Requests) > 0 {
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "===> Requests:\n")
+			for _, t := range res.Requests {
+				fmt.Fprintf(&buf, "%s\n", t.Footer())
+			}
+			if htmlout {
+				lo += "<pre>" + html.EscapeString(buf.String()) + "</pre>\n"
+			} else {
+				lo += buf.String()
+			}
+		}
+		relabel(perf, perfnames, c.String("perf-prefix"))
+		var perflong []PerfData
+		if c.Bool("perf-metrics") {
+			for _, b := range buckets(ev.O, ev.W, ev.C) {
+				for _, m := range b.MS {
+					perflong = append(perflong, PerfData{Label: m.Path, Value: m.Value, Warn: ev.Warn, Crit: ev.Crit})
+				}
+			}
+			relabel(perflong, perfnames, c.String("perf-prefix"))
+		}
+
+		// create and update services in op5 for each metric, if requested
+		if op5.URL != "" {
+			created, err := op5.Provision(ev.O, ev.W, ev.C, ev.Warn, ev.Crit)
+			if err != nil {
+				return fail(E_UNKNOWN, FAIL_OP5, "Unable to update services in op5: %v", err)
+			}
+			lo += fmt.Sprintf("Submitted %d passive results to op5 host %q (%d services created)\n", len(res.MS), op5.Host, created)
+		}
+
+		// remember this evaluation, to fall back on if the next runs can't reach the backend
+		if grace > 0 {
+			if _, err := state(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to read state file: %v", err)
+			}
+			lg := &LastGood{Time: time.Now(), Status: status, Summary: msg, Long: lo, Perf: perf}
+			if err := lg.Save(st); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to save state file: %v", err)
+			}
+		}
+		if ms := append(append(append(Metrics{}, ev.C...), ev.W...), ev.O...); len(ms) > 0 {
+			escalate(status, msg, ms[0])
+		} else {
+			escalate(status, msg, nil)
+		}
+		if st != nil {
+			if err := st.Close(); err != nil {
+				return fail(E_UNKNOWN, FAIL_STATE, "Unable to save state file: %v", err)
+			}
+		}
+
+		r := &Result{
+			Name:     chkname,
+			Host:     vars["host"],
+			Status:   status,
+			ExitCode: exitCode(status),
+			Summary:  msg,
+			Long:     lo,
+			Perf:     perf,
+			PerfLong: perflong,
+			O:        ev.O,
+			W:        ev.W,
+			C:        ev.C,
+			New:      nm,
+			Warn:     ev.Warn,
+			Crit:     ev.Crit,
+			RT:       res.RT,
+			Labels:   labels,
+		}
+		record(r)
+		if conn.Tape != nil {
+			r.Long += conn.Tape.Note()
+		}
+		if c.Bool("quiet") {
+			r.Long = ""
+		}
+		if c.Bool("no-perfdata") {
+			r.Perf = nil
+			r.PerfLong = nil
+		}
+		return r
+	case <-ctx.Done():
+		msg := fmt.Sprintf("Timed out after %d seconds", int(tmout))
+		r := fail(E_CRITICAL, FAIL_TIMEOUT, "%s", msg)
+		record(r)
+		r = bridge(r)
+		escalate(r.Status, r.Summary, nil)
+		return r
+	}
+}
+
+// run_check() runs the check given on the command line, prints the result and exits with its status
+func run_check(c *cli.Context) {
+	formatter, err := GetFormatter(c.String("output"))
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+
+	r := check(c)
+
+	// mail the result when it isn't OK, for running from cron without a monitoring server, if requested
+	if to := c.StringSlice("mail-to"); len(to) > 0 && r.Status != E_OK {
+		m := NewMailer(c.String("smtp-server"), c.String("smtp-user"), c.String("smtp-password"), c.String("mail-from"), to)
+		if err := m.Send(mailSubject(r), formatter.Format(r)); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to mail the result: %v\n", err)
+		}
+	}
+
+	// send the result to a trap receiver, if requested
+	if c.String("snmp-trap") != "" {
+		trap, err := NewSNMPTrap(c)
+		if err == nil {
+			err = trap.Send(r)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to send SNMP trap: %v\n", err)
+		}
+	}
+
+	// each metric as its own service, if requested
+	if c.Bool("multi") && len(r.Metrics()) > 0 {
+		out, ecode := multi_output(r.O, r.W, r.C, r.Warn, r.Crit, r.RT)
+		fmt.Print(out)
+		exit(ecode)
+	}
+
+	out := formatter.Format(r)
+	if c.String("output") == OUT_NAGIOS && !c.Bool("no-color") && useColor() {
+		out = colorize(out)
+	}
+	fmt.Print(out)
+	exit(r.ExitCode)
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "check_graphite"
+	app.Version = VERSION
+	app.Author = "Odd E. Ebbesen"
+	app.Email = "odd.ebbesen@wirelesscar.com"
+	app.Usage = "Check Graphite values and alert in Nagios/op5"
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "hostname, H",
+			Value: DEF_ADR,
+			Usage: "Hostname or IP to check",
+		},
+		cli.IntFlag{
+			Name:  "port, p",
+			Value: DEF_PORT,
 			Usage: "TCP port",
 		},
 		cli.StringFlag{
@@ -519,33 +1568,313 @@ func main() {
 			//Value: fmt.Sprintf("%s://%s:%d", DEF_PROT, DEF_ADR, DEF_PORT),
 			Usage: "URL prefix to Graphite in the form of PROT://ADR:PORT/PREFIX",
 		},
+		cli.StringFlag{
+			Name:  "grafana-datasource",
+			Usage: "Query through the Grafana datasource proxy for this datasource ID or UID, with the Grafana address as host or URL prefix",
+		},
+		cli.StringFlag{
+			Name:   "grafana-token",
+			Usage:  "Grafana API token to use with --grafana-datasource",
+			EnvVar: "CHECK_GRAPHITE_GRAFANA_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "dialect",
+			Value: DL_GRAPHITE,
+			Usage: "Graphite API implementation, to handle their differences (options: graphite, carbonapi, victoriametrics)",
+		},
+		cli.StringFlag{
+			Name:  "backend, B",
+			Value: BE_GRAPHITE,
+			Usage: "Backend to query (options: " + strings.Join(DatasourceNames(), ", ") + "). For opentsdb, the metric path is a query like avg:sys.cpu{host=*}",
+		},
 		cli.StringFlag{
 			Name:  "metricpath, m",
 			Usage: "Metric path or Graphite function",
 		},
+		cli.StringFlag{
+			Name:  "targets-file, f",
+			Usage: "File with one metric path or Graphite function per line (\"-\" for stdin), evaluated together with --metricpath",
+		},
+		cli.StringFlag{
+			Name:  "transform-null",
+			Usage: "Replace missing datapoints with this value, by wrapping targets in transformNull()",
+		},
+		cli.IntFlag{
+			Name:  "keep-last-value",
+			Usage: "Replace up to N missing datapoints in a row with the last value before them, by wrapping targets in keepLastValue(). 0 for no limit.",
+		},
+		cli.StringFlag{
+			Name:  "summarize",
+			Usage: "Summarize datapoints into buckets server side before evaluating them, in the form INTERVAL[,FUNC], e.g. 10min,avg, by wrapping targets in summarize()",
+		},
+		cli.Float64Flag{
+			Name:  "http-timeout",
+			Usage: "Number of seconds before each HTTP request, reading the response included, is given up, while --timeout limits the whole check (default: no limit but --timeout)",
+		},
+		cli.StringFlag{
+			Name:  "http-user",
+			Usage: "User for basic authentication to the backend",
+		},
+		cli.StringFlag{
+			Name:   "http-password",
+			Usage:  "Password for basic authentication to the backend",
+			EnvVar: "CHECK_GRAPHITE_HTTP_PASSWORD",
+		},
+		cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "Extra header for all requests to the backend, as \"Name: value\", e.g. for auth by a proxy. Can be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  "tls-verify",
+			Usage: "Verify the certificate of the backend over https, which isn't done by default",
+		},
+		cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "PEM file with the CAs to verify the certificate of the backend against, implies --tls-verify",
+		},
+		cli.StringFlag{
+			Name:  "client-cert",
+			Usage: "PEM file with a client certificate to present to the backend, and its key unless --client-key is given",
+		},
+		cli.StringFlag{
+			Name:  "client-key",
+			Usage: "PEM file with the key of --client-cert",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "Keep responses that come with an ETag or Last-Modified in this directory, and reuse them when the backend says they're unchanged",
+		},
+		cli.Float64Flag{
+			Name:  "idle-timeout",
+			Usage: "Number of seconds without any bytes of a response arriving before giving up on it, for backends that stall halfway (default: no limit)",
+		},
+		cli.IntFlag{
+			Name:  "max-inflight",
+			Usage: "Max number of requests to the backend at the same time, the rest are queued (default: no limit)",
+		},
+		cli.Float64Flag{
+			Name:  "max-rps",
+			Usage: "Max number of requests to the backend per second, the rest are delayed (default: no limit)",
+		},
+		cli.StringFlag{
+			Name:  "source-ip",
+			Usage: "Connect to the backend from this local IP address, or from the address of this network interface",
+		},
+		cli.StringFlag{
+			Name:  "srv",
+			Usage: "Find the backend in the DNS SRV records of this name, e.g. _graphite._tcp.example.com, failing over between them by priority. Overrides --hostname and --port.",
+		},
+		cli.StringFlag{
+			Name:  "consul-service",
+			Usage: "Find the backend as the healthy instances of this service in Consul, spreading the load and failing over between them. Overrides --hostname, --port and --srv.",
+		},
+		cli.StringFlag{
+			Name:   "consul-addr",
+			Value:  DEF_CONSUL_ADDR,
+			Usage:  "Address of the Consul agent, for --consul-service",
+			EnvVar: "CONSUL_HTTP_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "consul-token",
+			Usage:  "Consul ACL token, for --consul-service",
+			EnvVar: "CONSUL_HTTP_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "k8s-service",
+			Usage: "Find the backend as this Kubernetes service, in the form NAMESPACE/NAME[:PORT], from the cluster DNS. Overrides --hostname and --port.",
+		},
+		cli.BoolFlag{
+			Name:  "k8s-proxy",
+			Usage: "Reach --k8s-service through the API server proxy, found from KUBERNETES_SERVICE_HOST, instead of directly. Implies --k8s-token.",
+		},
+		cli.BoolFlag{
+			Name:  "k8s-token",
+			Usage: "Authenticate with the token of the Kubernetes service account mounted in the pod",
+		},
+		cli.StringSliceFlag{
+			Name:  "resolve",
+			Usage: "Connect to ADDR instead of looking up HOST, in the form HOST:ADDR or HOST:PORT:ADDR. Can be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "var, V",
+			Usage: "Variable in the form key=value, replacing {key} in metric paths. Can be repeated. {env:NAME} is replaced by environment variables.",
+		},
 		cli.StringFlag{
 			Name:  "timeperiod, T",
 			Value: DEF_PERIOD,
 			Usage: "Timeperiod for selection",
 		},
+		cli.StringFlag{
+			Name:  "no-match-status",
+			Value: S_UNKNOWN,
+			Usage: "Status when no series match the metric path at all",
+		},
+		cli.StringFlag{
+			Name:  "all-null-status",
+			Value: S_UNKNOWN,
+			Usage: "Status when series match the metric path, but all their values in the time period are null",
+		},
+		cli.StringFlag{
+			Name:  "suppress-if",
+			Usage: "No alerts while any metric of a guard target meets a condition, as TARGET:COND:VALUE, e.g. ops.maintenance_mode:gt:0",
+		},
+		cli.StringFlag{
+			Name:  "suppress-status",
+			Value: S_OK,
+			Usage: "Status to report instead of an alert suppressed by --suppress-if (options: " + S_OK + ", " + S_UNKNOWN + ")",
+		},
+		cli.StringFlag{
+			Name:  "long-window",
+			Usage: "Also judge the metrics over this longer time period, like 1h, and only alert when both breach, for multi-window burn rate alerts",
+		},
+		cli.Float64Flag{
+			Name:  "rt-warning",
+			Usage: "Response time of the backend in seconds to result in at least WARNING status (default: no alert)",
+		},
+		cli.Float64Flag{
+			Name:  "rt-critical",
+			Usage: "Response time of the backend in seconds to result in CRITICAL status (default: no alert)",
+		},
+		cli.IntFlag{
+			Name:  "cert-expiry",
+			Usage: "WARNING if the TLS certificate of the backend expires within this many days, when using https (default: no check)",
+		},
+		cli.StringFlag{
+			Name:  "offset",
+			Usage: "Shift the time period this far back from now, e.g. 5min to leave out the newest, still incomplete datapoints",
+		},
+		cli.StringFlag{
+			Name:  "aggregate",
+			Value: AGG_AVG,
+			Usage: "How to sum up the values of the metrics in the status line and perfdata (options: " + AGG_AVG + ", " + AGG_MEDIAN + ")",
+		},
+		cli.StringFlag{
+			Name:  "aggregate-across",
+			Usage: "Judge a percentile of the values of all metrics against the thresholds, like p95, instead of each metric",
+		},
+		cli.StringFlag{
+			Name:  "smooth",
+			Usage: "Smooth each series before judging it, with " + SM_EWMA + ":ALPHA for an exponentially weighted moving average, or " + SM_SMA + ":N for the average of the last N datapoints at each point",
+		},
+		cli.StringFlag{
+			Name:  "last-points",
+			Usage: "Judge each series on its last N datapoints only, whatever the time period, in the form N[,FUNC] where FUNC makes one value of them (options: " + strings.Join(ReducerNames(), ", ") + ", default: avg)",
+		},
 		cli.Float64Flag{
 			Name:  "warning, w",
-			Usage: "Value to result in WARNING status",
+			Usage: "Value to result in WARNING status (may be left out if --critical is given)",
 		},
 		cli.Float64Flag{
 			Name:  "critical, c",
-			Usage: "Value to result in CRITICAL status",
+			Usage: "Value to result in CRITICAL status (may be left out if --warning is given)",
+		},
+		cli.Float64Flag{
+			Name:  "low-warning",
+			Usage: "Lower bound resulting in WARNING status for values below it, in addition to --warning",
+		},
+		cli.Float64Flag{
+			Name:  "low-critical",
+			Usage: "Lower bound resulting in CRITICAL status for values below it, in addition to --critical",
+		},
+		cli.Float64Flag{
+			Name:  "warning-pct",
+			Usage: "Only result in WARNING status if more than this percentage of metrics are above/below the warning threshold",
+		},
+		cli.Float64Flag{
+			Name:  "critical-pct",
+			Usage: "Only result in CRITICAL status if more than this percentage of metrics are above/below the critical threshold",
+		},
+		cli.IntFlag{
+			Name:  "warning-count",
+			Value: 1,
+			Usage: "Only result in WARNING status if at least this many metrics are above/below the warning threshold",
+		},
+		cli.IntFlag{
+			Name:  "critical-count",
+			Value: 1,
+			Usage: "Only result in CRITICAL status if at least this many metrics are above/below the critical threshold",
 		},
 		cli.StringFlag{
 			Name:  "if, i",
 			Value: CMP_GT,
 			Usage: "Set whether to trigger on values being less than (lt), less than or equal (le), greater than or equal (ge) or greater than (gt) thresholds",
 		},
+		cli.StringFlag{
+			Name:  "if-warning",
+			Usage: "Same as --if, but only for the warning threshold (default: same as --if)",
+		},
+		cli.StringFlag{
+			Name:  "if-critical",
+			Usage: "Same as --if, but only for the critical threshold (default: same as --if)",
+		},
+		cli.StringFlag{
+			Name:  "evaluator",
+			Value: EV_THRESHOLD,
+			Usage: "How to decide the state from the metrics (options: " + strings.Join(EvaluatorNames(), ", ") + ")",
+		},
+		cli.Float64Flag{
+			Name:  "expect",
+			Usage: "CRITICAL if the value of any metric is not this, implies --evaluator " + EV_EXPECT,
+		},
+		cli.Float64Flag{
+			Name:  "tolerance",
+			Usage: "How far from the --expect value a value may be",
+		},
+		cli.StringFlag{
+			Name:  "flatline",
+			Usage: "Alert if the value of any metric hasn't changed at all for this long, e.g. 30min (default: no check)",
+		},
+		cli.StringFlag{
+			Name:  "flatline-status",
+			Value: S_WARNING,
+			Usage: "Status for metrics found by --flatline, WARNING like gaps, or CRITICAL for heartbeats that must never stall",
+		},
+		cli.Float64Flag{
+			Name:  "spike-warning",
+			Usage: "WARNING if the value of any metric changes more than this from one datapoint to the next (default: no check)",
+		},
+		cli.Float64Flag{
+			Name:  "spike-critical",
+			Usage: "CRITICAL if the value of any metric changes more than this from one datapoint to the next (default: no check)",
+		},
+		cli.StringFlag{
+			Name:  "gap-step",
+			Usage: "WARNING if more than --max-gap datapoints in a row are missing within any series, with datapoints this far apart, e.g. 1min (default: no check)",
+		},
+		cli.IntFlag{
+			Name:  "max-gap",
+			Usage: "How many datapoints in a row may be missing, for --gap-step",
+		},
+		cli.Float64Flag{
+			Name:  "mad-warning",
+			Usage: "WARNING if the value of any metric is more than this many median absolute deviations from the median of its series, for --evaluator " + EV_MAD,
+		},
+		cli.Float64Flag{
+			Name:  "mad-critical",
+			Usage: "CRITICAL if the value of any metric is more than this many median absolute deviations from the median of its series, for --evaluator " + EV_MAD,
+		},
+		cli.StringFlag{
+			Name:  "forecast-horizon",
+			Usage: "Also judge each metric by the value a straight line fitted to its series reaches this far ahead, e.g. 4h, implies --evaluator " + EV_FORECAST,
+		},
+		cli.StringSliceFlag{
+			Name:  "band",
+			Usage: "CRITICAL if the value of any metric is outside the band for the time of its latest datapoint, as DAYS/HOURS=LOW:HIGH, e.g. mon-fri/8-18=100:500, where the first band that applies counts, implies --evaluator " + EV_SEASONAL,
+		},
+		cli.IntFlag{
+			Name:  "max-resets",
+			Usage: "How many times a counter may go down within the time period, for --evaluator " + EV_COUNTER,
+		},
 		cli.Float64Flag{
 			Name:  "timeout, t",
 			Value: DEF_TMOUT,
 			Usage: "Number of seconds before connection times out",
 		},
+		cli.StringFlag{
+			Name:   "defaults",
+			Usage:  "YAML file with defaults for flags, instead of " + DEF_DEFAULTS_ETC + " and ~/.config/" + DEF_DEFAULTS_NAME,
+			EnvVar: "CHECK_GRAPHITE_DEFAULTS",
+		},
 		cli.StringFlag{
 			Name:  "log-level, l",
 			Value: "fatal",
@@ -556,6 +1885,22 @@ func main() {
 			Usage:  "Run in debug mode",
 			EnvVar: "CHECK_GRAPHITE_DEBUG",
 		},
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "Write profiles when exiting, as a comma separated list of cpu:path and mem:path",
+		},
+		cli.BoolFlag{
+			Name:  "timing",
+			Usage: "Break the response time down into DNS, connect, TLS, TTFB, download and parse, in long output and perfdata",
+		},
+		cli.StringFlag{
+			Name:  "max-memory",
+			Usage: "Give UNKNOWN instead of evaluating when the responses and parsed metrics take more than this, e.g. 64M",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Give UNKNOWN when any row of a response is malformed, instead of skipping it",
+		},
 		cli.BoolFlag{
 			Name:  "unknown-ok",
 			Usage: "Exit with status OK when no values found (otherwise UNKNOWN)",
@@ -568,21 +1913,624 @@ func main() {
 			Name:  "unknown-critical",
 			Usage: "Exit with status CRITICAL when no values found (otherwise UNKNOWN)",
 		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Value: OUT_NAGIOS,
+			Usage: "Output format (options: " + strings.Join(FormatterNames(), ", ") + ")",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "Don't color the output by state, which is otherwise done when it goes to a terminal, and not to Nagios",
+		},
+		cli.StringFlag{
+			Name:  "check-name",
+			Value: DEF_CHKNAME,
+			Usage: "Name of the check, for output formats that carry it",
+		},
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "Only show the N metrics most in breach of the thresholds in each state, and skip sorting the rest",
+		},
+		cli.BoolFlag{
+			Name:  "multi",
+			Usage: "Treat each metric as its own service, with check_multi compatible output",
+		},
+		cli.StringFlag{
+			Name:  "op5-api",
+			Usage: "URL to the op5 Monitor API (e.g. https://op5.example.com/api), to create a passive service for each metric and submit its result",
+		},
+		cli.StringFlag{
+			Name:  "op5-user",
+			Usage: "Username for the op5 API",
+		},
+		cli.StringFlag{
+			Name:   "op5-password",
+			Usage:  "Password for the op5 API",
+			EnvVar: "CHECK_GRAPHITE_OP5_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:  "op5-host",
+			Usage: "Host in op5 to add the services to (default: the value of --var host=...)",
+		},
+		cli.StringFlag{
+			Name:  "op5-template",
+			Value: DEF_OP5_TEMPLATE,
+			Usage: "Service template for services created in op5",
+		},
+		cli.StringFlag{
+			Name:  "op5-prefix",
+			Usage: "Prefix for the service description of services created in op5, which is otherwise the metric path",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Only output the status line with perfdata, without listing the metrics in long output",
+		},
+		cli.BoolFlag{
+			Name:  "output-html",
+			Usage: "Give the long output as HTML, for op5 extinfo pages, with each metric linked to its graph in Graphite",
+		},
+		cli.BoolFlag{
+			Name:  "show-points",
+			Usage: "Show the number of datapoints of each metric in the time period, and the age of the newest, in long output",
+		},
+		cli.StringFlag{
+			Name:   "pagerduty-key",
+			Usage:  "Routing key of a PagerDuty Events API v2 integration, to trigger an incident when the check enters CRITICAL and resolve it when it leaves",
+			EnvVar: "CHECK_GRAPHITE_PAGERDUTY_KEY",
+		},
+		cli.StringFlag{
+			Name:  "pagerduty-url",
+			Value: DEF_PAGERDUTY_URL,
+			Usage: "URL of the PagerDuty Events API v2",
+		},
+		cli.StringFlag{
+			Name:   "opsgenie-key",
+			Usage:  "API key of an OpsGenie integration, to create an alert when the check enters CRITICAL and close it when it leaves",
+			EnvVar: "CHECK_GRAPHITE_OPSGENIE_KEY",
+		},
+		cli.StringFlag{
+			Name:  "opsgenie-url",
+			Value: DEF_OPSGENIE_URL,
+			Usage: "URL of the OpsGenie API, e.g. https://api.eu.opsgenie.com",
+		},
+		cli.StringSliceFlag{
+			Name:  "mail-to",
+			Usage: "Mail the result to this address when it isn't OK, for running from cron without a monitoring server. Can be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "mail-from",
+			Usage: "Sender of the mails, check_graphite@<this host> if not given",
+		},
+		cli.StringFlag{
+			Name:  "smtp-server",
+			Value: DEF_SMTP_SERVER,
+			Usage: "SMTP server to send mails through, as host:port. STARTTLS is used if offered.",
+		},
+		cli.StringFlag{
+			Name:  "smtp-user",
+			Usage: "User for SMTP AUTH, none if not given",
+		},
+		cli.StringFlag{
+			Name:   "smtp-password",
+			Usage:  "Password for SMTP AUTH",
+			EnvVar: "CHECK_GRAPHITE_SMTP_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:  "snmp-trap",
+			Usage: "Send the result as an SNMP trap to this receiver, as host[:port]",
+		},
+		cli.StringFlag{
+			Name:  "snmp-version",
+			Value: DEF_SNMP_VERSION,
+			Usage: "SNMP version of the trap: 2c or 3",
+		},
+		cli.StringFlag{
+			Name:  "snmp-oid",
+			Value: DEF_SNMP_OID,
+			Usage: "OID of the trap, with the varbinds under it: .1 status code, .2 status, .3 check name, .4 summary, .5 host, .6 long output",
+		},
+		cli.StringFlag{
+			Name:   "snmp-community",
+			Value:  DEF_SNMP_COMMUNITY,
+			Usage:  "Community for SNMPv2c",
+			EnvVar: "CHECK_GRAPHITE_SNMP_COMMUNITY",
+		},
+		cli.StringFlag{
+			Name:  "snmp-user",
+			Usage: "User for SNMPv3",
+		},
+		cli.StringFlag{
+			Name:  "snmp-auth-protocol",
+			Value: "SHA",
+			Usage: "Authentication protocol for SNMPv3: MD5, SHA, SHA224, SHA256, SHA384 or SHA512",
+		},
+		cli.StringFlag{
+			Name:   "snmp-auth-password",
+			Usage:  "Authentication password for SNMPv3, none if not given",
+			EnvVar: "CHECK_GRAPHITE_SNMP_AUTH_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:  "snmp-priv-protocol",
+			Value: "AES",
+			Usage: "Privacy protocol for SNMPv3: DES, AES, AES192, AES256, AES192C or AES256C",
+		},
+		cli.StringFlag{
+			Name:   "snmp-priv-password",
+			Usage:  "Privacy password for SNMPv3, no encryption if not given",
+			EnvVar: "CHECK_GRAPHITE_SNMP_PRIV_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:  "snmp-engine-id",
+			Usage: "Engine ID for SNMPv3 in hex, for the receiver to know us by. Made from the name of this host if not given.",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "Label the result with key=value, appended to the status line and in JSON output, for routing alerts downstream. Can be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  "footer",
+			Usage: "List the URL (passwords redacted), HTTP status, response size and timing of each request at the end of long output, to reproduce the check",
+		},
+		cli.BoolFlag{
+			Name:  "graph-links",
+			Usage: "List the URL to a graph in Graphite of each metric in state CRITICAL in long output",
+		},
+		cli.BoolFlag{
+			Name:  "no-perfdata",
+			Usage: "Leave out perfdata, except with --multi, where each metric needs its own",
+		},
+		cli.BoolFlag{
+			Name:  "perf-metrics",
+			Usage: "Add perfdata for each metric, labeled by path, after the long output where Nagios and Icinga take more of it, so wide wildcards don't make the first line too long",
+		},
+		cli.StringSliceFlag{
+			Name:  "perf-label",
+			Usage: "Rename a perfdata item, in the form old=new, e.g. value=load. Can be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "perf-prefix",
+			Usage: "Prefix for the labels of all perfdata items, e.g. to tell checks apart in daemon mode",
+		},
+		cli.StringFlag{
+			Name:  "perf-min",
+			Usage: "Lowest value the metrics can possibly have, for the min field of perfdata, e.g. 0 for a percentage",
+		},
+		cli.StringFlag{
+			Name:  "perf-max",
+			Usage: "Highest value the metrics can possibly have, for the max field of perfdata, e.g. 100 for a percentage",
+		},
+		cli.IntFlag{
+			Name:  "max-lines",
+			Usage: "List at most N metrics per state in long output (default: all)",
+		},
+		cli.StringFlag{
+			Name:  "occurrences",
+			Usage: "Only alert when the check is WARNING or CRITICAL in M of the last K runs, in the form M/K, to quiet noisy metrics",
+		},
+		cli.BoolFlag{
+			Name:  "sparkline",
+			Usage: "Show the datapoints within the time period as a sparkline next to each metric in state WARNING or CRITICAL in long output",
+		},
+		cli.IntFlag{
+			Name:  "history",
+			Usage: "Keep the values of each metric in the last N runs, and show them as a sparkline next to it in long output",
+		},
+		cli.BoolFlag{
+			Name:  "trend",
+			Usage: "Show how the values of metrics in state WARNING or CRITICAL changed since the previous run, and if for the better or worse",
+		},
+		cli.BoolFlag{
+			Name:  "trend-perf",
+			Usage: "Add the change of the value since the previous run to the perfdata, as value_delta",
+		},
+		cli.IntFlag{
+			Name:  "soft-retries",
+			Usage: "Only alert when the check is WARNING or CRITICAL in N runs in a row, like soft states in Nagios, for schedulers like cron that lack them",
+		},
+		cli.StringFlag{
+			Name:  "downtime-check",
+			Usage: "Ask the monitoring system (op5 or icinga2) if the host or service (by --check-name) is in downtime or acknowledged, and if so exit with OK and a note instead of alerting",
+		},
+		cli.StringFlag{
+			Name:  "downtime-api",
+			Usage: "URL of the API for --downtime-check, e.g. https://op5.example.com/api or https://icinga.example.com:5665",
+		},
+		cli.StringFlag{
+			Name:  "downtime-user",
+			Usage: "User for --downtime-api",
+		},
+		cli.StringFlag{
+			Name:   "downtime-password",
+			Usage:  "Password for --downtime-api",
+			EnvVar: "CHECK_GRAPHITE_DOWNTIME_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:  "alert-on-new",
+			Usage: "Exit with at least status WARNING when metrics show up that were not seen in earlier runs",
+		},
+		cli.StringFlag{
+			Name:  "forget-series",
+			Value: DEF_FORGET_SERIES,
+			Usage: "Forget series for --alert-on-new that haven't been seen for this long, so they're new again should they come back",
+		},
+		cli.StringFlag{
+			Name:  "state-file, S",
+			Usage: "File to keep state between runs in, overriding --state-dir",
+		},
+		cli.StringFlag{
+			Name:  "grace",
+			Usage: "When the backend can't be reached or times out, give the last good result instead, marked as stale, if it's no older than this, e.g. 5m",
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Value: defaultStateDir(),
+			Usage: "Directory to keep state between runs in, one file per check, created only accessible to us",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "Save the raw responses from the backend and the result to this file, for later --replay",
+		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "Evaluate the responses saved with --record instead of asking the backend. Thresholds may differ from the recorded run",
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
+		if c.Args().First() == "check" {
+			return nil // the flags may be on both sides of it, so leave them to the check subcommand
+		}
+		files := defaultsFiles()
+		if file := c.String("defaults"); file != "" {
+			files = []string{file}
+		}
+		var err error
+		if defaults, err = LoadDefaults(files); err == nil {
+			err = applyDefaults(c, defaults)
+		}
+		if err != nil {
+			fmt.Printf("%s: Unable to apply defaults: %v\n", S_UNKNOWN, err)
+			exit(E_UNKNOWN)
+		}
 		log.SetOutput(os.Stdout)
 		level, err := log.ParseLevel(c.String("log-level"))
 		if err != nil {
-			log.Fatal(err.Error())
+			fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+			exit(E_UNKNOWN)
 		}
 		log.SetLevel(level)
 		if !c.IsSet("log-level") && !c.IsSet("l") && c.Bool("debug") {
 			log.SetLevel(log.DebugLevel)
 		}
+		if spec := c.String("profile"); spec != "" {
+			if err := startProfile(spec); err != nil {
+				fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+		}
+		if ds := c.String("grafana-datasource"); ds != "" {
+			conn.ProxyPath = grafanaProxyPath(ds)
+		}
+		conn.Dialect = validDialect(c.String("dialect"))
+		if n := c.Int("max-inflight"); n > 0 {
+			conn.Inflight = make(chan struct{}, n)
+		}
+		conn.Limiter.SetRate(c.Float64("max-rps"))
+		if t := c.Float64("http-timeout"); t < 0 {
+			fmt.Printf("%s: Invalid --http-timeout %g, should be above 0\n", S_UNKNOWN, t)
+			exit(E_UNKNOWN)
+		} else {
+			conn.Timeout = time.Duration(t * float64(time.Second))
+		}
+		if dir := c.String("cache-dir"); dir != "" {
+			conn.Cache = &ResponseCache{Dir: dir}
+		}
+		if t := c.Float64("idle-timeout"); t < 0 {
+			fmt.Printf("%s: Invalid --idle-timeout %g, should be above 0\n", S_UNKNOWN, t)
+			exit(E_UNKNOWN)
+		} else {
+			conn.IdleTimeout = time.Duration(t * float64(time.Second))
+		}
+		if specs := c.StringSlice("resolve"); len(specs) > 0 {
+			res, err := parseResolve(specs)
+			if err != nil {
+				fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			conn.Resolve = res
+		}
+		if spec := c.String("source-ip"); spec != "" {
+			addr, err := parseSourceIP(spec)
+			if err != nil {
+				fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			conn.SourceIP = addr
+		}
+		if srv := c.String("srv"); srv != "" {
+			conn.Discovery = &SRVDiscovery{Name: srv}
+		}
+		if svc := c.String("consul-service"); svc != "" {
+			conn.Discovery = &ConsulDiscovery{Addr: c.String("consul-addr"), Service: svc, Token: c.String("consul-token")}
+		}
+		if spec := c.String("k8s-service"); spec != "" {
+			ks, err := parseKubeService(spec)
+			if err != nil {
+				fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			if c.Bool("k8s-proxy") {
+				apiserver, err := kubeAPIServer()
+				if err != nil {
+					fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+					exit(E_UNKNOWN)
+				}
+				conn.Prefix = apiserver
+				conn.ProxyPath = ks.ProxyPath()
+			} else {
+				conn.Discovery = ks
+			}
+		}
+		if c.Bool("k8s-token") || c.Bool("k8s-proxy") {
+			token, err := kubeToken()
+			if err != nil {
+				fmt.Printf("%s: Unable to read service account token: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			conn.Header.Set("Authorization", "Bearer "+token)
+		}
+		if token := c.String("grafana-token"); token != "" {
+			conn.Header.Set("Authorization", "Bearer "+token)
+		}
+		if user := c.String("http-user"); user != "" {
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth(user, c.String("http-password"))
+			conn.Header.Set("Authorization", req.Header.Get("Authorization"))
+		}
+		if specs := c.StringSlice("header"); len(specs) > 0 {
+			h, err := parseHeaders(specs)
+			if err != nil {
+				fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			for k, v := range h {
+				conn.Header[k] = v
+			}
+		}
+		tc, err := tlsConfig(c.Bool("tls-verify"), c.String("ca-file"), c.String("client-cert"), c.String("client-key"))
+		if err != nil {
+			fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+			exit(E_UNKNOWN)
+		}
+		conn.TLS = tc
+		if file := c.String("replay"); file != "" {
+			if c.String("record") != "" {
+				fmt.Printf("%s: --record and --replay can't be combined\n", S_UNKNOWN)
+				exit(E_UNKNOWN)
+			}
+			t, err := LoadTape(file)
+			if err != nil {
+				fmt.Printf("%s: Unable to load recording: %v\n", S_UNKNOWN, err)
+				exit(E_UNKNOWN)
+			}
+			conn.Tape = t
+		} else if file := c.String("record"); file != "" {
+			conn.Tape = NewTape(file)
+		}
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "check",
+			Usage:     "Check the metrics given, the same as without a subcommand",
+			ArgsUsage: " ",
+			Action:    run_check,
+			Flags:     app.Flags,
+			Before: func(c *cli.Context) error {
+				if err := inheritFlags(c, app.Flags); err != nil {
+					fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+					exit(E_UNKNOWN)
+				}
+				return app.Before(c)
+			},
+		},
+		{
+			Name:      "find",
+			Usage:     "List the nodes of the Graphite tree a query matches, branches ending with a dot",
+			ArgsUsage: "QUERY",
+			Action:    run_find,
+		},
+		{
+			Name:      "dump",
+			Usage:     "Print all datapoints of the series a target matches, as CSV",
+			ArgsUsage: "TARGET",
+			Action:    run_dump,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "timeperiod, T",
+					Value: DEF_PERIOD,
+					Usage: "Timeperiod for selection",
+				},
+				cli.StringFlag{
+					Name:  "offset",
+					Usage: "Move the time period this far back from now",
+				},
+			},
+		},
+		{
+			Name:      "tui",
+			Usage:     "Try out thresholds and aggregations interactively on the series of a target, to find the ones to put in the Nagios config",
+			ArgsUsage: "TARGET [CHECK FLAGS]",
+			Action:    run_tui,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "timeperiod, T",
+					Value: DEF_PERIOD,
+					Usage: "Timeperiod for selection",
+				},
+				cli.StringFlag{
+					Name:  "offset",
+					Usage: "Move the time period this far back from now",
+				},
+			},
+		},
+		{
+			Name:      "version",
+			Usage:     "Print the version",
+			ArgsUsage: " ",
+			Action:    run_version,
+		},
+		{
+			Name:      "events",
+			Usage:     "Check the number of Graphite events with given tags (connection flags go before the subcommand)",
+			ArgsUsage: " ",
+			Action:    run_events,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tags, g",
+					Usage: "Space separated tags the events must all have",
+				},
+				cli.StringFlag{
+					Name:  "timeperiod, T",
+					Value: DEF_PERIOD,
+					Usage: "Timeperiod for selection",
+				},
+				cli.Float64Flag{
+					Name:  "warning, w",
+					Usage: "Number of events to result in WARNING status",
+				},
+				cli.Float64Flag{
+					Name:  "critical, c",
+					Usage: "Number of events to result in CRITICAL status",
+				},
+				cli.StringFlag{
+					Name:  "if, i",
+					Value: CMP_GT,
+					Usage: "Trigger on the number of events being lt, le, ge or gt the thresholds (use lt/le to alert on absence)",
+				},
+			},
+		},
+		{
+			Name:      "carbon-health",
+			Usage:     "Check the health of the Carbon agents themselves, with built in targets and thresholds",
+			ArgsUsage: " ",
+			Action:    run_carbon_health,
+			Flags:     carbonHealthFlags(),
+		},
+		{
+			Name:      "compose",
+			Usage:     "Check several targets, each with its own thresholds, and combine their states with AND and OR",
+			ArgsUsage: " ",
+			Action:    run_compose,
+			Flags:     composeFlags,
+		},
+		{
+			Name:      "slo",
+			Usage:     "Check the error budget of a service level objective, and how fast it's burning",
+			ArgsUsage: " ",
+			Action:    run_slo,
+			Flags:     sloFlags,
+		},
+		{
+			Name:      "ping",
+			Usage:     "Check only that Graphite is available, and its response time",
+			ArgsUsage: " ",
+			Action:    run_ping,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path",
+					Value: DEF_PING_PATH,
+					Usage: "Path to request, e.g. a trivial render if /version is not available",
+				},
+				cli.Float64Flag{
+					Name:  "warning, w",
+					Usage: "Response time in seconds to result in WARNING status",
+				},
+				cli.Float64Flag{
+					Name:  "critical, c",
+					Usage: "Response time in seconds to result in CRITICAL status",
+				},
+			},
+		},
+		{
+			Name:      "expand",
+			Usage:     "List the series a metric path resolves to, to verify what a check would cover",
+			ArgsUsage: " ",
+			Action:    run_expand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "metricpath, m",
+					Usage: "Metric path with wildcards to expand",
+				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "Include branches, not only leaf series",
+				},
+			},
+		},
+		{
+			Name:      "mockserver",
+			Usage:     "Serve canned series like Graphite would, to try out checks without a real Graphite",
+			ArgsUsage: " ",
+			Action:    run_mockserver,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: DEF_MOCK_LISTEN,
+					Usage: "Address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "fixture, F",
+					Usage: "File with series in the CSV or JSON (by .json extension) render format, - for CSV on stdin. Without it, a few mock.servers.* series are served",
+				},
+				cli.Float64Flag{
+					Name:  "latency",
+					Usage: "Seconds to wait before answering each request",
+				},
+				cli.Float64Flag{
+					Name:  "error-rate",
+					Usage: "Part of requests, between 0 and 1, to answer with HTTP 500",
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Work with config files for the daemon",
+			Subcommands: []cli.Command{
+				{
+					Name:      "lint",
+					Usage:     "Validate a config file, listing each problem with where it is, and exit non-zero if there are any",
+					ArgsUsage: "FILE",
+					Action:    run_lint,
+				},
+			},
+		},
+		{
+			Name:      "daemon",
+			Aliases:   []string{"serve"},
+			Usage:     "Run the checks of a config file at their intervals, until terminated. SIGHUP reloads the config",
+			ArgsUsage: " ",
+			Action:    run_daemon,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, C",
+					Usage: "YAML file with the checks to run, each given by the same flags as on the command line",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "Address to answer /healthz and /readyz probes, and serve /metrics about the daemon itself on, e.g. :9108 (default: no listener)",
+				},
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "Run each check once as a batch, followed by a summary in the worst status of them all, and exit with that status",
+				},
+			},
+		},
+	}
+
+	cli.OsExiter = exit // for subcommands returning errors
 	app.Action = run_check
 	app.Run(os.Args)
+	exit(E_OK) // subcommands that didn't exit themselves went fine
 }
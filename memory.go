@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Budget limits how much memory the data of a check may take, shared by all its requests
+type Budget struct {
+	Max  int64
+	used int64
+}
+
+// BudgetError is returned when the data of a check doesn't fit in its Budget
+type BudgetError struct {
+	Max int64
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("Dataset exceeds the memory budget of %s, narrow down the metric path or raise --max-memory", fmtSize(e.Max))
+}
+
+type budgetKey struct{}
+
+// withBudget() returns a context that has the data fetched with it charged to b
+func withBudget(ctx context.Context, b *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// budgetFrom() returns the Budget to charge for data fetched with ctx, or nil
+func budgetFrom(ctx context.Context) *Budget {
+	b, _ := ctx.Value(budgetKey{}).(*Budget)
+	return b
+}
+
+// Use() charges n bytes to the budget, and returns a *BudgetError if that exceeds it
+func (b *Budget) Use(n int64) error {
+	if atomic.AddInt64(&b.used, n) > b.Max {
+		return &BudgetError{Max: b.Max}
+	}
+	return nil
+}
+
+// Used() returns the number of bytes charged so far
+func (b *Budget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// budgetReader charges everything read through it to a Budget
+type budgetReader struct {
+	r io.Reader
+	b *Budget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if berr := br.b.Use(int64(n)); berr != nil {
+		return n, berr
+	}
+	return n, err
+}
+
+// Size() estimates the memory taken by a slice of metrics
+func (ms Metrics) Size() int64 {
+	var size int64
+	for i := range ms {
+		size += int64(unsafe.Sizeof(ms[i])+unsafe.Sizeof(*ms[i])) + int64(len(ms[i].Path))
+		size += int64(len(ms[i].Points)) * int64(unsafe.Sizeof(Point{}))
+	}
+	return size
+}
+
+// parseSize() parses a size in bytes, with an optional K, M or G suffix for powers of 1024
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, should be a number of bytes with an optional K, M or G suffix", size)
+	}
+	return n * mult, nil
+}
+
+// fmtSize() formats a number of bytes the way parseSize() reads them
+func fmtSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_MOCK_LISTEN string = "127.0.0.1:8080"
+	MOCK_VERSION    string = "1.1.10-mock"
+)
+
+// MockServer serves canned series through the parts of the Graphite API the checks use
+type MockServer struct {
+	Series    []JSONSeries
+	Latency   time.Duration
+	ErrorRate float64 // part of requests, 0 to 1, answered with an error
+}
+
+// defaultFixture() returns a few series to serve when no fixture file is given.
+// Timestamps are recent, so the series look alive.
+func defaultFixture() []JSONSeries {
+	ts := float64(time.Now().Truncate(time.Minute).Unix())
+	dp := func(vals ...float64) [][2]*float64 {
+		dps := make([][2]*float64, len(vals))
+		for i := range vals {
+			v, t := vals[i], ts-float64(60*(len(vals)-1-i))
+			dps[i] = [2]*float64{&v, &t}
+		}
+		return dps
+	}
+	return []JSONSeries{
+		{Target: "mock.servers.web01.cpu", Datapoints: dp(12, 15, 11)},
+		{Target: "mock.servers.web02.cpu", Datapoints: dp(45, 52, 61)},
+		{Target: "mock.servers.db01.cpu", Datapoints: dp(88, 93, 97)},
+	}
+}
+
+// LoadFixture() reads series from a file in the CSV or JSON format of the render API,
+// decided by the file extension. "-" reads CSV from stdin.
+func LoadFixture(file string) ([]JSONSeries, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		var series []JSONSeries
+		if err := json.NewDecoder(r).Decode(&series); err != nil {
+			return nil, err
+		}
+		return series, nil
+	}
+
+	rdr := csv.NewReader(r)
+	rdr.FieldsPerRecord = 3
+	idx := make(map[string]int) // keeps the order of first appearance
+	series := []JSONSeries{}
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ts, err := time.Parse(G_DATEFORMAT, rec[1])
+		if err != nil {
+			return nil, err
+		}
+		t := float64(ts.Unix())
+		var v *float64 // empty value fields are missing data
+		if rec[2] != "" {
+			val, err := strconv.ParseFloat(rec[2], 64)
+			if err != nil {
+				return nil, err
+			}
+			v = &val
+		}
+		i, ok := idx[rec[0]]
+		if !ok {
+			i = len(series)
+			idx[rec[0]] = i
+			series = append(series, JSONSeries{Target: rec[0]})
+		}
+		series[i].Datapoints = append(series[i].Datapoints, [2]*float64{v, &t})
+	}
+	return series, nil
+}
+
+// globRE() converts a Graphite path expression to a regexp matching whole paths,
+// where wildcards don't cross dots
+func globRE(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	inbrace := false
+	for _, r := range pattern {
+		switch {
+		case r == '*':
+			buf.WriteString(`[^.]*`)
+		case r == '?':
+			buf.WriteString(`[^.]`)
+		case r == '[' || r == ']':
+			buf.WriteRune(r)
+		case r == '{':
+			inbrace = true
+			buf.WriteString("(?:")
+		case r == '}' && inbrace:
+			inbrace = false
+			buf.WriteString(")")
+		case r == ',' && inbrace:
+			buf.WriteString("|")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// match() returns the series matching any of the given path expressions.
+// Functions are not evaluated, so targets should be plain paths.
+func (ms *MockServer) match(targets []string) ([]JSONSeries, error) {
+	res := []JSONSeries{}
+	for _, t := range targets {
+		re, err := globRE(t)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ms.Series {
+			if re.MatchString(ms.Series[i].Target) {
+				res = append(res, ms.Series[i])
+			}
+		}
+	}
+	return res, nil
+}
+
+// ServeHTTP() adds latency and errors as configured, then answers like Graphite would
+func (ms *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Infof("%s %s", r.Method, r.URL)
+	if ms.Latency > 0 {
+		time.Sleep(ms.Latency)
+	}
+	if ms.ErrorRate > 0 && rand.Float64() < ms.ErrorRate {
+		http.Error(w, "Simulated error from mock server", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/render", "/render/":
+		series, err := ms.match(q["target"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(series)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		for _, s := range series {
+			for _, dp := range s.Datapoints {
+				var val string
+				if dp[0] != nil {
+					val = strconv.FormatFloat(*dp[0], 'f', -1, 64)
+				}
+				cw.Write([]string{s.Target, time.Unix(int64(*dp[1]), 0).Format(G_DATEFORMAT), val})
+			}
+		}
+		cw.Flush()
+	case "/metrics/expand":
+		series, err := ms.match(q["query"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		er := ExpandResponse{Results: []string{}}
+		for i := range series {
+			er.Results = append(er.Results, series[i].Target)
+		}
+		sort.Strings(er.Results)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(er)
+	case "/events/get_data":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "[]")
+	case DEF_PING_PATH:
+		fmt.Fprintln(w, MOCK_VERSION)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// run_mockserver() serves fixtures on a local port until killed, for trying out checks without Graphite
+func run_mockserver(c *cli.Context) error {
+	listen := c.String("listen")
+	fixture := c.String("fixture")
+	latency := c.Float64("latency")
+	erate := c.Float64("error-rate")
+
+	if erate < 0 || erate > 1 {
+		return cli.NewExitError(fmt.Sprintf("Error rate must be between 0 and 1, got %v", erate), E_UNKNOWN)
+	}
+
+	ms := &MockServer{
+		Series:    defaultFixture(),
+		Latency:   time.Duration(latency * float64(time.Second)),
+		ErrorRate: erate,
+	}
+	if fixture != "" {
+		series, err := LoadFixture(fixture)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to load fixture %q: %v", fixture, err), E_UNKNOWN)
+		}
+		ms.Series = series
+	}
+
+	fmt.Fprintf(os.Stderr, "Serving %d series on http://%s\n", len(ms.Series), listen)
+	if err := http.ListenAndServe(listen, ms); err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// perfLabel() quotes a perfdata label if needed, as per the Nagios plugin guidelines
+func perfLabel(label string) string {
+	if strings.ContainsAny(label, " '=") {
+		return "'" + strings.Replace(label, "'", "''", -1) + "'"
+	}
+	return label
+}
+
+// multi_output() treats each metric as its own sub check, and formats the result the way check_multi
+// does, which Icinga2 and friends know how to split into separate services.
+// Returns the output and the exit code, which is the worst of all sub checks.
+func multi_output(o, w, c Metrics, s_warn, s_crit string, rt float64) (string, int) {
+	ecode := E_OK
+	if len(w) > 0 {
+		ecode = E_WARNING
+	}
+	if len(c) > 0 {
+		ecode = E_CRITICAL
+	}
+
+	// names of the offenders for the summary line
+	names := func(ms Metrics) string {
+		if len(ms) == 0 {
+			return ""
+		}
+		paths := make([]string, 0, len(ms))
+		for i := range ms {
+			paths = append(paths, ms[i].Path)
+		}
+		return " (" + strings.Join(paths, ", ") + ")"
+	}
+
+	var buf, perf bytes.Buffer
+	total := len(o) + len(w) + len(c)
+	fmt.Fprintf(&buf, "%s - %d plugins checked, %d critical%s, %d warning%s, 0 unknown, %d ok\n",
+		statusText(ecode), total, len(c), names(c), len(w), names(w), len(o))
+	fmt.Fprintf(&perf, "|check_multi::check_multi::plugins=%d time=%f", total, rt)
+
+	n := 0
+	for _, b := range buckets(o, w, c) {
+		for _, m := range b.MS {
+			n++
+			fmt.Fprintf(&buf, "[%2d] %s %s - value %.4f at %s\n", n, m.Path, statusText(b.ECode), m.Value, m.TS.Format(G_DATEFORMAT))
+			fmt.Fprintf(&perf, " %s=%f;%s;%s;;", perfLabel(m.Path+"::check_graphite::value"), m.Value, s_warn, s_crit)
+		}
+	}
+
+	return buf.String() + perf.String() + "\n", ecode
+}
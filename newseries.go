@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	DEF_FORGET_SERIES string = "7d" // how long series are remembered after they were last seen
+)
+
+// SeenSeries keeps track of when each metric path was last seen, so that we can tell
+// which series show up for the first time between runs
+type SeenSeries struct {
+	Paths map[string]time.Time `json:"paths"`
+}
+
+// LoadSeenSeries() reads previously seen series from the state.
+// The bool return value is false if there were none, meaning this is the first run.
+func LoadSeenSeries(st *State) (*SeenSeries, bool, error) {
+	ss := &SeenSeries{}
+	found, err := st.Get("seen_series", ss)
+	if err == nil && !found {
+		// state files from before --state-dir held only the seen series
+		found, err = st.Get("paths", &ss.Paths)
+	}
+	if err != nil {
+		return ss, false, err
+	}
+	if ss.Paths == nil {
+		ss.Paths = make(map[string]time.Time)
+	}
+	return ss, found, nil
+}
+
+// Save() puts the seen series in the state
+func (ss *SeenSeries) Save(st *State) error {
+	st.Delete("paths")
+	return st.Put("seen_series", ss)
+}
+
+// Update() registers all metrics as seen now, and returns the ones not seen before. Series not seen
+// for longer than retain are forgotten, so the state doesn't keep growing with series long gone,
+// and they're new again should they come back.
+func (ss *SeenSeries) Update(ms Metrics, retain time.Duration) Metrics {
+	nm := Metrics{}
+	now := time.Now()
+	for path, seen := range ss.Paths {
+		if now.Sub(seen) > retain {
+			delete(ss.Paths, path)
+		}
+	}
+	for i := range ms {
+		if _, ok := ss.Paths[ms[i].Path]; !ok {
+			nm = append(nm, ms[i])
+		}
+		ss.Paths[ms[i].Path] = now
+	}
+	sort.Sort(nm)
+	return nm
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeenSeriesUpdate(t *testing.T) {
+	now := time.Now()
+	ss := &SeenSeries{Paths: map[string]time.Time{
+		"a": now.Add(-time.Hour),
+		"b": now.Add(-48 * time.Hour),
+		"c": now.Add(-48 * time.Hour),
+	}}
+	// b and c were gone long enough to be forgotten, so b coming back is new again
+	nm := ss.Update(Metrics{series("a", 1), series("b", 1), series("d", 1)}, 24*time.Hour)
+	if len(nm) != 2 || nm[0].Path != "b" || nm[1].Path != "d" {
+		t.Errorf("got %v new, want b and d", nm)
+	}
+	if _, ok := ss.Paths["c"]; ok || len(ss.Paths) != 3 {
+		t.Errorf("got %v seen, want a, b and d", ss.Paths)
+	}
+
+	// a series seen again is remembered from then on
+	if now.Sub(ss.Paths["a"]) > time.Minute {
+		t.Errorf("got a last seen at %v, want now", ss.Paths["a"])
+	}
+	if nm := ss.Update(Metrics{series("a", 1)}, 24*time.Hour); len(nm) != 0 {
+		t.Errorf("got %v new, want none", nm)
+	}
+}
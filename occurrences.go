@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Occurrences requires the check to be WARNING or CRITICAL in M of the last K runs before alerting,
+// as given with --occurrences
+type Occurrences struct {
+	M int
+	K int
+}
+
+// ParseOccurrences() parses M/K
+func ParseOccurrences(spec string) (*Occurrences, error) {
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid --occurrences %q, should be in the form M/K", spec)
+	}
+	m, err1 := strconv.Atoi(parts[0])
+	k, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || m < 1 || k < m {
+		return nil, fmt.Errorf("Invalid --occurrences %q, should be M/K with 1 <= M <= K", spec)
+	}
+	return &Occurrences{M: m, K: k}, nil
+}
+
+// Filter() records status as that of this run in the state, and returns it if the check was
+// WARNING or CRITICAL often enough, or else E_OK with a note on why
+func (o *Occurrences) Filter(st *State, status int) (int, string, error) {
+	var history []int // statuses of the last runs, oldest first
+	if _, err := st.Get("occurrences", &history); err != nil {
+		return status, "", err
+	}
+	history = append(history, status)
+	if len(history) > o.K {
+		history = history[len(history)-o.K:]
+	}
+	if err := st.Put("occurrences", history); err != nil {
+		return status, "", err
+	}
+
+	if status != E_WARNING && status != E_CRITICAL {
+		return status, "", nil
+	}
+	n := 0
+	for _, s := range history {
+		if s == E_WARNING || s == E_CRITICAL {
+			n++
+		}
+	}
+	if n >= o.M {
+		return status, "", nil
+	}
+	return E_OK, fmt.Sprintf(" (breached in %d of the last %d runs, alerting from %d of %d)", n, len(history), o.M, o.K), nil
+}
+
+// softState is what --soft-retries keeps between runs
+type softState struct {
+	Count int `json:"count"` // consecutive runs in WARNING or CRITICAL
+}
+
+// SoftRetries() emulates the soft states of Nagios for schedulers without them: records status as that
+// of this run in the state, and returns it once the check was WARNING or CRITICAL in n runs in a row, or
+// else E_OK with a note on the soft state. UNKNOWN neither counts nor breaks a streak.
+func SoftRetries(st *State, n, status int) (int, string, error) {
+	var ss softState
+	if _, err := st.Get("soft_retries", &ss); err != nil {
+		return status, "", err
+	}
+	switch status {
+	case E_WARNING, E_CRITICAL:
+		ss.Count++
+	case E_OK:
+		ss.Count = 0
+	}
+	if err := st.Put("soft_retries", ss); err != nil {
+		return status, "", err
+	}
+
+	if (status != E_WARNING && status != E_CRITICAL) || ss.Count >= n {
+		return status, "", nil
+	}
+	return E_OK, fmt.Sprintf(" (SOFT %s, %d of %d runs in a row)", statusText(status), ss.Count, n), nil
+}
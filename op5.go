@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	DEF_OP5_TEMPLATE string = "default-service"
+	OP5_CHECK_CMD    string = "check_dummy!3!\"No passive result received from check_graphite\""
+)
+
+// Op5Client talks to the op5 Monitor REST API, to create passive services and submit results to them
+type Op5Client struct {
+	URL      string // e.g. https://op5.example.com/api
+	User     string
+	Password string
+	Host     string // the op5 host to add the services to
+	Template string
+	Prefix   string // prepended to the metric path to make the service description
+}
+
+// request() does an API call, with the JSON encoded body if not nil, and returns the HTTP status code
+func (oc *Op5Client) request(method, path string, body interface{}) (int, error) {
+	return oc.call(method, path, body, nil)
+}
+
+// call() does an API call like request(), decoding a successful JSON response into out if not nil
+func (oc *Op5Client) call(method, path string, body, out interface{}) (int, error) {
+	var rdr io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rdr = bytes.NewReader(data)
+	}
+	u := strings.TrimSuffix(oc.URL, "/") + path
+	req, err := http.NewRequest(method, u, rdr)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", UA)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(oc.User, oc.Password)
+
+	log.Debugf("op5 API: %s %s", method, u)
+	resp, err := httpclient(u).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
+
+// ServiceName() returns the service description used for a metric
+func (oc *Op5Client) ServiceName(m *Metric) string {
+	return oc.Prefix + m.Path
+}
+
+// EnsureService() creates a passive service for the metric if it doesn't exist.
+// Returns true if the service was created, meaning the config has to be saved.
+func (oc *Op5Client) EnsureService(m *Metric) (bool, error) {
+	path := fmt.Sprintf("/config/service/%s", url.PathEscape(oc.Host+";"+oc.ServiceName(m)))
+	code, err := oc.request(http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	if code != http.StatusNotFound {
+		return false, nil
+	}
+	svc := map[string]interface{}{
+		"host_name":              oc.Host,
+		"service_description":    oc.ServiceName(m),
+		"template":               oc.Template,
+		"check_command":          OP5_CHECK_CMD,
+		"active_checks_enabled":  false,
+		"passive_checks_enabled": true,
+	}
+	if _, err := oc.request(http.MethodPost, "/config/service", svc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SaveConfig() saves the changes made to the op5 config, which also reloads it
+func (oc *Op5Client) SaveConfig() error {
+	_, err := oc.request(http.MethodPost, "/config/change", nil)
+	return err
+}
+
+// SubmitResult() submits a passive check result for the service of a metric
+func (oc *Op5Client) SubmitResult(m *Metric, ecode int, output string) error {
+	res := map[string]interface{}{
+		"host_name":           oc.Host,
+		"service_description": oc.ServiceName(m),
+		"status_code":         ecode,
+		"plugin_output":       output,
+	}
+	_, err := oc.request(http.MethodPost, "/command/PROCESS_SERVICE_CHECK_RESULT", res)
+	return err
+}
+
+// Provision() makes sure there is a service for each metric, and submits the result for each,
+// based on which slice the metric is in. Returns the number of services created.
+func (oc *Op5Client) Provision(o, w, c Metrics, s_warn, s_crit string) (int, error) {
+	created := 0
+	for _, b := range buckets(o, w, c) {
+		for _, m := range b.MS {
+			isnew, err := oc.EnsureService(m)
+			if err != nil {
+				return created, err
+			}
+			if isnew {
+				created++
+			}
+		}
+	}
+	if created > 0 {
+		// results for services not yet in the running config would be dropped, so save first
+		if err := oc.SaveConfig(); err != nil {
+			return created, err
+		}
+	}
+	for _, b := range buckets(o, w, c) {
+		for _, m := range b.MS {
+			output := fmt.Sprintf("%s: value %.4f at %s |value=%f;%s;%s;;",
+				statusText(b.ECode), m.Value, m.TS.Format(G_DATEFORMAT), m.Value, s_warn, s_crit)
+			if err := oc.SubmitResult(m, b.ECode, output); err != nil {
+				return created, err
+			}
+		}
+	}
+	return created, nil
+}
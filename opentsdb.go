@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BE_OPENTSDB  string = "opentsdb"
+	URL_TSDBTMPL string = "/api/query?start=%s-ago&m=%s" // OpenTSDB path template
+	URL_TSDBEND  string = "&end=%s-ago"                  // end of the window, when not now
+	TSDB_DEF_AGG string = "none"                         // gives each series separately
+)
+
+// OpenTSDB gets metrics from the OpenTSDB query API
+type OpenTSDB struct {
+	Base string
+}
+
+func init() {
+	RegisterDatasource(BE_OPENTSDB, func(base string) Datasource {
+		return &OpenTSDB{Base: base}
+	})
+}
+
+// TSDBResult is one series in a response from the OpenTSDB query API
+type TSDBResult struct {
+	Metric string             `json:"metric"`
+	Tags   map[string]string  `json:"tags"`
+	DPS    map[string]float64 `json:"dps"`
+}
+
+// Path() puts together the metric name and tags into a name unique per series, like metric{k1=v1,k2=v2}
+func (tr TSDBResult) Path() string {
+	if len(tr.Tags) == 0 {
+		return tr.Metric
+	}
+	keys := make([]string, 0, len(tr.Tags))
+	for k := range tr.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, k+"="+tr.Tags[k])
+	}
+	return tr.Metric + "{" + strings.Join(kvs, ",") + "}"
+}
+
+var periodRE = regexp.MustCompile(`^(\d+)([a-z]+)$`)
+
+// tsdbPeriod() converts a Graphite style relative time like 5min into the OpenTSDB style 5m
+func tsdbPeriod(period string) (string, error) {
+	sm := periodRE.FindStringSubmatch(period)
+	if sm == nil {
+		return "", fmt.Errorf("unable to convert time period %q for OpenTSDB", period)
+	}
+	var unit string
+	switch {
+	case strings.HasPrefix(sm[2], "s"):
+		unit = "s"
+	case strings.HasPrefix(sm[2], "min"):
+		unit = "m"
+	case strings.HasPrefix(sm[2], "h"):
+		unit = "h"
+	case strings.HasPrefix(sm[2], "d"):
+		unit = "d"
+	case strings.HasPrefix(sm[2], "w"):
+		unit = "w"
+	case strings.HasPrefix(sm[2], "mon"):
+		unit = "n"
+	case strings.HasPrefix(sm[2], "y"):
+		unit = "y"
+	default:
+		return "", fmt.Errorf("unknown time unit %q in %q", sm[2], period)
+	}
+	return sm[1] + unit, nil
+}
+
+// tsdb_url() returns the query path for a metric expression. An expression without an aggregator
+// gets TSDB_DEF_AGG, to get each series by itself, like Graphite does.
+func tsdb_url(mexpr string, window Window) (string, error) {
+	start, err := tsdbPeriod(window.From())
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(mexpr, ":") {
+		mexpr = TSDB_DEF_AGG + ":" + mexpr
+	}
+	path := fmt.Sprintf(URL_TSDBTMPL, start, url.QueryEscape(mexpr))
+	if until := window.Until(); until != "" {
+		end, err := tsdbPeriod(until)
+		if err != nil {
+			return "", err
+		}
+		path += fmt.Sprintf(URL_TSDBEND, end)
+	}
+	return path, nil
+}
+
+// Fetch() queries the OpenTSDB API and converts the response to Metrics
+func (t *OpenTSDB) Fetch(ctx context.Context, target string, window Window) (Metrics, error) {
+	path, err := tsdb_url(target, window)
+	if err != nil {
+		return nil, err
+	}
+	url := t.Base + path
+	log.Debugf("URL: %s", url)
+	body, err := getbody(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var results []TSDBResult
+	if err := json.NewDecoder(body).Decode(&results); err != nil {
+		return nil, err
+	}
+
+	ss := make(seriesSet)
+	for _, tr := range results {
+		ss.Seen(tr.Path())
+		for ts, val := range tr.DPS {
+			sec, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				if err := malformed(ctx, target, fmt.Sprintf("%q of %s", ts, tr.Path()), err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			ss.Add(tr.Path(), time.Unix(sec, 0), val)
+		}
+	}
+	noteNull(ctx, ss.Null())
+	return ss.Metrics(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OUT_SENSU  string = "sensu"
+	OUT_ZABBIX string = "zabbix"
+	OUT_OPENM  string = "openmetrics"
+	OUT_CSV    string = "csv"
+	ZBX_PREFIX string = "graphite"
+)
+
+// SensuFormatter gives a Sensu check result, with the Nagios output as check output
+type SensuFormatter struct{}
+
+// ZabbixFormatter gives input for zabbix_sender
+type ZabbixFormatter struct{}
+
+// OpenMetricsFormatter gives the values and states as OpenMetrics samples
+type OpenMetricsFormatter struct{}
+
+// CSVFormatter gives one row per metric, for spreadsheets and shell pipelines
+type CSVFormatter struct{}
+
+func init() {
+	RegisterFormatter(OUT_SENSU, SensuFormatter{})
+	RegisterFormatter(OUT_ZABBIX, ZabbixFormatter{})
+	RegisterFormatter(OUT_OPENM, OpenMetricsFormatter{})
+	RegisterFormatter(OUT_CSV, CSVFormatter{})
+}
+
+func (SensuFormatter) Format(r *Result) string {
+	return sensu_output(r.Name, NagiosFormatter{}.Format(r), r.ExitCode, r.RT)
+}
+
+func (ZabbixFormatter) Format(r *Result) string {
+	return zabbix_output(r.Host, r.Name, r.Metrics(), r.ExitCode, r.RT)
+}
+
+func (OpenMetricsFormatter) Format(r *Result) string {
+	return openmetrics_output(r.Name, r.O, r.W, r.C, r.ExitCode, r.RT)
+}
+
+func (CSVFormatter) Format(r *Result) string {
+	return csv_output(r.O, r.W, r.C, r.Warn, r.Crit)
+}
+
+// SensuCheck is the check part of a Sensu event, as accepted by the agent socket and events API
+type SensuCheck struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status   int     `json:"status"`
+	Output   string  `json:"output"`
+	Executed int64   `json:"executed"`
+	Duration float64 `json:"duration"`
+}
+
+// sensu_output() formats a result as Sensu check result JSON
+func sensu_output(name, output string, ecode int, rt float64) string {
+	ev := struct {
+		Check SensuCheck `json:"check"`
+	}{}
+	ev.Check.Metadata.Name = name
+	ev.Check.Status = ecode
+	ev.Check.Output = output
+	ev.Check.Executed = time.Now().Unix()
+	ev.Check.Duration = rt
+	data, err := json.Marshal(ev)
+	if err != nil {
+		// can't really happen with the types above
+		return fmt.Sprintf("{\"check\":{\"status\":%d,\"output\":%q}}", E_UNKNOWN, err.Error())
+	}
+	return string(data) + "\n"
+}
+
+// zbxQuote() quotes a field for zabbix_sender input if needed
+func zbxQuote(s string) string {
+	if strings.ContainsAny(s, " \t\"\\") {
+		return "\"" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+	}
+	return s
+}
+
+// zbxKey() returns an item key with the given parameter, quoted if needed
+func zbxKey(key, param string) string {
+	if strings.ContainsAny(param, ",]\" ") {
+		param = "\"" + strings.Replace(param, "\"", "\\\"", -1) + "\""
+	}
+	return fmt.Sprintf("%s.%s[%s]", ZBX_PREFIX, key, param)
+}
+
+// zabbix_output() formats a result as input for "zabbix_sender -T -i -", with the value of each metric,
+// plus the status and response time of the check itself. Host "-" means the host from the sender config.
+func zabbix_output(host, name string, ms Metrics, ecode int, rt float64) string {
+	if host == "" {
+		host = "-"
+	}
+	var buf bytes.Buffer
+	for i := range ms {
+		fmt.Fprintf(&buf, "%s %s %d %s\n", zbxQuote(host), zbxQuote(zbxKey("value", ms[i].Path)),
+			ms[i].TS.Unix(), strconv.FormatFloat(ms[i].Value, 'f', -1, 64))
+	}
+	now := time.Now().Unix()
+	fmt.Fprintf(&buf, "%s %s %d %d\n", zbxQuote(host), zbxQuote(zbxKey("status", name)), now, ecode)
+	fmt.Fprintf(&buf, "%s %s %d %f\n", zbxQuote(host), zbxQuote(zbxKey("response_time", name)), now, rt)
+	return buf.String()
+}
+
+// omLabel() escapes a label value for OpenMetrics
+func omLabel(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s)
+}
+
+// openmetrics_output() formats the value and state of each metric, plus the status and response
+// time of the check itself, in the OpenMetrics text format
+func openmetrics_output(name string, o, w, c Metrics, ecode int, rt float64) string {
+	var vbuf, sbuf bytes.Buffer
+	for _, b := range buckets(o, w, c) {
+		for _, m := range b.MS {
+			labels := fmt.Sprintf("{check=\"%s\",path=\"%s\"}", omLabel(name), omLabel(m.Path))
+			fmt.Fprintf(&vbuf, "graphite_value%s %s %d\n", labels, strconv.FormatFloat(m.Value, 'g', -1, 64), m.TS.Unix())
+			fmt.Fprintf(&sbuf, "graphite_state%s %d\n", labels, b.ECode)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE graphite_value gauge\n# HELP graphite_value Latest value of the metric in Graphite\n%s", vbuf.String())
+	fmt.Fprintf(&buf, "# TYPE graphite_state gauge\n# HELP graphite_state State of the metric (0 OK, 1 WARNING, 2 CRITICAL)\n%s", sbuf.String())
+	fmt.Fprintf(&buf, "# TYPE check_graphite_status gauge\n# HELP check_graphite_status Overall status of the check\n")
+	fmt.Fprintf(&buf, "check_graphite_status{check=\"%s\"} %d\n", omLabel(name), ecode)
+	fmt.Fprintf(&buf, "# TYPE check_graphite_response_time_seconds gauge\n# UNIT check_graphite_response_time_seconds seconds\n")
+	fmt.Fprintf(&buf, "# HELP check_graphite_response_time_seconds Response time of Graphite\n")
+	fmt.Fprintf(&buf, "check_graphite_response_time_seconds{check=\"%s\"} %s\n", omLabel(name), strconv.FormatFloat(rt, 'g', -1, 64))
+	fmt.Fprintf(&buf, "# EOF\n")
+	return buf.String()
+}
+
+// csv_output() formats the value and state of each metric as CSV with a header, worst state first.
+// The thresholds are in perfdata range form, empty if not given.
+func csv_output(o, w, c Metrics, warn, crit string) string {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"path", "value", "timestamp", "state", "warning", "critical"})
+	for _, b := range buckets(o, w, c) {
+		for _, m := range b.MS {
+			cw.Write([]string{m.Path, strconv.FormatFloat(m.Value, 'f', -1, 64), m.TS.Format(G_DATEFORMAT),
+				statusText(b.ECode), warn, crit})
+		}
+	}
+	cw.Flush()
+	return buf.String()
+}
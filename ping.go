@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_PING_PATH string = "/version"
+)
+
+type PingResponse struct {
+	Status  string
+	Code    int
+	Version string
+	RT      float64
+	Err     error
+}
+
+// ping() requests the given URL and reports status and response time
+// Designed to run in a separate goroutine, just like parse()
+func ping(ctx context.Context, url string, chRes chan PingResponse) {
+	pr := PingResponse{}
+	t_start := time.Now()
+	resp, err := geturl(ctx, url)
+	if err != nil {
+		pr.Err = err
+		pr.RT = time.Duration(time.Now().Sub(t_start)).Seconds()
+		chRes <- pr
+		return
+	}
+	defer resp.Body.Close()
+
+	// /version returns just the version string, so keep a little of the body for the output
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	pr.RT = time.Duration(time.Now().Sub(t_start)).Seconds()
+	pr.Status = resp.Status
+	pr.Code = resp.StatusCode
+	pr.Err = err
+	if resp.StatusCode == 200 && strings.HasSuffix(url, DEF_PING_PATH) {
+		pr.Version = strings.TrimSpace(string(body))
+	}
+	chRes <- pr
+}
+
+// run_ping() checks that Graphite responds at all, and how fast
+func run_ping(c *cli.Context) {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	path := c.String("path")
+	warn := c.Float64("warning")
+	crit := c.Float64("critical")
+	haswarn := c.IsSet("warning") || c.IsSet("w")
+	hascrit := c.IsSet("critical") || c.IsSet("c")
+
+	if conn.Dialect == DL_VM && !c.IsSet("path") {
+		path = VM_PING_PATH
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	url := base + path
+	log.Debugf("URL: %s\n", url)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+	chRes := make(chan PingResponse, 1)
+	go ping(ctx, url, chRes)
+
+	select {
+	case res := <-chRes:
+		if res.Err != nil {
+			fmt.Printf("%s: Graphite not available: %q\n", S_CRITICAL, res.Err)
+			exit(E_CRITICAL)
+		}
+
+		var s_warn, s_crit string
+		if haswarn {
+			s_warn = fmt.Sprintf("%f", warn)
+		}
+		if hascrit {
+			s_crit = fmt.Sprintf("%f", crit)
+		}
+		perf := fmt.Sprintf("|response_time=%fs;%s;%s;0;%f", res.RT, s_warn, s_crit, tmout)
+
+		if res.Code != 200 {
+			fmt.Printf("%s: Graphite responded with %s %s\n", S_CRITICAL, res.Status, perf)
+			exit(E_CRITICAL)
+		}
+
+		var what string
+		if res.Version != "" {
+			what = fmt.Sprintf("Graphite %s", res.Version)
+		} else {
+			what = "Graphite"
+		}
+		msg_tmpl := "%s: %s responded in %.03fs%s %s\n"
+		if hascrit && res.RT > crit {
+			fmt.Printf(msg_tmpl, S_CRITICAL, what, res.RT, fmt.Sprintf(", above the critical threshold of %.03fs", crit), perf)
+			exit(E_CRITICAL)
+		}
+		if haswarn && res.RT > warn {
+			fmt.Printf(msg_tmpl, S_WARNING, what, res.RT, fmt.Sprintf(", above the warning threshold of %.03fs", warn), perf)
+			exit(E_WARNING)
+		}
+		fmt.Printf(msg_tmpl, S_OK, what, res.RT, "", perf)
+		exit(E_OK)
+	case <-ctx.Done():
+		fmt.Printf("%s: Timed out after %d seconds", S_CRITICAL, int(tmout))
+		exit(E_CRITICAL)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is one datapoint of a series
+type Point struct {
+	TS    time.Time
+	Value float64
+}
+
+// seriesSet collects the datapoints of series by path, as they come from the backend
+type seriesSet map[string][]Point
+
+// Add() adds a datapoint to the series of path
+func (ss seriesSet) Add(path string, ts time.Time, val float64) {
+	ss[path] = append(ss[path], Point{TS: ts, Value: val})
+}
+
+// Seen() adds path to the set even if none of its datapoints has a value, to tell it matched
+func (ss seriesSet) Seen(path string) {
+	if _, ok := ss[path]; !ok {
+		ss[path] = nil
+	}
+}
+
+// Null() returns the paths of the series in the set without any datapoints with a value
+func (ss seriesSet) Null() []string {
+	var paths []string
+	for path, pts := range ss {
+		if len(pts) == 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Metrics() returns a Metric per series with values, with the value of its latest datapoint, and all datapoints oldest first
+func (ss seriesSet) Metrics() Metrics {
+	ms := make(Metrics, 0, len(ss))
+	for path, pts := range ss {
+		if len(pts) == 0 {
+			continue
+		}
+		sort.SliceStable(pts, func(i, j int) bool { return pts[i].TS.Before(pts[j].TS) })
+		last := pts[len(pts)-1]
+		m := NewMetric(path, last.TS, last.Value)
+		m.Points = pts
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// Reducer turns the values of a series into one
+type Reducer func(vals []float64) float64
+
+var reducers = map[string]Reducer{
+	"avg": func(vals []float64) float64 {
+		return sum(vals) / float64(len(vals))
+	},
+	"sum": sum,
+	"min": func(vals []float64) float64 {
+		min := vals[0]
+		for _, v := range vals[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	},
+	"max": func(vals []float64) float64 {
+		max := vals[0]
+		for _, v := range vals[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	},
+	"median": func(vals []float64) float64 {
+		s := append([]float64(nil), vals...)
+		sort.Float64s(s)
+		if len(s)%2 == 1 {
+			return s[len(s)/2]
+		}
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	},
+	"last": func(vals []float64) float64 {
+		return vals[len(vals)-1]
+	},
+}
+
+func sum(vals []float64) float64 {
+	var s float64
+	for _, v := range vals {
+		s += v
+	}
+	return s
+}
+
+// percentile() returns the pth percentile of values by the nearest rank, like Graphite does
+func percentile(vals []float64, p float64) float64 {
+	s := append([]float64(nil), vals...)
+	sort.Float64s(s)
+	rank := int(math.Ceil(p/100*float64(len(s)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return s[rank]
+}
+
+// ParsePercentile() parses a percentile given like p95
+func ParsePercentile(spec string) (float64, error) {
+	if !percentileRE.MatchString(spec) {
+		return 0, fmt.Errorf("%q is not a percentile like p95", spec)
+	}
+	p, err := strconv.ParseFloat(spec[1:], 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("percentile %q should be above 0 and at most 100", spec)
+	}
+	return p, nil
+}
+
+// ReducerNames() returns the names of all reducers, sorted
+func ReducerNames() []string {
+	names := make([]string, 0, len(reducers))
+	for name := range reducers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LastPoints is how to judge series on their latest datapoints only, as given with --last-points
+type LastPoints struct {
+	N    int
+	Func string
+}
+
+// ParseLastPoints() parses N[,FUNC], where FUNC defaults to avg
+func ParseLastPoints(spec string) (*LastPoints, error) {
+	parts := strings.SplitN(spec, ",", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("Invalid --last-points %q, should be a number of datapoints above 0", spec)
+	}
+	lp := &LastPoints{N: n, Func: "avg"}
+	if len(parts) == 2 {
+		lp.Func = parts[1]
+		if _, ok := reducers[lp.Func]; !ok {
+			return nil, fmt.Errorf("Invalid --last-points %q: unknown function %q (options: %s)", spec, lp.Func, strings.Join(ReducerNames(), ", "))
+		}
+	}
+	return lp, nil
+}
+
+// Apply() cuts the datapoints of each metric down to the last N, and sets its value to what Func makes of them.
+// The timestamp stays that of the latest datapoint.
+func (lp *LastPoints) Apply(ms Metrics) {
+	for _, m := range ms {
+		if len(m.Points) == 0 {
+			continue
+		}
+		if len(m.Points) > lp.N {
+			m.Points = m.Points[len(m.Points)-lp.N:]
+		}
+		vals := make([]float64, len(m.Points))
+		for i := range m.Points {
+			vals[i] = m.Points[i].Value
+		}
+		m.Value = reducers[lp.Func](vals)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLastPointsApply(t *testing.T) {
+	tests := []struct {
+		lp     LastPoints
+		vals   []float64
+		value  float64
+		points int
+	}{
+		{LastPoints{N: 3, Func: "avg"}, []float64{100, 1, 2, 3}, 2, 3},
+		{LastPoints{N: 2, Func: "max"}, []float64{100, 1, 2, 3}, 3, 2},
+		{LastPoints{N: 2, Func: "min"}, []float64{100, 1, 2, 3}, 2, 2},
+		{LastPoints{N: 3, Func: "sum"}, []float64{100, 1, 2, 3}, 6, 3},
+		{LastPoints{N: 10, Func: "avg"}, []float64{1, 2, 3}, 2, 3},
+		{LastPoints{N: 1, Func: "avg"}, []float64{1, 2, 3}, 3, 1},
+	}
+	for _, tt := range tests {
+		m := series("a", tt.vals...)
+		ts := m.TS
+		tt.lp.Apply(Metrics{m})
+		if m.Value != tt.value || len(m.Points) != tt.points {
+			t.Errorf("%d,%s of %v: got %v from %d points, want %v from %d", tt.lp.N, tt.lp.Func, tt.vals,
+				m.Value, len(m.Points), tt.value, tt.points)
+		}
+		if !m.TS.Equal(ts) {
+			t.Errorf("%d,%s of %v: got timestamp %s, want that of the latest point %s", tt.lp.N, tt.lp.Func, tt.vals, m.TS, ts)
+		}
+	}
+
+	// a series without datapoints keeps its value
+	m := &Metric{Path: "a", Value: 7}
+	(&LastPoints{N: 2, Func: "avg"}).Apply(Metrics{m})
+	if m.Value != 7 {
+		t.Errorf("empty series: got %v, want the value kept", m.Value)
+	}
+}
+
+func TestParseLastPoints(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *LastPoints
+	}{
+		{"3", &LastPoints{N: 3, Func: "avg"}},
+		{"5,max", &LastPoints{N: 5, Func: "max"}},
+		{"0", nil},
+		{"x", nil},
+		{"3,nosuch", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseLastPoints(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
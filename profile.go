@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+)
+
+const (
+	PROF_CPU string = "cpu"
+	PROF_MEM string = "mem"
+)
+
+var exitHooks []func()
+
+// atExit() registers a func to run before the program exits through exit(), last registered first
+func atExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
+// exit() runs the registered exit hooks, then exits with the given code.
+// Use it instead of os.Exit(), so that profiles and such get written.
+func exit(code int) {
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	exitHooks = nil // in case a hook exits itself
+	os.Exit(code)
+}
+
+// startProfile() starts profiling as given by a comma separated list of kind:path, e.g.
+// "cpu:/tmp/check.cpu,mem:/tmp/check.mem". Profiles are written when exiting.
+func startProfile(spec string) error {
+	for _, p := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("invalid profile %q, should be %s:path or %s:path", p, PROF_CPU, PROF_MEM)
+		}
+		kind, path := kv[0], kv[1]
+		switch kind {
+		case PROF_CPU:
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			if err := pprof.StartCPUProfile(f); err != nil {
+				f.Close()
+				return err
+			}
+			atExit(func() {
+				pprof.StopCPUProfile()
+				f.Close()
+			})
+		case PROF_MEM:
+			atExit(func() {
+				f, err := os.Create(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to write memory profile: %v\n", err)
+					return
+				}
+				defer f.Close()
+				runtime.GC() // get up-to-date statistics
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to write memory profile: %v\n", err)
+				}
+			})
+		default:
+			return fmt.Errorf("unknown profile kind %q (options: %s, %s)", kind, PROF_CPU, PROF_MEM)
+		}
+	}
+
+	// long running subcommands are stopped by signals, so write the profiles then as well
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		exit(E_UNKNOWN)
+	}()
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEF_RETRY_AFTER time.Duration = time.Second // how long to back off on a 429 that doesn't say
+	MAX_RETRIES     int           = 3           // how many times to retry a request the backend asks us to back off from
+)
+
+// RateLimiter is a token bucket for requests to the backend, shared by all targets and checks.
+// It also holds back all requests when the backend asks us to, with Retry-After.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second, 0 for no limit
+	burst  float64 // max tokens saved up
+	tokens float64
+	last   time.Time // when tokens was last updated
+	hold   time.Time // no requests before this
+}
+
+// SetRate() limits requests to rps per second, with bursts of up to one second worth of requests.
+// 0 means no limit.
+func (rl *RateLimiter) SetRate(rps float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate = rps
+	rl.burst = math.Max(1, math.Floor(rps))
+	rl.tokens = rl.burst
+	rl.last = time.Now()
+}
+
+// reserve() takes a token and returns how long to wait before using it
+func (rl *RateLimiter) reserve() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if rl.rate > 0 {
+		rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+		rl.last = now
+		rl.tokens--
+		if rl.tokens < 0 {
+			wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+		}
+	}
+	if d := rl.hold.Sub(now); d > wait {
+		wait = d
+	}
+	return wait
+}
+
+// Wait() waits until a request may be sent, or ctx is done
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	wait := rl.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < wait {
+		return context.DeadlineExceeded
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Backoff() holds back all requests for d
+func (rl *RateLimiter) Backoff(d time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if until := time.Now().Add(d); until.After(rl.hold) {
+		rl.hold = until
+	}
+}
+
+// retryAfter() returns how long the backend asks us to back off, if it does.
+// That's a 429, or a 503 with Retry-After, in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	ra := resp.Header.Get("Retry-After")
+	if ra == "" {
+		return DEF_RETRY_AFTER, resp.StatusCode == http.StatusTooManyRequests
+	}
+	if secs, err := strconv.Atoi(ra); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(ra); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return DEF_RETRY_AFTER, true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one recorded request to the backend and its response
+type Exchange struct {
+	URL         string
+	Code        int    `json:",omitempty"`
+	Status      string `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	Body        string `json:",omitempty"`
+	Error       string `json:",omitempty"` // set when no response was received at all
+}
+
+// Tape holds the raw responses a check got and what it made of them, for --record and --replay
+type Tape struct {
+	Recorded  time.Time
+	Args      []string
+	Exchanges []Exchange
+	Result    *Result `json:",omitempty"`
+
+	file   string
+	replay bool
+	mu     sync.Mutex
+}
+
+// NewTape() returns a Tape recording to the given file
+func NewTape(file string) *Tape {
+	return &Tape{
+		Recorded: time.Now(),
+		Args:     os.Args,
+		file:     file,
+	}
+}
+
+// LoadTape() reads a recorded Tape from file, for replay
+func LoadTape(file string) (*Tape, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tape{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	t.file = file
+	t.replay = true
+	return t, nil
+}
+
+// requestKey() returns the part of a URL that identifies the request, so a replay works
+// without giving the same host as when recording
+func requestKey(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return strings.TrimPrefix(pu.RequestURI(), conn.ProxyPath)
+}
+
+// Record() saves the response to a request, and returns an equivalent response for the caller to read
+func (t *Tape) Record(u string, resp *http.Response, err error) (*http.Response, error) {
+	ex := Exchange{URL: u}
+	if err != nil {
+		ex.Error = err.Error()
+	} else {
+		body, rerr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		ex.Code = resp.StatusCode
+		ex.Status = resp.Status
+		ex.ContentType = resp.Header.Get("Content-Type")
+		ex.Body = string(body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	t.mu.Lock()
+	t.Exchanges = append(t.Exchanges, ex)
+	t.mu.Unlock()
+	return resp, err
+}
+
+// Play() returns the recorded response for a request, as if it came from the backend
+func (t *Tape) Play(u string) (*http.Response, error) {
+	key := requestKey(u)
+	for _, ex := range t.Exchanges {
+		if requestKey(ex.URL) != key {
+			continue
+		}
+		if ex.Error != "" {
+			return nil, fmt.Errorf("%s (replayed)", ex.Error)
+		}
+		resp := &http.Response{
+			Status:     ex.Status,
+			StatusCode: ex.Code,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(ex.Body)),
+		}
+		if ex.ContentType != "" {
+			resp.Header.Set("Content-Type", ex.ContentType)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("No recorded response for %s in %q", key, t.file)
+}
+
+// Save() writes the Tape with the given result to its file. Does nothing when replaying.
+func (t *Tape) Save(r *Result) error {
+	if t.replay {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Result = r
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// Note() describes a replay and what the recorded run said, for the long output
+func (t *Tape) Note() string {
+	if !t.replay {
+		return ""
+	}
+	note := fmt.Sprintf("Replayed from %q, recorded %s\n", t.file, t.Recorded.Format(G_DATEFORMAT))
+	if t.Result != nil {
+		note += fmt.Sprintf("Recorded result: %s: %s\n", statusText(t.Result.Status), t.Result.Summary)
+	}
+	return note
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseResolve() parses --resolve overrides, curl style "host:port:addr", or "host:addr" for any port.
+// The returned map has "host:port" or just "host" as key, and the address to connect to instead as value.
+func parseResolve(specs []string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --resolve %q, expected host:addr or host:port:addr", spec)
+		}
+		key, addr := parts[0], strings.Join(parts[1:], ":")
+		if len(parts) == 3 {
+			if _, err := strconv.Atoi(parts[1]); err == nil {
+				key, addr = net.JoinHostPort(parts[0], parts[1]), parts[2]
+			}
+		}
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("Invalid --resolve %q: %q is not an IP address", spec, addr)
+		}
+		res[strings.ToLower(key)] = addr
+	}
+	return res, nil
+}
+
+// parseSourceIP() returns the local address to connect from, given as an IP address or a network interface
+func parseSourceIP(spec string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --source-ip %q, neither an IP address nor a network interface", spec)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			return &net.TCPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("Network interface %q has no IP address", spec)
+}
+
+// resolveDial() connects to the address given with --resolve instead of looking up the host, if there is one
+func resolveDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{}
+	if conn.SourceIP != nil {
+		d.LocalAddr = conn.SourceIP
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	ip, ok := conn.Resolve[strings.ToLower(addr)]
+	if !ok {
+		ip, ok = conn.Resolve[strings.ToLower(host)]
+	}
+	if ok {
+		log.Debugf("Connecting to %s instead of %s, as given with --resolve", ip, host)
+		addr = net.JoinHostPort(ip, port)
+	}
+	return d.DialContext(ctx, network, addr)
+}
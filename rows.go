@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+)
+
+// MalformedError is returned for a row of a response that can't be read, with --strict
+type MalformedError struct {
+	Target string
+	Row    string
+	Err    error
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("Malformed row %s in the response for %s: %v", e.Row, e.Target, e.Err)
+}
+
+type strictKey struct{}
+
+// withStrict() returns a context that has the requests made with it fail on malformed rows,
+// instead of skipping them
+func withStrict(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+type skipKey struct{}
+
+// withSkip() returns a context that has the requests made with it count the malformed rows they skip into n
+func withSkip(ctx context.Context, n *int) context.Context {
+	return context.WithValue(ctx, skipKey{}, n)
+}
+
+// malformed() decides what to do with a row that can't be read: returns a *MalformedError if the
+// context is strict, or else counts it as skipped and returns nil
+func malformed(ctx context.Context, target, row string, err error) error {
+	if strict, _ := ctx.Value(strictKey{}).(bool); strict {
+		return &MalformedError{Target: target, Row: row, Err: err}
+	}
+	log.Debugf("Skipping malformed row %s: %v", row, err)
+	if n, ok := ctx.Value(skipKey{}).(*int); ok {
+		*n++
+	}
+	return nil
+}
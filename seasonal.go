@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EV_SEASONAL string = "seasonal"
+)
+
+func init() {
+	RegisterEvaluator(EV_SEASONAL, NewSeasonalEvaluator)
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} // in the order of time.Weekday
+
+// Band is the range values are expected to be in at some hours of some days, for metrics with a daily
+// or weekly pattern. In a config file, e.g.:
+//
+//	bands:
+//	  - days: mon-fri
+//	    hours: 8-18
+//	    low: 100
+//	    high: 500
+//	  - high: 200
+//
+// On the command line, the same is --band mon-fri/8-18=100:500 --band */*=:200
+type Band struct {
+	Days  string   `yaml:"days,omitempty"`  // like mon-fri or sat,sun, all days if empty
+	Hours string   `yaml:"hours,omitempty"` // hours of the day, like 8-18 for 08:00 to 17:59, all day if empty
+	Low   *float64 `yaml:"low,omitempty"`   // no lower limit if nil
+	High  *float64 `yaml:"high,omitempty"`  // no upper limit if nil
+
+	days  [7]bool
+	hours [24]bool
+}
+
+// String() returns the band in the form of --band
+func (b *Band) String() string {
+	num := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	days, hours := b.Days, b.Hours
+	if days == "" {
+		days = "*"
+	}
+	if hours == "" {
+		hours = "*"
+	}
+	return fmt.Sprintf("%s/%s=%s:%s", days, hours, num(b.Low), num(b.High))
+}
+
+// ParseBand() parses a band given as DAYS/HOURS=LOW:HIGH, where * is all days or hours, and LOW or HIGH may be
+// left out for no limit
+func ParseBand(spec string) (*Band, error) {
+	when := strings.SplitN(spec, "=", 2)
+	if len(when) != 2 {
+		return nil, fmt.Errorf("Invalid band %q, should be DAYS/HOURS=LOW:HIGH", spec)
+	}
+	dh := strings.SplitN(when[0], "/", 2)
+	lh := strings.SplitN(when[1], ":", 2)
+	if len(dh) != 2 || len(lh) != 2 {
+		return nil, fmt.Errorf("Invalid band %q, should be DAYS/HOURS=LOW:HIGH", spec)
+	}
+	b := &Band{}
+	if dh[0] != "*" {
+		b.Days = dh[0]
+	}
+	if dh[1] != "*" {
+		b.Hours = dh[1]
+	}
+	for i, lim := range []**float64{&b.Low, &b.High} {
+		if lh[i] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(lh[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid band %q: %q is not a number", spec, lh[i])
+		}
+		*lim = &v
+	}
+	if err := b.compile(); err != nil {
+		return nil, fmt.Errorf("Invalid band %q: %v", spec, err)
+	}
+	return b, nil
+}
+
+// compile() checks the band, and works out which days and hours it applies to
+func (b *Band) compile() error {
+	if b.Low == nil && b.High == nil {
+		return fmt.Errorf("no low or high limit")
+	}
+	if b.Low != nil && b.High != nil && *b.Low > *b.High {
+		return fmt.Errorf("low limit above high limit")
+	}
+	day := func(name string) (int, error) {
+		for i, wd := range weekdays {
+			if strings.ToLower(name) == wd {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown day %q (options: %s)", name, strings.Join(weekdays, ", "))
+	}
+	hour := func(s string) (int, error) {
+		h, err := strconv.Atoi(s)
+		if err != nil || h < 0 || h > 24 {
+			return 0, fmt.Errorf("invalid hour %q, should be 0-24", s)
+		}
+		return h, nil
+	}
+	if err := spans(b.Days, b.days[:], day, true); err != nil {
+		return err
+	}
+	return spans(b.Hours, b.hours[:], hour, false)
+}
+
+// spans() marks the parts of a day or a week given like a-b,c in set, all of it if spec is empty. With
+// inclusive, a-b includes b, like for days, otherwise it doesn't, like for hours. A span may wrap around.
+func spans(spec string, set []bool, parse func(string) (int, error), inclusive bool) error {
+	if spec == "" {
+		for i := range set {
+			set[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		ends := strings.SplitN(part, "-", 2)
+		from, err := parse(ends[0])
+		if err != nil {
+			return err
+		}
+		to := from
+		if len(ends) == 2 {
+			if to, err = parse(ends[1]); err != nil {
+				return err
+			}
+			if !inclusive {
+				to--
+			}
+		}
+		for i := from; ; i = (i + 1) % len(set) {
+			set[i%len(set)] = true
+			if i%len(set) == (to+len(set))%len(set) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Applies() tells if the band is for the given time
+func (b *Band) Applies(t time.Time) bool {
+	return b.days[t.Weekday()] && b.hours[t.Hour()]
+}
+
+// Range() returns the band as a range as per the Nagios plugin guidelines, alerting outside it
+func (b *Band) Range() string {
+	low, high := "~", ""
+	if b.Low != nil {
+		low = strconv.FormatFloat(*b.Low, 'f', -1, 64)
+	}
+	if b.High != nil {
+		high = strconv.FormatFloat(*b.High, 'f', -1, 64)
+	}
+	return low + ":" + high
+}
+
+// Outside() tells how far a value is outside the band, 0 if it's within
+func (b *Band) Outside(val float64) float64 {
+	switch {
+	case b.Low != nil && val < *b.Low:
+		return *b.Low - val
+	case b.High != nil && val > *b.High:
+		return val - *b.High
+	}
+	return 0
+}
+
+// SeasonalEvaluator expects the value of each metric to be within the band for the time of its latest
+// datapoint, where the first band that applies counts. Any metric outside its band is CRITICAL.
+type SeasonalEvaluator struct {
+	Bands []*Band
+	Top   int // how many metrics to keep in each state, 0 for all
+}
+
+// NewSeasonalEvaluator() creates a SeasonalEvaluator from --band
+func NewSeasonalEvaluator(c *cli.Context) (Evaluator, error) {
+	se := &SeasonalEvaluator{Top: c.Int("top")}
+	for _, spec := range c.StringSlice("band") {
+		b, err := ParseBand(spec)
+		if err != nil {
+			return nil, err
+		}
+		se.Bands = append(se.Bands, b)
+	}
+	if len(se.Bands) == 0 {
+		return nil, fmt.Errorf("The %s evaluator needs --band, or bands in the config file", EV_SEASONAL)
+	}
+	return se, nil
+}
+
+// band() returns the band for a time, nil if there's none
+func (se *SeasonalEvaluator) band(t time.Time) *Band {
+	for _, b := range se.Bands {
+		if b.Applies(t.Local()) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Evaluate() implements Evaluator
+func (se *SeasonalEvaluator) Evaluate(ms Metrics) *Evaluation {
+	outside := make(map[*Metric]float64, len(ms))
+	o, c := Metrics{}, Metrics{}
+	var unbanded int
+	var worst *Metric
+	for _, m := range ms {
+		b := se.band(m.TS)
+		if b == nil {
+			unbanded++
+			o = append(o, m)
+			continue
+		}
+		outside[m] = b.Outside(m.Value)
+		if outside[m] > 0 {
+			c = append(c, m)
+			if worst == nil || outside[m] > outside[worst] {
+				worst = m
+			}
+		} else {
+			o = append(o, m)
+		}
+	}
+	log.Debugf("#c: %d, #o: %d, without band: %d\n", len(c), len(o), unbanded)
+
+	// helper func, sorts metrics furthest outside first, and keeps the first Top of them
+	top := func(ms Metrics) Metrics {
+		sort.Slice(ms, func(i, j int) bool {
+			oi, oj := outside[ms[i]], outside[ms[j]]
+			return oi > oj || (oi == oj && ms[i].Path < ms[j].Path)
+		})
+		if se.Top > 0 && len(ms) > se.Top {
+			return ms[:se.Top]
+		}
+		return ms
+	}
+
+	ev := &Evaluation{}
+	var bnote string // "band note"
+	if b := se.band(time.Now()); b != nil {
+		bnote = fmt.Sprintf(" (band now %s)", b)
+		ev.Crit = b.Range()
+	}
+	if unbanded > 0 {
+		bnote += fmt.Sprintf(", %d metrics without a band for the time", unbanded)
+	}
+
+	// helper func
+	perf := func(bucket Metrics) []PerfData {
+		return []PerfData{
+			{Label: "value", Value: bucket.Avg(), Unknown: len(bucket) == 0, Crit: ev.Crit},
+			{Label: "num_matching_metrics", Value: float64(len(bucket)), Count: true},
+		}
+	}
+
+	switch {
+	case len(ms) == 0:
+		ev.Status = E_UNKNOWN
+		ev.Summary = "No values to evaluate"
+		ev.Perf = perf(Metrics{})
+	case len(c) > 0:
+		ev.Status = E_CRITICAL
+		ev.Summary = fmt.Sprintf("%d metrics outside their expected band, e.g. %s at %.02f, expected %s%s",
+			len(c), worst.Path, worst.Value, se.band(worst.TS), bnote)
+		ev.Perf = perf(c)
+	default:
+		ev.Status = E_OK
+		ev.Summary = fmt.Sprintf("%d metrics within their expected band%s", len(o), bnote)
+		ev.Perf = perf(o)
+	}
+
+	ev.C = top(c)
+	ev.W = Metrics{}
+	ev.O = top(o)
+	return ev
+}
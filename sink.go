@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink is somewhere results of checks run in process go
+type Sink interface {
+	Write(r *Result) error
+	Flush() error
+	Close() error
+}
+
+// WriterSink writes results in a given format to a file or stdout, buffered
+type WriterSink struct {
+	format Formatter
+	buf    *bufio.Writer
+	c      io.Closer // nil for stdout, which isn't ours to close
+	mu     sync.Mutex
+}
+
+// NewSink() opens a sink for the given file, appending to it. "-" means stdout.
+func NewSink(file string, format Formatter) (Sink, error) {
+	if file == DEF_SINK {
+		return &WriterSink{format: format, buf: bufio.NewWriter(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterSink{format: format, buf: bufio.NewWriter(f), c: f}, nil
+}
+
+func (ws *WriterSink) Write(r *Result) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.buf.WriteString(ws.format.Format(r))
+	return err
+}
+
+func (ws *WriterSink) Flush() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.buf.Flush()
+}
+
+func (ws *WriterSink) Close() error {
+	err := ws.Flush()
+	if ws.c != nil {
+		if cerr := ws.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
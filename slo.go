@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_SLO_OBJECTIVE   float64 = 99.9
+	DEF_SLO_PERIOD      string  = "30d"
+	DEF_SLO_BURN_WINDOW string  = "1h"
+	DEF_SLO_BURN_WARN   float64 = 6    // 5% of a 30 day budget in 6 hours
+	DEF_SLO_BURN_CRIT   float64 = 14.4 // 2% of a 30 day budget in 1 hour
+)
+
+// sloFlags are the flags of the slo subcommand
+var sloFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "good",
+		Usage: "Target for the number of good events, e.g. successful requests, per datapoint",
+	},
+	cli.StringFlag{
+		Name:  "total",
+		Usage: "Target for the number of all events per datapoint",
+	},
+	cli.Float64Flag{
+		Name:  "objective",
+		Value: DEF_SLO_OBJECTIVE,
+		Usage: "Percentage of events that should be good",
+	},
+	cli.StringFlag{
+		Name:  "period",
+		Value: DEF_SLO_PERIOD,
+		Usage: "Time period the objective is for, and the error budget is spent over",
+	},
+	cli.StringFlag{
+		Name:  "burn-window",
+		Value: DEF_SLO_BURN_WINDOW,
+		Usage: "Time period to measure how fast the error budget is burning over",
+	},
+	cli.Float64Flag{
+		Name:  "warning, w",
+		Value: DEF_SLO_BURN_WARN,
+		Usage: "Burn rate to result in WARNING status, where 1 spends exactly the error budget over the period",
+	},
+	cli.Float64Flag{
+		Name:  "critical, c",
+		Value: DEF_SLO_BURN_CRIT,
+		Usage: "Burn rate to result in CRITICAL status. Running out of error budget is always CRITICAL.",
+	},
+}
+
+// sumPoints() adds up all datapoints of all metrics, for events counted per datapoint
+func sumPoints(ms Metrics) float64 {
+	var total float64
+	for _, m := range ms {
+		for _, p := range m.Points {
+			total += p.Value
+		}
+	}
+	return total
+}
+
+// run_slo() checks how much of the error budget of a service level objective is left, and how fast it's burning.
+// The targets should be counts of events per datapoint, like from Graphite's hitcount() or a statsd counter.
+func run_slo(c *cli.Context) {
+	urlprefix := c.GlobalString("urlprefix")
+	prot := c.GlobalString("protocol")
+	host := c.GlobalString("hostname")
+	port := c.GlobalUint64("port")
+	tmout := c.GlobalFloat64("timeout")
+	good := c.String("good")
+	total := c.String("total")
+	objective := c.Float64("objective")
+	period := c.String("period")
+	burnwin := c.String("burn-window")
+	warn := c.Float64("warning")
+	crit := c.Float64("critical")
+
+	if good == "" || total == "" {
+		fmt.Printf("%s: Both --good and --total are needed\n", S_UNKNOWN)
+		exit(E_UNKNOWN)
+	}
+	if objective <= 0 || objective >= 100 {
+		fmt.Printf("%s: Invalid --objective %g, should be a percentage above 0 and below 100\n", S_UNKNOWN, objective)
+		exit(E_UNKNOWN)
+	}
+	for _, p := range []string{period, burnwin} {
+		if _, err := graphiteDuration(p); err != nil {
+			fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+			exit(E_UNKNOWN)
+		}
+	}
+
+	base, err := base_url(urlprefix, prot, host, port)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ds, err := NewDatasource(c.GlobalString("backend"), base)
+	if err != nil {
+		fmt.Printf("%s: %v\n", S_UNKNOWN, err)
+		exit(E_UNKNOWN)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+	defer cancel()
+
+	// good and total events, over the whole period and over the burn window
+	queries := []struct {
+		target string
+		window Window
+	}{{good, Window{Period: period}}, {total, Window{Period: period}}, {good, Window{Period: burnwin}}, {total, Window{Period: burnwin}}}
+	chans := make([]chan GraphiteResponse, len(queries))
+	for i, q := range queries {
+		log.Debugf("Fetching %s over %s", q.target, q.window)
+		chans[i] = make(chan GraphiteResponse, 1) // buffered, so late responses don't block after a timeout
+		go parse(ctx, ds, []string{q.target}, q.window, chans[i])
+	}
+	sums := make([]float64, len(queries))
+	var rt float64
+	for i, q := range queries {
+		var res GraphiteResponse
+		select {
+		case res = <-chans[i]:
+		case <-ctx.Done():
+			fmt.Printf("%s: Timed out after %d seconds\n", S_CRITICAL, int(tmout))
+			exit(E_CRITICAL)
+		}
+		if res.Err != nil {
+			fmt.Printf("%s: Error parsing result for %s: %q\n", S_CRITICAL, q.target, res.Err)
+			exit(E_CRITICAL)
+		}
+		sums[i] = sumPoints(res.MS)
+		if res.RT > rt {
+			rt = res.RT
+		}
+	}
+
+	allowed := 1 - objective/100 // part of events that may be bad
+	if sums[1] == 0 {
+		fmt.Printf("%s: No events in %s within %s range\n", S_UNKNOWN, total, period)
+		exit(E_UNKNOWN)
+	}
+	bad := (sums[1] - sums[0]) / sums[1]
+	remaining := (1 - bad/allowed) * 100
+	var burn float64
+	if sums[3] > 0 {
+		burn = (sums[3] - sums[2]) / sums[3] / allowed
+	}
+
+	ecode := E_OK
+	var note string
+	switch {
+	case remaining <= 0:
+		ecode = E_CRITICAL
+		note = ", error budget spent"
+	case burn > crit:
+		ecode = E_CRITICAL
+		note = fmt.Sprintf(", above the critical burn rate of %gx", crit)
+	case burn > warn:
+		ecode = E_WARNING
+		note = fmt.Sprintf(", above the warning burn rate of %gx", warn)
+	}
+	perf := []PerfData{
+		{Label: "error_budget_remaining", Value: remaining, UOM: "%", Crit: "0:", Max: "100"},
+		{Label: "burn_rate", Value: burn, Warn: fmt.Sprintf("%g", warn), Crit: fmt.Sprintf("%g", crit), Min: "0"},
+		{Label: "good_events", Value: sums[0], UOM: "c"},
+		{Label: "total_events", Value: sums[1], UOM: "c"},
+		{Label: "response_time", Value: rt, UOM: "s"},
+	}
+	pds := make([]string, len(perf))
+	for i := range perf {
+		pds[i] = perf[i].String()
+	}
+	fmt.Printf("%s: SLO %g%% over %s at %.03f%%, %.01f%% of error budget left, burning at %.02fx over %s%s |%s\n",
+		statusText(ecode), objective, period, (1-bad)*100, remaining, burn, burnwin, note, strings.Join(pds, " "))
+	exit(ecode)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Ways to smooth series, for --smooth
+const (
+	SM_EWMA string = "ewma" // exponentially weighted moving average
+	SM_SMA  string = "sma"  // simple moving average
+)
+
+// Smoothing smooths each series before it's judged, so single noisy datapoints don't trigger alerts
+type Smoothing struct {
+	Kind  string
+	Alpha float64 // weight of the newest datapoint, for SM_EWMA
+	N     int     // datapoints to average over, for SM_SMA
+}
+
+// ParseSmoothing() parses ewma:ALPHA or sma:N
+func ParseSmoothing(spec string) (*Smoothing, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid --smooth %q, should be %s:ALPHA or %s:N", spec, SM_EWMA, SM_SMA)
+	}
+	sm := &Smoothing{Kind: parts[0]}
+	switch sm.Kind {
+	case SM_EWMA:
+		alpha, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("Invalid --smooth %q, ALPHA should be above 0 and at most 1", spec)
+		}
+		sm.Alpha = alpha
+	case SM_SMA:
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid --smooth %q, N should be a number of datapoints above 0", spec)
+		}
+		sm.N = n
+	default:
+		return nil, fmt.Errorf("Invalid --smooth %q: unknown kind %q (options: %s, %s)", spec, sm.Kind, SM_EWMA, SM_SMA)
+	}
+	return sm, nil
+}
+
+// Apply() replaces the datapoints of each metric with the smoothed ones, and its value with the latest of them
+func (sm *Smoothing) Apply(ms Metrics) {
+	for _, m := range ms {
+		if len(m.Points) == 0 {
+			continue
+		}
+		pts := make([]Point, len(m.Points))
+		copy(pts, m.Points)
+		switch sm.Kind {
+		case SM_EWMA:
+			for i := 1; i < len(pts); i++ {
+				pts[i].Value = sm.Alpha*m.Points[i].Value + (1-sm.Alpha)*pts[i-1].Value
+			}
+		case SM_SMA:
+			var total float64
+			for i := range pts {
+				total += m.Points[i].Value
+				n := i + 1
+				if i >= sm.N {
+					total -= m.Points[i-sm.N].Value
+					n = sm.N
+				}
+				pts[i].Value = total / float64(n)
+			}
+		}
+		m.Points = pts
+		m.Value = pts[len(pts)-1].Value
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/gosnmp/gosnmp"
+	"github.com/urfave/cli"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEF_SNMP_PORT      uint16 = 162
+	DEF_SNMP_COMMUNITY string = "public"
+	DEF_SNMP_OID       string = "1.3.6.1.4.1.8072.9999.9999.1" // NET-SNMP-MIB::netSnmpPlaypen, for a start
+	DEF_SNMP_VERSION   string = "2c"
+
+	OID_SNMPTRAP string = "1.3.6.1.6.3.1.1.4.1.0" // snmpTrapOID.0
+)
+
+// SNMPTrap sends results as SNMP traps, for the trap receivers of a NOC. The trap has the OID given,
+// and varbinds under it for the status code (.1), status (.2), check name (.3), summary (.4),
+// host (.5) and long output (.6).
+type SNMPTrap struct {
+	OID  string
+	snmp *gosnmp.GoSNMP
+}
+
+// snmpAuthProtocol() returns the SNMPv3 authentication protocol by name, like SHA256
+func snmpAuthProtocol(name string) (gosnmp.SnmpV3AuthProtocol, error) {
+	all := []gosnmp.SnmpV3AuthProtocol{gosnmp.MD5, gosnmp.SHA, gosnmp.SHA224, gosnmp.SHA256, gosnmp.SHA384, gosnmp.SHA512}
+	names := make([]string, len(all))
+	for i, p := range all {
+		if strings.EqualFold(name, p.String()) {
+			return p, nil
+		}
+		names[i] = p.String()
+	}
+	return gosnmp.NoAuth, fmt.Errorf("Unknown --snmp-auth-protocol %q (options: %s)", name, strings.Join(names, ", "))
+}
+
+// snmpPrivProtocol() returns the SNMPv3 privacy protocol by name, like AES
+func snmpPrivProtocol(name string) (gosnmp.SnmpV3PrivProtocol, error) {
+	all := []gosnmp.SnmpV3PrivProtocol{gosnmp.DES, gosnmp.AES, gosnmp.AES192, gosnmp.AES256, gosnmp.AES192C, gosnmp.AES256C}
+	names := make([]string, len(all))
+	for i, p := range all {
+		if strings.EqualFold(name, p.String()) {
+			return p, nil
+		}
+		names[i] = p.String()
+	}
+	return gosnmp.NoPriv, fmt.Errorf("Unknown --snmp-priv-protocol %q (options: %s)", name, strings.Join(names, ", "))
+}
+
+// snmpEngineID() returns the engine ID given in hex, or one made from the name of this host, as
+// RFC 3411 has it for text, under the enterprise number of NET-SNMP
+func snmpEngineID(s string) (string, error) {
+	if s != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return "", fmt.Errorf("Invalid --snmp-engine-id %q, should be 5-32 bytes in hex", s)
+		}
+		return string(id), nil
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "check_graphite"
+	}
+	if len(host) > 27 {
+		host = host[:27]
+	}
+	return "\x80\x00\x1f\x88\x04" + host, nil
+}
+
+// validOID() tells if s is a numeric OID, like 1.3.6.1.4.1
+func validOID(s string) bool {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSNMPTrap() sets up sending traps as given by the flags in c
+func NewSNMPTrap(c *cli.Context) (*SNMPTrap, error) {
+	host, port := c.String("snmp-trap"), DEF_SNMP_PORT
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("Invalid port in --snmp-trap %q", host)
+		}
+		host, port = h, uint16(n)
+	}
+	oid := strings.TrimPrefix(c.String("snmp-oid"), ".")
+	if !validOID(oid) {
+		return nil, fmt.Errorf("Invalid --snmp-oid %q, should be numeric, like %s", c.String("snmp-oid"), DEF_SNMP_OID)
+	}
+	snmp := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Community: c.String("snmp-community"),
+		Timeout:   time.Duration(c.Float64("timeout") * float64(time.Second)),
+		MaxOids:   gosnmp.MaxOids,
+	}
+	switch v := c.String("snmp-version"); v {
+	case "2c":
+		snmp.Version = gosnmp.Version2c
+	case "3":
+		snmp.Version = gosnmp.Version3
+		snmp.SecurityModel = gosnmp.UserSecurityModel
+		snmp.MsgFlags = gosnmp.NoAuthNoPriv
+		usm := &gosnmp.UsmSecurityParameters{UserName: c.String("snmp-user")}
+		if usm.UserName == "" {
+			return nil, fmt.Errorf("No --snmp-user given for SNMPv3")
+		}
+		var err error
+		if usm.AuthoritativeEngineID, err = snmpEngineID(c.String("snmp-engine-id")); err != nil {
+			return nil, err
+		}
+		if pw := c.String("snmp-auth-password"); pw != "" {
+			if usm.AuthenticationProtocol, err = snmpAuthProtocol(c.String("snmp-auth-protocol")); err != nil {
+				return nil, err
+			}
+			usm.AuthenticationPassphrase = pw
+			snmp.MsgFlags = gosnmp.AuthNoPriv
+		}
+		if pw := c.String("snmp-priv-password"); pw != "" {
+			if snmp.MsgFlags == gosnmp.NoAuthNoPriv {
+				return nil, fmt.Errorf("--snmp-priv-password needs --snmp-auth-password as well")
+			}
+			if usm.PrivacyProtocol, err = snmpPrivProtocol(c.String("snmp-priv-protocol")); err != nil {
+				return nil, err
+			}
+			usm.PrivacyPassphrase = pw
+			snmp.MsgFlags = gosnmp.AuthPriv
+		}
+		snmp.SecurityParameters = usm
+	default:
+		return nil, fmt.Errorf("Invalid --snmp-version %q (options: 2c, 3)", v)
+	}
+	return &SNMPTrap{OID: oid, snmp: snmp}, nil
+}
+
+// Send() sends the result as a trap
+func (t *SNMPTrap) Send(r *Result) error {
+	vars := []gosnmp.SnmpPDU{
+		{Name: OID_SNMPTRAP, Type: gosnmp.ObjectIdentifier, Value: t.OID},
+		{Name: t.OID + ".1", Type: gosnmp.Integer, Value: r.Status},
+		{Name: t.OID + ".2", Type: gosnmp.OctetString, Value: statusText(r.Status)},
+		{Name: t.OID + ".3", Type: gosnmp.OctetString, Value: r.Name},
+		{Name: t.OID + ".4", Type: gosnmp.OctetString, Value: r.summary()},
+		{Name: t.OID + ".5", Type: gosnmp.OctetString, Value: r.Host},
+		{Name: t.OID + ".6", Type: gosnmp.OctetString, Value: r.Long},
+	}
+	if err := t.snmp.Connect(); err != nil {
+		return err
+	}
+	defer t.snmp.Conn.Close()
+	_, err := t.snmp.SendTrap(gosnmp.SnmpTrap{Variables: vars})
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// the bars of a sparkline, lowest first
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline() draws values as a line of bars, scaled between the lowest and highest of them
+func sparkline(vals []float64) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range vals {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	bars := make([]rune, len(vals))
+	for i, v := range vals {
+		n := len(sparkBars) / 2 // flat, somewhere in the middle
+		if hi > lo {
+			n = int((v - lo) / (hi - lo) * float64(len(sparkBars)-1))
+		}
+		bars[i] = sparkBars[n]
+	}
+	return string(bars)
+}
+
+// add_column() appends a column to the lines of the metrics in the state sections of long output,
+// as output by long_output(), by path
+func add_column(lo string, col map[string]string, align int) string {
+	lines := strings.Split(lo, "\n")
+	in := false
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "===> Metrics in state "):
+			in = true
+			continue
+		case l == "":
+			in = false
+			continue
+		}
+		if !in || len(l) <= align || l[align] != ' ' {
+			continue
+		}
+		if c, ok := col[strings.TrimRight(l[:align], " ")]; ok {
+			lines[i] = l + "  " + c
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// History keeps the values of each metric in the last runs, for --history
+type History struct {
+	Values map[string][]float64 `json:"values"` // oldest first
+}
+
+// LoadHistory() reads the history from the state
+func LoadHistory(st *State) (*History, error) {
+	h := &History{}
+	_, err := st.Get("history", h)
+	if h.Values == nil {
+		h.Values = make(map[string][]float64)
+	}
+	return h, err
+}
+
+// Update() adds the values of this run, keeping the last n of each metric. Metrics not seen in
+// this run are dropped, so the history doesn't grow with series that went away.
+func (h *History) Update(ms Metrics, n int) {
+	vals := make(map[string][]float64, len(ms))
+	for _, m := range ms {
+		v := append(h.Values[m.Path], m.Value)
+		if len(v) > n {
+			v = v[len(v)-n:]
+		}
+		vals[m.Path] = v
+	}
+	h.Values = vals
+}
+
+// Save() puts the history in the state
+func (h *History) Save(st *State) error {
+	return st.Put("history", h)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+)
+
+// largestJump() returns the largest change between two datapoints in a row within the series of m,
+// up or down
+func largestJump(m *Metric) float64 {
+	var largest float64
+	for i := 1; i < len(m.Points); i++ {
+		if d := math.Abs(m.Points[i].Value - m.Points[i-1].Value); d > largest {
+			largest = d
+		}
+	}
+	return largest
+}
+
+// Spikes() splits out the metrics that jumped more than the warning and critical limits from one
+// datapoint to the next, flagging sudden steps even when the values stay within the thresholds.
+// A limit of 0 or less is not checked. The largest jump of all metrics is returned as well.
+func Spikes(ms Metrics, warn, crit float64) (w, c Metrics, largest float64) {
+	w, c = Metrics{}, Metrics{}
+	for _, m := range ms {
+		j := largestJump(m)
+		if j > largest {
+			largest = j
+		}
+		switch {
+		case crit > 0 && j > crit:
+			c = append(c, m)
+		case warn > 0 && j > warn:
+			w = append(w, m)
+		}
+	}
+	return w, c, largest
+}
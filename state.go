@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State is a small key/value store kept between runs of a check, one file per check identity.
+// It's locked from OpenState() until Close(), so concurrent runs of the same check take turns.
+type State struct {
+	file   string
+	lock   *os.File
+	values map[string]json.RawMessage
+	dirty  bool
+}
+
+// defaultStateDir() returns where to keep state by default: a directory of our own under
+// $XDG_STATE_HOME or ~/.local/state, rather than the shared temp dir where others could plant files
+func defaultStateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			dir = filepath.Join(home, ".local", "state")
+		}
+	}
+	if dir == "" {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("check_graphite-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "check_graphite")
+}
+
+// StateFile() returns the state file in dir for the check with the given identity
+func StateFile(dir, id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return filepath.Join(dir, fmt.Sprintf("check_graphite_%08x.json", h.Sum32()))
+}
+
+// OpenState() locks and reads the state in file, waiting for the lock until ctx ends. A missing file is
+// an empty state.
+func OpenState(ctx context.Context, file string) (*State, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(ctx, lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	st := &State{file: file, lock: lock, values: make(map[string]json.RawMessage)}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		st.unlock()
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &st.values); err != nil {
+			st.unlock()
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return st, nil
+}
+
+// Get() reads the value of key into v. The bool return value is false if there was no such key.
+func (st *State) Get(key string, v interface{}) (bool, error) {
+	data, ok := st.values[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s: %s: %v", st.file, key, err)
+	}
+	return true, nil
+}
+
+// Put() sets the value of key, to be saved on Close()
+func (st *State) Put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	st.values[key] = data
+	st.dirty = true
+	return nil
+}
+
+// Delete() removes key, to be saved on Close()
+func (st *State) Delete(key string) {
+	if _, ok := st.values[key]; ok {
+		delete(st.values, key)
+		st.dirty = true
+	}
+}
+
+// Close() saves the state if changed, via a temp file to not leave a half written state behind,
+// and unlocks it. The temp file gets a name of its own, so it can't be one planted there by
+// someone else. Closing it again does nothing.
+func (st *State) Close() error {
+	if st.lock == nil {
+		return nil
+	}
+	defer st.unlock()
+	if !st.dirty {
+		return nil
+	}
+	data, err := json.Marshal(st.values)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(st.file), filepath.Base(st.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), st.file)
+}
+
+func (st *State) unlock() {
+	unlockFile(st.lock)
+	st.lock.Close()
+	st.lock = nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	DEF_LOCK_RETRY time.Duration = 50 * time.Millisecond // how often to try for a lock another run holds
+)
+
+// lockFile() takes an exclusive lock on f, waiting for it if needed, but not past the end of ctx
+func lockFile(ctx context.Context, f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("state locked by another run of the check, gave up waiting: %v", ctx.Err())
+		case <-time.After(DEF_LOCK_RETRY):
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenStateLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_graphite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	held, err := OpenState(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another run gives up when its time is up
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := OpenState(ctx, file); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("got %v while locked, want it to give up", err)
+	}
+
+	// and gets it once released in time
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := OpenState(ctx, file)
+	if err != nil {
+		t.Fatalf("got %v after the lock was released", err)
+	}
+	st.Close()
+}
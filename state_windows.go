@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// lockFile() does nothing on Windows, so concurrent runs of the same check may lose state updates
+func lockFile(ctx context.Context, f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Guard is a metric that, when its condition holds, suppresses alerts of the check, like a
+// maintenance mode flag. Given with --suppress-if.
+type Guard struct {
+	Target    string
+	Condition string
+	Value     float64
+}
+
+// ParseGuard() parses TARGET:COND:VALUE, e.g. ops.maintenance_mode:gt:0. The target may have colons of its own.
+func ParseGuard(spec string) (*Guard, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 || parts[0] == "" {
+		return nil, fmt.Errorf("Invalid --suppress-if %q, should be TARGET:COND:VALUE", spec)
+	}
+	n := len(parts)
+	g := &Guard{Target: strings.Join(parts[:n-2], ":"), Condition: parts[n-2]}
+	switch g.Condition {
+	case CMP_LT, CMP_LE, CMP_GE, CMP_GT:
+	default:
+		return nil, fmt.Errorf("Invalid --suppress-if %q: unknown condition %q", spec, g.Condition)
+	}
+	var err error
+	if g.Value, err = strconv.ParseFloat(parts[n-1], 64); err != nil {
+		return nil, fmt.Errorf("Invalid --suppress-if %q: %q is not a number", spec, parts[n-1])
+	}
+	return g, nil
+}
+
+// Holds() tells if any of the metrics of the guard meets its condition, and if so, why
+func (g *Guard) Holds(ms Metrics) (bool, string) {
+	for _, m := range ms {
+		if checkIf(g.Condition, m.Value, g.Value) {
+			return true, fmt.Sprintf("%s is %.02f", m.Path, m.Value)
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ReadTargets() reads metric paths from a file, one per line, or from stdin if file is "-".
+// Empty lines and lines starting with # are skipped.
+func ReadTargets(file string) ([]string, error) {
+	var r io.Reader
+	if file == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var targets []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	return targets, scanner.Err()
+}
+
+// Matches {name} and {env:NAME} placeholders. Graphite's own {a,b} alternatives never match, as
+// commas are not allowed in names.
+var macroRE = regexp.MustCompile(`\{(env:)?([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// ParseVars() parses a list of key=value strings into a map
+func ParseVars(list []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, kv := range list {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid variable %q, should be in the form key=value", kv)
+		}
+		vars[kv[:i]] = kv[i+1:]
+	}
+	return vars, nil
+}
+
+// ExpandMacros() replaces {name} with the value of the variable name, and {env:NAME} with the
+// value of the environment variable NAME. Placeholders for undefined variables are left alone, as
+// they might be Graphite's own {alternative} syntax, but undefined environment variables are an error.
+func ExpandMacros(s string, vars map[string]string) (string, error) {
+	var err error
+	res := macroRE.ReplaceAllStringFunc(s, func(m string) string {
+		sm := macroRE.FindStringSubmatch(m)
+		if sm[1] != "" {
+			val, ok := os.LookupEnv(sm[2])
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %q referenced in %q is not set", sm[2], s)
+			}
+			return val
+		}
+		if val, ok := vars[sm[2]]; ok {
+			return val
+		}
+		return m
+	})
+	return res, err
+}
+
+// Wrapping is the Graphite functions to wrap all targets in, as given with flags
+type Wrapping struct {
+	TransformNull string // value to replace missing datapoints with, "" for none
+	KeepLast      int    // how many missing datapoints in a row to replace with the last value, 0 for no limit, -1 for none
+	Summarize     string // interval to summarize datapoints into, "" for none
+	SummarizeFunc string // how to summarize them, e.g. avg
+}
+
+// the functions summarize() takes, besides percentiles like p90
+var summarizeFuncs = map[string]bool{
+	"sum": true, "total": true, "avg": true, "average": true, "median": true, "min": true, "max": true,
+	"first": true, "last": true, "count": true, "range": true, "diff": true, "stddev": true, "multiply": true,
+}
+
+var percentileRE = regexp.MustCompile(`^p\d+(\.\d+)?$`)
+
+// ParseSummarize() parses the interval and function to summarize with, as INTERVAL[,FUNC].
+// FUNC defaults to sum, like in Graphite.
+func (w *Wrapping) ParseSummarize(spec string) error {
+	parts := strings.SplitN(spec, ",", 2)
+	if _, err := graphiteDuration(parts[0]); err != nil {
+		return fmt.Errorf("Invalid --summarize %q: %v", spec, err)
+	}
+	w.Summarize, w.SummarizeFunc = parts[0], "sum"
+	if len(parts) == 2 {
+		w.SummarizeFunc = parts[1]
+		if !summarizeFuncs[w.SummarizeFunc] && !percentileRE.MatchString(w.SummarizeFunc) {
+			return fmt.Errorf("Invalid --summarize %q: unknown function %q", spec, w.SummarizeFunc)
+		}
+	}
+	return nil
+}
+
+// Empty() returns true if targets are left as they are
+func (w *Wrapping) Empty() bool {
+	return w.TransformNull == "" && w.KeepLast < 0 && w.Summarize == ""
+}
+
+// Wrap() wraps target in the functions, keepLastValue() innermost, so any gap it leaves is then
+// filled by transformNull(), and summarize() outermost, to work on the filled in datapoints
+func (w *Wrapping) Wrap(target string) string {
+	if w.KeepLast == 0 {
+		target = fmt.Sprintf("keepLastValue(%s)", target)
+	} else if w.KeepLast > 0 {
+		target = fmt.Sprintf("keepLastValue(%s,%d)", target, w.KeepLast)
+	}
+	if w.TransformNull != "" {
+		target = fmt.Sprintf("transformNull(%s,%s)", target, w.TransformNull)
+	}
+	if w.Summarize != "" {
+		target = fmt.Sprintf("summarize(%s,'%s','%s')", target, w.Summarize, w.SummarizeFunc)
+	}
+	return target
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Classes of failures, for Result.Failure
+const (
+	FAIL_CONFIG  string = "config"  // the check can't run as given
+	FAIL_TIMEOUT string = "timeout" // the backend didn't answer in time
+	FAIL_BACKEND string = "backend" // the backend couldn't be reached, or answered with an error
+	FAIL_BUDGET  string = "budget"  // the data didn't fit in --max-memory
+	FAIL_STATE   string = "state"   // the state file couldn't be read or saved
+	FAIL_OP5     string = "op5"     // results couldn't be submitted to op5
+	FAIL_DATA    string = "data"    // the backend answered with rows that couldn't be read, with --strict
+)
+
+// upper bounds of the buckets of check duration histograms, in seconds
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations into durationBuckets
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// counterKey identifies a counter by check, and status or failure class
+type counterKey struct {
+	Check string
+	Label string
+}
+
+// Telemetry keeps track of what the daemon itself does, to monitor the monitor
+type Telemetry struct {
+	running   int64 // checks running right now, accessed atomically
+	mu        sync.Mutex
+	executed  map[counterKey]uint64 // by status
+	failures  map[counterKey]uint64 // by failure class
+	durations map[string]*histogram // per check
+}
+
+// NewTelemetry() returns empty Telemetry
+func NewTelemetry() *Telemetry {
+	return &Telemetry{
+		executed:  make(map[counterKey]uint64),
+		failures:  make(map[counterKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// Started() counts a check as running, until Done() is called for it
+func (t *Telemetry) Started() {
+	atomic.AddInt64(&t.running, 1)
+}
+
+// Done() records the result of a check run and how long it took
+func (t *Telemetry) Done(name string, r *Result, seconds float64) {
+	atomic.AddInt64(&t.running, -1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.executed[counterKey{name, statusText(r.Status)}]++
+	if r.Failure != "" {
+		t.failures[counterKey{name, r.Failure}]++
+	}
+
+	h := t.durations[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		t.durations[name] = h
+	}
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// sortedKeys() returns the keys of a set of counters in order, for stable output
+func sortedKeys(m map[counterKey]uint64) []counterKey {
+	keys := make([]counterKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Check != keys[j].Check {
+			return keys[i].Check < keys[j].Check
+		}
+		return keys[i].Label < keys[j].Label
+	})
+	return keys
+}
+
+// Write() formats all telemetry in the Prometheus text format
+func (t *Telemetry) Write(buf *bytes.Buffer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP check_graphite_checks_total Checks run, by resulting status\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_checks_total counter\n")
+	for _, k := range sortedKeys(t.executed) {
+		fmt.Fprintf(buf, "check_graphite_checks_total{check=\"%s\",status=\"%s\"} %d\n", omLabel(k.Check), k.Label, t.executed[k])
+	}
+
+	fmt.Fprintf(buf, "# HELP check_graphite_check_failures_total Checks that couldn't be evaluated, by class of failure\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_check_failures_total counter\n")
+	for _, k := range sortedKeys(t.failures) {
+		fmt.Fprintf(buf, "check_graphite_check_failures_total{check=\"%s\",class=\"%s\"} %d\n", omLabel(k.Check), k.Label, t.failures[k])
+	}
+
+	fmt.Fprintf(buf, "# HELP check_graphite_check_duration_seconds How long checks take to run\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_check_duration_seconds histogram\n")
+	names := make([]string, 0, len(t.durations))
+	for name := range t.durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := t.durations[name]
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(buf, "check_graphite_check_duration_seconds_bucket{check=\"%s\",le=\"%g\"} %d\n", omLabel(name), le, cum)
+		}
+		fmt.Fprintf(buf, "check_graphite_check_duration_seconds_bucket{check=\"%s\",le=\"+Inf\"} %d\n", omLabel(name), h.count)
+		fmt.Fprintf(buf, "check_graphite_check_duration_seconds_sum{check=\"%s\"} %f\n", omLabel(name), h.sum)
+		fmt.Fprintf(buf, "check_graphite_check_duration_seconds_count{check=\"%s\"} %d\n", omLabel(name), h.count)
+	}
+
+	fmt.Fprintf(buf, "# HELP check_graphite_checks_running Checks running right now\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_checks_running gauge\n")
+	fmt.Fprintf(buf, "check_graphite_checks_running %d\n", atomic.LoadInt64(&t.running))
+
+	fmt.Fprintf(buf, "# HELP check_graphite_requests_inflight Requests to the backend in flight\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_requests_inflight gauge\n")
+	fmt.Fprintf(buf, "check_graphite_requests_inflight %d\n", atomic.LoadInt64(&conn.inflight))
+
+	fmt.Fprintf(buf, "# HELP check_graphite_requests_queued Requests to the backend waiting for a slot, see --max-inflight\n")
+	fmt.Fprintf(buf, "# TYPE check_graphite_requests_queued gauge\n")
+	fmt.Fprintf(buf, "check_graphite_requests_queued %d\n", atomic.LoadInt64(&conn.queued))
+}
+
+// ServeHTTP() answers /metrics
+func (t *Telemetry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	t.Write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Timing breaks the time of a request down into its phases, to tell what makes it slow
+type Timing struct {
+	DNS      time.Duration // name lookup
+	Connect  time.Duration // TCP connect
+	TLS      time.Duration // TLS handshake
+	TTFB     time.Duration // from the request being sent to the first byte of the response, i.e. server time
+	Download time.Duration // from the first byte until the body is read
+	Parse    time.Duration // from the body being read until the metrics are ready
+
+	Cert *x509.Certificate // the certificate of the server chain that expires first, if https
+
+	URL    string // what was requested, with any password redacted
+	Status string // of the response, or how it was answered without one
+	Size   int    // of the response body, in bytes
+
+	start, dnsStart, connStart, tlsStart, wrote, firstByte, bodyRead time.Time
+}
+
+type timingKey struct{}
+
+// withTiming() returns a context that has the requests made with it record their phases into t
+func withTiming(ctx context.Context, t *Timing) context.Context {
+	return context.WithValue(ctx, timingKey{}, t)
+}
+
+// timingFrom() returns the Timing to record into for a request made with ctx, or nil
+func timingFrom(ctx context.Context) *Timing {
+	t, _ := ctx.Value(timingKey{}).(*Timing)
+	return t
+}
+
+// trace() returns the hooks to record a request into t, and marks its start
+func (t *Timing) trace() *httptrace.ClientTrace {
+	t.start = time.Now()
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.DNS = time.Since(t.dnsStart) },
+		ConnectStart: func(string, string) {
+			t.connStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.Connect = time.Since(t.connStart)
+		},
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			t.TLS = time.Since(t.tlsStart)
+			if err == nil {
+				t.Cert = soonerExpiring(t.Cert, firstExpiring(cs))
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+			if !t.wrote.IsZero() {
+				t.TTFB = t.firstByte.Sub(t.wrote)
+			}
+		},
+	}
+}
+
+// BodyRead() marks the response body as completely read
+func (t *Timing) BodyRead() {
+	t.bodyRead = time.Now()
+	if !t.firstByte.IsZero() {
+		t.Download = t.bodyRead.Sub(t.firstByte)
+	}
+}
+
+// Done() marks the metrics as ready
+func (t *Timing) Done() {
+	if !t.bodyRead.IsZero() {
+		t.Parse = time.Since(t.bodyRead)
+	}
+}
+
+// Phase is the duration of one phase of a request
+type Phase struct {
+	Name string
+	D    time.Duration
+}
+
+// Phases() returns the phases in order
+func (t *Timing) Phases() []Phase {
+	return []Phase{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLS},
+		{"ttfb", t.TTFB},
+		{"download", t.Download},
+		{"parse", t.Parse},
+	}
+}
+
+// String() returns the phases on one line, for verbose output
+func (t *Timing) String() string {
+	parts := []string{}
+	for _, p := range t.Phases() {
+		parts = append(parts, fmt.Sprintf("%s %.06fs", p.Name, p.D.Seconds()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Perf() returns the phases as perfdata, labeled time_<phase>
+func (t *Timing) Perf() []PerfData {
+	perf := []PerfData{}
+	for _, p := range t.Phases() {
+		perf = append(perf, PerfData{Label: "time_" + p.Name, Value: p.D.Seconds(), UOM: "s"})
+	}
+	return perf
+}
+
+// redactURL() returns a URL with the password, if any, replaced
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// Footer() describes the request on one line, to reproduce it
+func (t *Timing) Footer() string {
+	return fmt.Sprintf("GET %s\n    %s, %d bytes, %s", t.URL, t.Status, t.Size, t)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// firstExpiring() returns the certificate of the chain the server sent that expires first, or nil
+func firstExpiring(cs tls.ConnectionState) *x509.Certificate {
+	var first *x509.Certificate
+	for _, cert := range cs.PeerCertificates {
+		first = soonerExpiring(first, cert)
+	}
+	return first
+}
+
+// soonerExpiring() returns whichever of a and b expires first, either of them may be nil
+func soonerExpiring(a, b *x509.Certificate) *x509.Certificate {
+	if a == nil || (b != nil && b.NotAfter.Before(a.NotAfter)) {
+		return b
+	}
+	return a
+}
+
+// certExpiry() tells if cert expires within the given number of days, and when
+func certExpiry(cert *x509.Certificate, days int) (bool, string) {
+	left := time.Until(cert.NotAfter)
+	when := fmt.Sprintf("TLS certificate %q expires %s", cert.Subject.CommonName, cert.NotAfter.Format(G_DATEFORMAT))
+	if left < 0 {
+		when = fmt.Sprintf("TLS certificate %q expired %s", cert.Subject.CommonName, cert.NotAfter.Format(G_DATEFORMAT))
+	} else {
+		when += fmt.Sprintf(", in %d days", int(left.Hours()/24))
+	}
+	return left < time.Duration(days)*24*time.Hour, when
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Trend is what the last run saw, kept in the state to tell how values changed since, for --trend
+type Trend struct {
+	Values map[string]float64 `json:"values"`          // value of each metric
+	Value  *float64           `json:"value,omitempty"` // the value in perfdata, if known
+}
+
+// LoadTrend() reads what the last run saw from the state. The bool return value is false if there's
+// nothing, meaning this is the first run.
+func LoadTrend(st *State) (*Trend, bool, error) {
+	t := &Trend{}
+	found, err := st.Get("trend", t)
+	if t.Values == nil {
+		t.Values = make(map[string]float64)
+	}
+	return t, found, err
+}
+
+// Save() puts what this run saw in the state
+func (t *Trend) Save(st *State) error {
+	return st.Put("trend", t)
+}
+
+// trendWord() returns an arrow for the direction of a change, and if it's for the better or worse
+// when triggering on the condition
+func trendWord(delta float64, condition string) (string, string) {
+	switch {
+	case delta == 0:
+		return "→", "unchanged"
+	case (delta > 0) == (condition == CMP_GT || condition == CMP_GE):
+		if delta > 0 {
+			return "↑", "worse"
+		}
+		return "↓", "worse"
+	case delta > 0:
+		return "↑", "better"
+	default:
+		return "↓", "better"
+	}
+}
+
+// trend_output() lists metrics with how their values changed since the previous run
+func trend_output(ms Metrics, prev map[string]float64, condition string, align int) string {
+	if len(ms) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "===> Changes since the previous run:\n")
+	for _, m := range ms {
+		pv, ok := prev[m.Path]
+		if !ok {
+			fmt.Fprintf(&buf, "%-*s % 12.4f   new\n", align, m.Path, m.Value)
+			continue
+		}
+		arrow, word := trendWord(m.Value-pv, condition)
+		fmt.Fprintf(&buf, "%-*s % 12.4f %s %+.4f %s\n", align, m.Path, m.Value, arrow, m.Value-pv, word)
+	}
+	fmt.Fprintf(&buf, "\n")
+	return buf.String()
+}
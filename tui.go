@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TUI_PROMPT string = "check_graphite> "
+)
+
+// Workbench is the state of the interactive threshold explorer: the series fetched once, and the
+// check flags being tried out on them, as groups of a flag and its value, in the order given
+type Workbench struct {
+	App     *cli.App
+	Target  string
+	MS      Metrics
+	Groups  [][]string
+	aliases map[string]string // any flag name to its first one
+	slices  map[string]bool   // flags that can be repeated
+}
+
+// NewWorkbench() creates a Workbench for the flags of app
+func NewWorkbench(app *cli.App, target string, ms Metrics) *Workbench {
+	wb := &Workbench{
+		App:     app,
+		Target:  target,
+		MS:      ms,
+		aliases: make(map[string]string),
+		slices:  make(map[string]bool),
+	}
+	for _, f := range app.Flags {
+		names := strings.Split(f.GetName(), ",")
+		first := strings.TrimSpace(names[0])
+		for _, name := range names {
+			wb.aliases[strings.TrimSpace(name)] = first
+		}
+		if _, ok := f.(cli.StringSliceFlag); ok {
+			wb.slices[first] = true
+		}
+	}
+	return wb
+}
+
+// flagName() returns the first name of the flag in a group, or "" if it isn't one
+func (wb *Workbench) flagName(group []string) string {
+	name := strings.TrimLeft(group[0], "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	return wb.aliases[name]
+}
+
+// isFlag() tells if a word is the start of a flag and not a negative number
+func isFlag(word string) bool {
+	if !strings.HasPrefix(word, "-") || word == "-" {
+		return false
+	}
+	_, err := strconv.ParseFloat(word, 64)
+	return err != nil
+}
+
+// Set() adds flags, replacing earlier values of flags that can only be given once
+func (wb *Workbench) Set(words []string) error {
+	old := append([][]string{}, wb.Groups...)
+	var groups [][]string
+	for _, w := range words {
+		if isFlag(w) || len(groups) == 0 {
+			groups = append(groups, []string{w})
+			continue
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], w)
+	}
+	for _, g := range groups {
+		name := wb.flagName(g)
+		if name == "" {
+			wb.Groups = old
+			return fmt.Errorf("unknown flag %q", g[0])
+		}
+		if !wb.slices[name] {
+			wb.unset(name)
+		}
+		wb.Groups = append(wb.Groups, g)
+	}
+	// check them at once, rather than at the next evaluation
+	if _, err := wb.evaluator(); err != nil {
+		wb.Groups = old
+		return err
+	}
+	return nil
+}
+
+// unset() removes all values of a flag, by its first name
+func (wb *Workbench) unset(name string) {
+	kept := wb.Groups[:0]
+	for _, g := range wb.Groups {
+		if wb.flagName(g) != name {
+			kept = append(kept, g)
+		}
+	}
+	wb.Groups = kept
+}
+
+// Unset() removes all values of the named flags
+func (wb *Workbench) Unset(names []string) error {
+	for _, n := range names {
+		name := wb.aliases[strings.TrimLeft(n, "-")]
+		if name == "" {
+			return fmt.Errorf("unknown flag %q", n)
+		}
+		wb.unset(name)
+	}
+	return nil
+}
+
+// Args() returns the flags being tried out, as given on a command line
+func (wb *Workbench) Args() []string {
+	var args []string
+	for _, g := range wb.Groups {
+		args = append(args, g...)
+	}
+	return args
+}
+
+// evaluator() creates the evaluator the flags make for, with the point transformations they ask for
+func (wb *Workbench) evaluator() (func(ms Metrics) *Evaluation, error) {
+	c, err := checkContext(wb.App, wb.App.Name, wb.Args())
+	if err != nil {
+		return nil, err
+	}
+	ev, err := NewEvaluator(evaluatorName(c), c)
+	if err != nil {
+		return nil, err
+	}
+	var smooth *Smoothing
+	if spec := c.String("smooth"); spec != "" {
+		if smooth, err = ParseSmoothing(spec); err != nil {
+			return nil, err
+		}
+	}
+	var lastpts *LastPoints
+	if spec := c.String("last-points"); spec != "" {
+		if lastpts, err = ParseLastPoints(spec); err != nil {
+			return nil, err
+		}
+	}
+	return func(ms Metrics) *Evaluation {
+		if smooth != nil {
+			smooth.Apply(ms)
+		}
+		if lastpts != nil {
+			lastpts.Apply(ms)
+		}
+		return ev.Evaluate(ms)
+	}, nil
+}
+
+// metrics() returns a copy of the fetched series, for the transformations to change
+func (wb *Workbench) metrics() Metrics {
+	return wb.MS.Copy()
+}
+
+// Eval() writes the result of a check with the current flags, and the state of each series
+func (wb *Workbench) Eval(w io.Writer) error {
+	evaluate, err := wb.evaluator()
+	if err != nil {
+		return err
+	}
+	ms := wb.metrics()
+	ev := evaluate(ms)
+	fmt.Fprintf(w, "%s: %s\n", statusText(ev.Status), ev.Summary)
+	fmt.Fprint(w, long_output(ev.O, ev.W, ev.C, ms.LongestKey(), 0, false))
+	return nil
+}
+
+// Show() writes the datapoints of the series with a path, or number in the order they were listed
+func (wb *Workbench) Show(w io.Writer, which string) error {
+	ms := wb.metrics()
+	ms.SortByPath()
+	var m *Metric
+	if n, err := strconv.Atoi(which); err == nil && n >= 1 && n <= len(ms) {
+		m = ms[n-1]
+	}
+	for _, cand := range ms {
+		if cand.Path == which {
+			m = cand
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("no series %q, see list", which)
+	}
+	fmt.Fprintf(w, "%s, %d points:\n", m.Path, len(m.Points))
+	for _, p := range m.Points {
+		fmt.Fprintf(w, "  %s %g\n", p.TS.Format(G_DATEFORMAT), p.Value)
+	}
+	return nil
+}
+
+// List() writes the fetched series, numbered for show, with their latest values
+func (wb *Workbench) List(w io.Writer) {
+	ms := wb.metrics()
+	ms.SortByPath()
+	for i, m := range ms {
+		fmt.Fprintf(w, "%3d %-*s %12.4f %s\n", i+1, ms.LongestKey(), m.Path, m.Value, m.TS.Format(G_DATEFORMAT))
+	}
+}
+
+// tui_help() writes the commands of the workbench
+func tui_help(w io.Writer) {
+	fmt.Fprint(w, `Commands:
+  list               List the series, numbered
+  show N|PATH        Show the datapoints of a series
+  set FLAGS...       Try out check flags, e.g. set -w 10 -c 20 --aggregate median
+  unset NAME...      Remove flags, e.g. unset w warning-pct
+  eval               Evaluate the series with the flags set
+  flags              Print the command line for the check, to put in the Nagios config
+  reload             Fetch the series again
+  help               Show this
+  quit               Leave
+`)
+}
+
+// run_tui() fetches the series of a target once, and lets the user try out thresholds and
+// aggregations on them before putting them in the Nagios config
+func run_tui(c *cli.Context) error {
+	app := c.App
+	for p := c.Parent(); p != nil; p = p.Parent() {
+		app = p.App
+	}
+	target := c.Args().First()
+	if target == "" {
+		return cli.NewExitError("No target given", E_UNKNOWN)
+	}
+	window, err := NewWindow(c.String("timeperiod"), c.String("offset"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	base, err := base_url(c.GlobalString("urlprefix"), c.GlobalString("protocol"), c.GlobalString("hostname"), c.GlobalUint64("port"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	ds, err := NewDatasource(c.GlobalString("backend"), base)
+	if err != nil {
+		return cli.NewExitError(err.Error(), E_UNKNOWN)
+	}
+	tmout := c.GlobalFloat64("timeout")
+	fetch := func() (Metrics, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmout*float64(time.Second)))
+		defer cancel()
+		return ds.Fetch(ctx, target, window)
+	}
+
+	ms, err := fetch()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to fetch %q: %v", target, err), E_UNKNOWN)
+	}
+	wb := NewWorkbench(app, target, ms)
+	if flags := c.Args().Tail(); len(flags) > 0 {
+		if err := wb.Set(flags); err != nil {
+			return cli.NewExitError(err.Error(), E_UNKNOWN)
+		}
+	}
+	fmt.Printf("%q matches %d series, \"help\" lists the commands\n", target, len(ms))
+
+	in := bufio.NewScanner(os.Stdin)
+	for fmt.Print(TUI_PROMPT); in.Scan(); fmt.Print(TUI_PROMPT) {
+		words := strings.Fields(in.Text())
+		if len(words) == 0 {
+			continue
+		}
+		var err error
+		switch words[0] {
+		case "list", "ls":
+			wb.List(os.Stdout)
+		case "show":
+			if len(words) != 2 {
+				err = fmt.Errorf("usage: show N|PATH")
+				break
+			}
+			err = wb.Show(os.Stdout, words[1])
+		case "set":
+			if err = wb.Set(words[1:]); err == nil {
+				err = wb.Eval(os.Stdout)
+			}
+		case "unset":
+			if err = wb.Unset(words[1:]); err == nil {
+				err = wb.Eval(os.Stdout)
+			}
+		case "eval":
+			err = wb.Eval(os.Stdout)
+		case "flags":
+			fmt.Printf("%s -m %s -T %s %s\n", app.Name, shellQuote(target), shellQuote(c.String("timeperiod")),
+				strings.Join(shellQuoteAll(wb.Args()), " "))
+		case "reload":
+			var rms Metrics
+			if rms, err = fetch(); err == nil {
+				wb.MS = rms
+				fmt.Printf("%q matches %d series\n", target, len(rms))
+			}
+		case "help", "?":
+			tui_help(os.Stdout)
+		case "quit", "exit", "q":
+			return nil
+		default:
+			err = fmt.Errorf("unknown command %q, see help", words[0])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// shellQuote() quotes a word for a shell, if needed
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteAll() quotes all words for a shell
+func shellQuoteAll(words []string) []string {
+	q := make([]string, len(words))
+	for i, w := range words {
+		q[i] = shellQuote(w)
+	}
+	return q
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+)
+
+// validateArgs() checks the arguments of a check upfront, for what would otherwise make for a
+// nonsense URL or misclassified results, and returns what's wrong with the first bad one
+func validateArgs(c *cli.Context) error {
+	if c.String("metricpath") == "" && c.String("targets-file") == "" {
+		return errors.New("No metric path given, use --metricpath or --targets-file")
+	}
+	if c.String("urlprefix") == "" {
+		if prot := c.String("protocol"); prot != "http" && prot != "https" {
+			return fmt.Errorf("Invalid --protocol %q (options: http, https)", prot)
+		}
+		if port := c.Uint64("port"); port == 0 || port > 65535 {
+			return fmt.Errorf("Invalid --port %d, should be 1-65535", port)
+		}
+	}
+	if tmout := c.Float64("timeout"); tmout <= 0 {
+		return fmt.Errorf("Invalid --timeout %g, should be above 0", tmout)
+	}
+	// unknown conditions would otherwise be taken as lt, which is hardly what was meant
+	for _, name := range []string{"if", "if-warning", "if-critical"} {
+		if cond := c.String(name); cond != "" && validCondition(cond) != cond {
+			return fmt.Errorf("Invalid --%s %q (options: %s, %s, %s, %s)", name, cond, CMP_LT, CMP_LE, CMP_GE, CMP_GT)
+		}
+	}
+	if _, err := parseLabels(c.StringSlice("label")); err != nil {
+		return err
+	}
+	addrs := c.StringSlice("mail-to")
+	if from := c.String("mail-from"); from != "" {
+		addrs = append(addrs, from)
+	}
+	if err := validateAddresses(addrs); err != nil {
+		return err
+	}
+	if c.String("snmp-trap") != "" {
+		if _, err := NewSNMPTrap(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payload templates for webhooks, for the config
+const (
+	WH_GENERIC string = "generic"
+	WH_SLACK   string = "slack"
+	WH_TEAMS   string = "teams"
+
+	DEF_WEBHOOK_TIMEOUT time.Duration = 10 * time.Second
+	DEF_WEBHOOK_QUEUE   int           = 100 // state changes waiting to be posted, before more are dropped
+)
+
+// Webhook is where to POST a JSON payload when a check in the daemon changes state, e.g.:
+//
+//	webhooks:
+//	  - url: https://hooks.slack.com/services/T000/B000/XXXX
+//	    template: slack
+type Webhook struct {
+	URL      string `yaml:"url"`
+	Template string `yaml:"template,omitempty"` // generic, slack or teams, generic if not given
+}
+
+// validate() tells what's wrong with a webhook, if anything
+func (wh Webhook) validate() error {
+	if u, err := url.Parse(wh.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("webhook has an invalid url %q", wh.URL)
+	}
+	switch wh.Template {
+	case "", WH_GENERIC, WH_SLACK, WH_TEAMS:
+		return nil
+	}
+	return fmt.Errorf("webhook to %q has an unknown template %q (options: %s, %s, %s)", wh.URL, wh.Template,
+		WH_GENERIC, WH_SLACK, WH_TEAMS)
+}
+
+// StateChange is what a webhook is told about a check changing state
+type StateChange struct {
+	Check    string            `json:"check"`
+	Host     string            `json:"host,omitempty"`
+	Status   string            `json:"status"`
+	Previous string            `json:"previous_status"`
+	Summary  string            `json:"summary"`
+	Metric   string            `json:"metric,omitempty"` // the one in the worst state
+	Value    *float64          `json:"value,omitempty"`
+	Warn     string            `json:"warn,omitempty"`
+	Crit     string            `json:"crit,omitempty"`
+	Graph    string            `json:"graph,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Time     int64             `json:"time"`
+
+	status int
+}
+
+// NewStateChange() describes the change of a check from the previous status to that of r, linking
+// to the graph of the metric in the worst state, if there are any metrics
+func NewStateChange(r *Result, previous int, gl *GraphLinker) *StateChange {
+	sc := &StateChange{
+		Check:    r.Name,
+		Host:     r.Host,
+		Status:   statusText(r.Status),
+		Previous: statusText(previous),
+		Summary:  r.Summary,
+		Warn:     r.Warn,
+		Crit:     r.Crit,
+		Time:     time.Now().Unix(),
+		status:   r.Status,
+	}
+	if ms := r.Metrics(); len(ms) > 0 {
+		sc.Metric = ms[0].Path
+		sc.Value = &ms[0].Value
+		if gl != nil {
+			sc.Graph = gl.Render(ms[0].Path)
+		}
+	}
+	if len(r.Labels) > 0 {
+		sc.Labels = make(map[string]string, len(r.Labels))
+		for _, l := range r.Labels {
+			sc.Labels[l.Key] = l.Value
+		}
+	}
+	return sc
+}
+
+// text() describes the change for chat, one fact per line
+func (sc *StateChange) text() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s is %s, was %s: %s", sc.Check, sc.Status, sc.Previous, sc.Summary)
+	if sc.Value != nil {
+		fmt.Fprintf(&buf, "\n%s = %g", sc.Metric, *sc.Value)
+		var th []string
+		if sc.Warn != "" {
+			th = append(th, "warning "+sc.Warn)
+		}
+		if sc.Crit != "" {
+			th = append(th, "critical "+sc.Crit)
+		}
+		if len(th) > 0 {
+			fmt.Fprintf(&buf, " (%s)", strings.Join(th, ", "))
+		}
+	}
+	return buf.String()
+}
+
+// color() returns the hex color for the state, as chat cards show it
+func (sc *StateChange) color() string {
+	switch sc.status {
+	case E_OK:
+		return "2EB886"
+	case E_WARNING:
+		return "DAA038"
+	case E_CRITICAL:
+		return "A30200"
+	}
+	return "808080"
+}
+
+// payload() returns the body to post for the template
+func (sc *StateChange) payload(template string) interface{} {
+	switch template {
+	case WH_SLACK:
+		text := sc.text()
+		if sc.Graph != "" {
+			text += fmt.Sprintf("\n<%s|Graph>", sc.Graph)
+		}
+		return map[string]interface{}{
+			"text": fmt.Sprintf("%s is %s", sc.Check, sc.Status), // for notifications
+			"attachments": []map[string]interface{}{
+				{"color": "#" + sc.color(), "text": text},
+			},
+		}
+	case WH_TEAMS:
+		card := map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": sc.color(),
+			"summary":    fmt.Sprintf("%s is %s", sc.Check, sc.Status),
+			"title":      fmt.Sprintf("%s is %s", sc.Check, sc.Status),
+			"text":       strings.Replace(sc.text(), "\n", "\n\n", -1), // Markdown, paragraphs for lines
+		}
+		if sc.Graph != "" {
+			card["potentialAction"] = []map[string]interface{}{{
+				"@type":   "OpenUri",
+				"name":    "Graph",
+				"targets": []map[string]string{{"os": "default", "uri": sc.Graph}},
+			}}
+		}
+		return card
+	}
+	return sc
+}
+
+// Post() sends the change to a webhook
+func (wh Webhook) Post(sc *StateChange) error {
+	return postJSON(wh.URL, nil, sc.payload(wh.Template))
+}
+
+// postJSON() posts body as JSON to an API outside of Graphite, with any extra headers
+func postJSON(u string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("User-Agent", UA)
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Debugf("POST %s", redactURL(u))
+	// not the client for Graphite, which may be set up to dial elsewhere
+	client := &http.Client{Timeout: DEF_WEBHOOK_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", redactURL(u), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Notifier tells the webhooks when a check changes state. The first result of a check is only
+// told about if it isn't OK, as there's nothing to compare it with. It's kept across reloads of the
+// config, so it still knows what state each check was in.
+type Notifier struct {
+	last  map[string]int // status of each check by name
+	mu    sync.Mutex
+	queue chan notification // posted in order, away from the checks, so a slow webhook doesn't hold them up
+	done  chan struct{}     // closed when the queue is drained after Close()
+	once  sync.Once
+}
+
+// notification is a state change to post to webhooks
+type notification struct {
+	sc    *StateChange
+	hooks []Webhook
+}
+
+// NewNotifier() creates a Notifier, and starts posting what it's told about
+func NewNotifier() *Notifier {
+	n := &Notifier{last: make(map[string]int), queue: make(chan notification, DEF_WEBHOOK_QUEUE), done: make(chan struct{})}
+	go n.post()
+	return n
+}
+
+// post() posts the queued state changes until the queue is closed
+func (n *Notifier) post() {
+	defer close(n.done)
+	for nt := range n.queue {
+		for _, wh := range nt.hooks {
+			if err := wh.Post(nt.sc); err != nil {
+				log.Errorf("%s: Unable to notify webhook: %v", nt.sc.Check, err)
+			}
+		}
+	}
+}
+
+// Changed() records the status of a result and returns the previous one, and whether it changed
+func (n *Notifier) Changed(r *Result) (int, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	prev, seen := n.last[r.Name]
+	n.last[r.Name] = r.Status
+	if !seen {
+		return E_OK, r.Status != E_OK
+	}
+	return prev, prev != r.Status
+}
+
+// Notify() queues a post to the hooks if the check of the result changed state. When the queue is
+// full, as when webhooks don't answer, the state change is dropped rather than waited for.
+func (n *Notifier) Notify(r *Result, gl *GraphLinker, hooks []Webhook) {
+	prev, changed := n.Changed(r)
+	if !changed || len(hooks) == 0 {
+		return
+	}
+	select {
+	case n.queue <- notification{sc: NewStateChange(r, prev, gl), hooks: hooks}:
+	default:
+		log.Errorf("%s: Too many webhook posts pending, dropping the change to %s", r.Name, statusText(r.Status))
+	}
+}
+
+// Close() stops taking state changes, and waits for those queued to be posted, for at most timeout
+func (n *Notifier) Close(timeout time.Duration) {
+	n.once.Do(func() { close(n.queue) })
+	select {
+	case <-n.done:
+	case <-time.After(timeout):
+		log.Warnf("Gave up waiting for %d webhook posts", len(n.queue))
+	}
+}
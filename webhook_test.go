@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifierChanged(t *testing.T) {
+	n := NewNotifier()
+	defer n.Close(time.Second)
+	tests := []struct {
+		name    string
+		status  int
+		prev    int
+		changed bool
+	}{
+		{"a", E_OK, E_OK, false},      // first seen as OK is no change
+		{"b", E_CRITICAL, E_OK, true}, // first seen as not OK is
+		{"a", E_OK, E_OK, false},
+		{"a", E_WARNING, E_OK, true},
+		{"a", E_WARNING, E_WARNING, false},
+		{"b", E_CRITICAL, E_CRITICAL, false},
+		{"a", E_CRITICAL, E_WARNING, true},
+		{"b", E_UNKNOWN, E_CRITICAL, true},
+		{"a", E_OK, E_CRITICAL, true},
+	}
+	for i, tt := range tests {
+		prev, changed := n.Changed(&Result{Name: tt.name, Status: tt.status})
+		if prev != tt.prev || changed != tt.changed {
+			t.Errorf("#%d %s to %d: got %d, %v, want %d, %v", i+1, tt.name, tt.status, prev, changed, tt.prev, tt.changed)
+		}
+	}
+}
+
+func TestNotifierNotify(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc := &StateChange{}
+		json.NewDecoder(r.Body).Decode(sc)
+		mu.Lock()
+		posted = append(posted, sc.Check+" "+sc.Status)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	hooks := []Webhook{{URL: ts.URL}}
+	n := NewNotifier()
+	n.Notify(&Result{Name: "a", Status: E_CRITICAL}, nil, hooks)
+	n.Notify(&Result{Name: "a", Status: E_CRITICAL}, nil, hooks)
+	// as after a reload, with the webhooks of the new config, it's still known to have been CRITICAL
+	n.Notify(&Result{Name: "a", Status: E_OK}, nil, []Webhook{{URL: ts.URL}})
+	n.Notify(&Result{Name: "b", Status: E_WARNING}, nil, nil)
+	n.Close(time.Second)
+
+	want := []string{"a CRITICAL", "a OK"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != len(want) || posted[0] != want[0] || posted[1] != want[1] {
+		t.Errorf("got %q posted, want %q", posted, want)
+	}
+}